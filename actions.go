@@ -0,0 +1,224 @@
+// Corporate actions: splits, reverse splits, spin-offs, mergers and
+// code changes (see lots.go for how they affect holdings)
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Show form to edit/create a corporate action. Edits the action if an ID
+// is provided. If zero, adds an action for the stock ID expected in the
+// query string, of the type in the query string (default split).
+func editAction(c *gin.Context) {
+
+	// Get action ID (will be 0 to add)
+	uid := portfolioOwner(c)
+	aid := parseInt(c.Param("aid"))
+	if aid < 0 {
+		c.String(http.StatusNotFound, "Invalid corporate action ID")
+		return
+	}
+
+	// If action ID is zero, create a "blank" action, otherwise get the
+	// action. Blank action requires a stock to be provided as query string.
+	var a *Action
+	if aid == 0 {
+		sid_, _ := c.GetQuery("sid")
+		sid := parseInt(sid_)
+		if sid <= 0 {
+			c.String(http.StatusNotFound, "Missing stock ID, required for adding corporate action")
+			return
+		}
+		a = &Action{Stock: sid, Date: lastTransDate(uid), Type: ActionSplit,
+			RatioOld: 1, RatioNew: 1}
+		if t, ok := c.GetQuery("type"); ok {
+			a.Type = t
+		}
+	} else {
+		a = getAction(uid, aid)
+		if a == nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("Corporate action %d not found", aid))
+			return
+		}
+	}
+
+	// Get the stock as well, and units currently held
+	s := getStock(uid, a.Stock)
+	if s == nil {
+		c.String(http.StatusNotFound, "Stock not found")
+		return
+	}
+	units := unitsHeld(uid, s.Id, today())
+
+	// Show the form to edit action
+	showPage(c, "edit_action.html",
+		gin.H{"a": a, "s": s, "q": units, "types": actionTypes,
+			"stocks": getStocks(uid), "current": "Stocks"})
+}
+
+// Process form to update or add a corporate action
+func saveAction(c *gin.Context) {
+
+	// Get action and stock ID (aid will be 0 to add)
+	uid := portfolioOwner(c)
+	aid_, ok1 := c.GetPostForm("aid")
+	sid_, ok2 := c.GetPostForm("sid")
+	aid := parseInt(aid_)
+	sid := parseInt(sid_)
+	if !ok1 || !ok2 || sid < 0 || aid < 0 {
+		c.String(http.StatusOK, "saveAction: Missing or invalid stock and action IDs")
+		return
+	}
+
+	// Make sure the stock belongs to this user
+	s := getStock(uid, sid)
+	if s == nil {
+		c.String(http.StatusNotFound, "saveAction: stock not found")
+		return
+	}
+
+	// Get the action or create a "blank" one
+	a := &Action{Id: aid, Stock: sid}
+	if aid > 0 {
+		a = getAction(uid, aid)
+		if a == nil {
+			c.String(http.StatusNotFound, "saveAction: not found")
+			return
+		}
+	}
+
+	// Update the action with the form inputs; blank numbers are zero,
+	// except for cost fraction, see below
+	ds, _ := c.GetPostForm("date")
+	a.Date = parseDate(ds)
+	a.Type, _ = c.GetPostForm("type")
+	a.RatioOld = parseFloatOr(c.PostForm("ratio_old"), 0)
+	a.RatioNew = parseFloatOr(c.PostForm("ratio_new"), 0)
+	a.NewStock = parseIntOr(c.PostForm("new_stock"), 0)
+	a.CostFraction = parseFloatOr(c.PostForm("cost_fraction"), -1)
+	a.Cash = parseFloatOr(c.PostForm("cash"), 0)
+	a.NewCode = strings.TrimSpace(c.PostForm("new_code"))
+	a.Comments, _ = c.GetPostForm("comments")
+
+	// Validate according to type of action
+	if msg := validateAction(uid, a); msg != "" {
+		c.String(http.StatusOK, "Invalid inputs: "+msg)
+		return
+	}
+
+	// A new code change renames the stock, remembering the old code
+	if a.Type == ActionCodeChange && aid == 0 {
+		a.OldCode = s.Code
+		s.Code = a.NewCode
+		addUpdateStock(uid, s)
+	}
+
+	// Create or update action in database
+	addUpdateAction(uid, a)
+
+	// Remember the last transaction date for next entry
+	setLastTransDate(uid, a.Date)
+
+	// Go back to stock page
+	c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", sid))
+}
+
+// Check the fields of a corporate action according to its type, and set
+// default cost fraction if blank. Returns an error message, or blank if ok.
+func validateAction(uid int, a *Action) string {
+
+	// Checks for all types
+	if !validDate(a.Date) {
+		return "invalid date"
+	}
+	if a.Cash < 0 {
+		return "cash cannot be negative"
+	}
+	if a.NewStock != 0 && (a.NewStock == a.Stock || getStock(uid, a.NewStock) == nil) {
+		return "invalid new stock"
+	}
+
+	switch a.Type {
+
+	case ActionSplit:
+		if a.RatioOld <= 0 || a.RatioNew <= 0 || a.RatioOld == a.RatioNew {
+			return "split requires different positive old and new units"
+		}
+		a.NewStock, a.CostFraction = 0, 0
+
+	case ActionSpinOff:
+		if a.NewStock == 0 {
+			return "spin-off requires the new stock"
+		}
+		if a.RatioOld <= 0 || a.RatioNew <= 0 {
+			return "spin-off requires positive old and new units"
+		}
+		if a.CostFraction < 0 || a.CostFraction > 1 {
+			return "spin-off requires a cost fraction between 0 and 1"
+		}
+
+	case ActionMerger:
+		if a.NewStock == 0 && a.Cash == 0 {
+			return "merger requires a new stock, cash, or both"
+		}
+		if a.NewStock != 0 && (a.RatioOld <= 0 || a.RatioNew <= 0) {
+			return "merger into a stock requires positive old and new units"
+		}
+		if a.CostFraction < 0 { // default: all cost to new stock, if any
+			a.CostFraction = 0
+			if a.NewStock != 0 {
+				a.CostFraction = 1
+			}
+		}
+		if a.CostFraction > 1 || (a.NewStock == 0 && a.CostFraction != 0) {
+			return "invalid cost fraction"
+		}
+
+	case ActionCodeChange:
+		if len(a.NewCode) == 0 {
+			return "code change requires the new code"
+		}
+		a.NewStock, a.CostFraction, a.Cash = 0, 0, 0
+
+	default:
+		return "unknown type of corporate action"
+	}
+
+	// Cost fraction is only used for spin-offs and mergers
+	if a.CostFraction < 0 {
+		a.CostFraction = 0
+	}
+	return ""
+}
+
+// Delete a corporate action. If it was a code change, the stock gets
+// its old code back, unless it has been renamed since.
+func doDeleteAction(c *gin.Context) {
+
+	// Get the action (URL positional param)
+	uid := portfolioOwner(c)
+	aid := parseInt(c.Param("aid"))
+	a := getAction(uid, aid)
+	if aid <= 0 || a == nil {
+		c.String(http.StatusNotFound, "Corporate action not found")
+		return
+	}
+
+	// Undo code change
+	if a.Type == ActionCodeChange {
+		s := getStock(uid, a.Stock)
+		if s != nil && s.Code == a.NewCode && len(a.OldCode) > 0 {
+			s.Code = a.OldCode
+			addUpdateStock(uid, s)
+		}
+	}
+
+	// Delete action and go back to stock page
+	deleteAction(uid, aid)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", a.Stock))
+}
@@ -0,0 +1,114 @@
+// Allocation: current value of holdings and cash, grouped by asset class,
+// sector, region, currency, account or tag
+
+package main
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Value of the holdings in one group, and percentage of the total
+type Allocation struct {
+	Group   string
+	Value   float64 // in home currency
+	Percent float64
+}
+
+// Show page with allocation table and charts, grouped by the grouping in
+// the query string (default asset class)
+func showAllocation(c *gin.Context) {
+
+	// Get grouping, which may also be by account
+	by := c.DefaultQuery("by", "class")
+	gg := append(slices.Clone(groupings), Grouping{"account", "Account"})
+
+	// Get allocation today, and lists of labels and values for the charts
+	uid := portfolioOwner(c)
+	today := time.Now()
+	alloc := getAllocation(uid, today, by)
+	labels, values := []string{}, []float64{}
+	var total float64
+	for _, a := range alloc {
+		labels = append(labels, a.Group)
+		values = append(values, a.Value)
+		total += a.Value
+	}
+
+	// Show page
+	showPage(c, "allocation.html",
+		gin.H{"d": today, "by": by, "groupings": gg, "alloc": alloc, "total": total,
+			"labels": labels, "values": values, "home": homeCurrency, "current": "Allocation"})
+}
+
+// Get the allocation of a user's portfolio on a date, as the value of
+// holdings (see getPortfolio) and cash (see cashBalances) in each group,
+// largest first. Cash is its own group, except by currency or account.
+// A stock with several tags has its value split equally between them,
+// so the percentages add up to 100.
+func getAllocation(uid int, d time.Time, by string) []Allocation {
+
+	// Add up value of holdings in each group
+	values := map[string]float64{}
+	for _, h := range getPortfolio(uid, d, true) {
+		if by == "account" {
+			for acct, q := range h.Accounts {
+				values[accountName(acct)] += h.CurValue * q / h.Units
+			}
+			continue
+		}
+		for g, share := range groupShares(&h.Stock, by) {
+			values[g] += h.CurValue * share
+		}
+	}
+
+	// Add cash
+	rates := newRates(uid)
+	switch by {
+	case "currency":
+		for _, b := range cashBalances(uid, d, rates) {
+			values[b.Currency] += b.Value
+		}
+	case "account":
+		for acct, v := range cashByAccount(uid, d, rates) {
+			values[accountName(acct)] += v
+		}
+	default:
+		for _, b := range cashBalances(uid, d, rates) {
+			values["Cash"] += b.Value
+		}
+	}
+
+	// Convert to list, leaving out empty groups, and work out percentages
+	alloc := []Allocation{}
+	var total float64
+	for g, v := range values {
+		if v > 0.005 || v < -0.005 {
+			alloc = append(alloc, Allocation{Group: g, Value: v})
+			total += v
+		}
+	}
+	for i := range alloc {
+		if total != 0 {
+			alloc[i].Percent = alloc[i].Value / total * 100
+		}
+	}
+	sort.Slice(alloc, func(i, j int) bool {
+		if alloc[i].Value != alloc[j].Value {
+			return alloc[i].Value > alloc[j].Value
+		}
+		return alloc[i].Group < alloc[j].Group
+	})
+	return alloc
+}
+
+// Name of an account for display, "Main" for the main (blank) account
+func accountName(acct string) string {
+	if acct == "" {
+		return "Main"
+	}
+	return acct
+}
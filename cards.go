@@ -0,0 +1,128 @@
+// Holding cards: a summary of each stock held, with its price trajectory,
+// annualized return, and where its gain came from
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Summary of a holding for a card on the Stocks page
+type HoldingCard struct {
+	Holding
+	Since        time.Time // date of the first purchase
+	Years        float64   // years since the first purchase
+	Annualized   float64   // money-weighted return, percent a year
+	Annualize    bool      // held at least a year, and the return could be worked out
+	Gain         float64   // value plus money received less money paid
+	PriceGain    float64   // part of the gain from the stock's price
+	DividendGain float64   // part of the gain from dividends
+	CurrencyGain float64   // part of the gain from exchange rates
+	Prices       []float64 // split-adjusted prices for the sparkline
+}
+
+// Days of prices shown in a sparkline, up to the latest
+const sparklineDays = 365
+
+// Make a card for a holding on a date. The gain since the first purchase
+// is split into dividends, the effect of exchange rates since then (see
+// fxEffect), and the rest from the price.
+func getHoldingCard(uid int, h Holding, d time.Time, rates *Rates) HoldingCard {
+
+	// Money paid for purchases, less money received from sales and
+	// corporate actions, up to the date
+	card := HoldingCard{Holding: h}
+	trades := []valueFlow{}
+	for _, t := range getTransactions(uid, h.Stock.Id) {
+		if later(t.Date, d) {
+			continue
+		}
+		if card.Since.IsZero() && t.Q > 0 {
+			card.Since = t.Date
+		}
+		if t.Q > 0 {
+			trades = append(trades, valueFlow{t.Date, t.Amount})
+		} else {
+			trades = append(trades, valueFlow{t.Date, -t.Amount})
+		}
+	}
+	for _, a := range getActions(uid, h.Stock.Id) {
+		if a.Cash != 0 && !later(a.Date, d) {
+			trades = append(trades, valueFlow{a.Date, -a.Cash})
+		}
+	}
+
+	// Dividends are money received too, for the annualized return
+	flows := append([]valueFlow{}, trades...)
+	for _, div := range getDividends(uid, h.Stock.Id) {
+		if !later(div.Date, d) {
+			card.DividendGain += div.Amount
+			flows = append(flows, valueFlow{div.Date, -div.Amount})
+		}
+	}
+
+	// Gain, and its components
+	card.Gain = h.CurValue
+	for _, f := range flows {
+		card.Gain -= f.amount
+	}
+	if !card.Since.IsZero() {
+		card.Years = d.Sub(card.Since).Hours() / 24 / 365.25
+		card.CurrencyGain = fxEffect(rates, h.Stock.Currency, card.Since, d, h.CurValue, trades)
+		r := annualizedReturn(flows, d, h.CurValue)
+		card.Annualize = card.Years >= 1 && !math.IsNaN(r)
+		if card.Annualize {
+			card.Annualized = r * 100
+		}
+	}
+	card.PriceGain = card.Gain - card.DividendGain - card.CurrencyGain
+
+	// Prices over a year up to the last price on the date
+	pp := []Price{}
+	for _, p := range getAdjustedPrices(uid, h.Stock.Id) {
+		if !later(p.Date, d) {
+			pp = append(pp, p)
+		}
+	}
+	for _, p := range pp {
+		if !p.Date.Before(pp[len(pp)-1].Date.AddDate(0, 0, -sparklineDays)) {
+			card.Prices = append(card.Prices, p.Price)
+		}
+	}
+	return card
+}
+
+// Money-weighted annual return of flows into an investment (negative for
+// money taken out) that is worth a value on a date, i.e., the rate at
+// which the flows would grow to the value. NaN if there is no such rate
+// between -99% and 10,000% a year.
+func annualizedReturn(flows []valueFlow, d time.Time, value float64) float64 {
+
+	// Value of the flows on the date at a rate, less the actual value
+	excess := func(r float64) float64 {
+		fv := -value
+		for _, f := range flows {
+			years := d.Sub(f.date).Hours() / 24 / 365.25
+			fv += f.amount * math.Pow(1+r, years)
+		}
+		return fv
+	}
+
+	// Bisection, as the excess rises with the rate if more money was put
+	// in than taken out
+	lo, hi := -0.99, 100.0
+	elo, ehi := excess(lo), excess(hi)
+	if len(flows) == 0 || elo*ehi > 0 {
+		return math.NaN()
+	}
+	for i := 0; i < 100 && hi-lo > 1e-9; i++ {
+		mid := (lo + hi) / 2
+		if e := excess(mid); (e < 0) == (elo < 0) {
+			lo, elo = mid, e
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
@@ -4,8 +4,11 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,21 +17,106 @@ import (
 // Show page with cash balance and transaction history
 func showCashPage(c *gin.Context) {
 
-	// Get cash transactions up to today
-	today := time.Now()
-	trans := getAllCash(today) // including "virtual" buy/sell
+	// Get cash transactions up to the date asked for, default today
+	uid := portfolioOwner(c)
+	asOf := getAsOf(c)
+	rates := newRates(uid)
+	trans := getAllCash(uid, asOf.Date, rates) // including "virtual" buy/sell
+
+	// Running balance in the currency of each transaction
+	running := map[string]float64{}
+	for i := range trans {
+		running[trans[i].Currency] += trans[i].Amount
+		trans[i].Balance = running[trans[i].Currency]
+	}
+
+	// Get balance in each currency on the date, and total in home currency
+	balances := cashBalances(uid, asOf.Date, rates)
+	var total float64
+	for _, b := range balances {
+		total += b.Value
+	}
+
+	// Show page
+	showPage(c, "cash.html",
+		gin.H{"d": asOf.Date, "asof": asOf, "transactions": trans, "balances": balances, "balance": total,
+			"home": homeCurrency, "current": "Cash"})
+}
+
+// Totals of a user's cash transactions in one account and year, by
+// category, in home currency
+type CashSummary struct {
+	Year    int
+	Account string             // blank for the main account
+	Totals  map[string]float64 // total for each category
+	Holding float64            // interest less fees and taxes
+}
 
-	// TODO: get cash value today, just sum of table above
-	// Get cash value today
-	var cash float64
-	for _, c := range getAllCash(today) {
-		cash += c.Amount
+// Show page with cash totals per year, account and category, e.g., to see
+// the cost of holding each account
+func showCashSummary(c *gin.Context) {
+
+	// Get totals, and the categories that have any transactions
+	uid := portfolioOwner(c)
+	summary := getCashSummary(uid, time.Now())
+	cats := []string{}
+	for _, cat := range cashCategories {
+		for _, s := range summary {
+			if _, ok := s.Totals[cat]; ok {
+				cats = append(cats, cat)
+				break
+			}
+		}
 	}
 
 	// Show page
-	c.HTML(http.StatusOK, "cash.html",
-		gin.H{"d": today, "transactions": trans, "balance": cash,
-			"menu": menu, "current": "Cash"})
+	showPage(c, "cash_summary.html",
+		gin.H{"summary": summary, "categories": cats, "home": homeCurrency, "current": "Cash"})
+}
+
+// Get totals of a user's cash transactions up to a date, per year and
+// account (latest year first), and per category, converted to home
+// currency at the rate on the date of each transaction. Transactions in
+// currencies without rates are left out.
+func getCashSummary(uid int, d time.Time) []CashSummary {
+
+	// Accumulate per year and account
+	type key struct {
+		year    int
+		account string
+	}
+	sums := map[key]*CashSummary{}
+	rates := newRates(uid)
+	for _, c := range getAllCash(uid, d, rates) {
+		rate, ok := rates.On(c.Currency, c.Date)
+		if !ok {
+			continue
+		}
+		k := key{c.Date.Year(), c.Account}
+		s, ok := sums[k]
+		if !ok {
+			s = &CashSummary{Year: k.year, Account: k.account, Totals: map[string]float64{}}
+			sums[k] = s
+		}
+		cat := cashCategory(c.Type)
+		s.Totals[cat] += c.Amount * rate
+		if cat == "Interest" || cat == "Fees" || cat == "Taxes" {
+			s.Holding += c.Amount * rate
+		}
+	}
+
+	// Convert to a sorted list
+	ss := []CashSummary{}
+	for _, s := range sums {
+		ss = append(ss, *s)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].Year != ss[j].Year {
+			return ss[i].Year > ss[j].Year
+		}
+		return ss[i].Account < ss[j].Account
+	})
+	return ss
 }
 
 // Page to show one cash transaction
@@ -36,21 +124,22 @@ func showCash(c *gin.Context) {
 
 	// Parse the ID and get the cash transaction
 	tid := parseInt(c.Param("id"))
-	t := getCashTransaction(tid)
+	t := getCashTransaction(portfolioOwner(c), tid)
 	if t == nil {
-		c.String(http.StatusOK, fmt.Sprintf("Cash %d not found", tid))
+		c.String(http.StatusNotFound, fmt.Sprintf("Cash %d not found", tid))
 		return
 	}
 
 	// Show page
-	c.HTML(http.StatusOK, "cash_trans.html",
-		gin.H{"c": t, "menu": menu, "current": "Cash"})
+	showPage(c, "cash_trans.html",
+		gin.H{"c": t, "current": "Cash"})
 }
 
 // Show form to edit/create a cash transaction
 func editCash(c *gin.Context) {
 
 	// Get cash ID (will be 0 to add)
+	uid := portfolioOwner(c)
 	tid := parseInt(c.Param("id"))
 	if tid < 0 {
 		c.String(http.StatusOK, "Invalid cash ID")
@@ -60,30 +149,33 @@ func editCash(c *gin.Context) {
 	// Get the cash transaction or create "blank" cash
 	t := &Cash{}
 	if tid > 0 {
-		t = getCashTransaction(tid)
+		t = getCashTransaction(uid, tid)
 		if t == nil {
 			c.String(http.StatusOK, "Cash not found")
 			return
 		}
 	} else {
-		t.Date = lastTransDate
-		t.Type = cashTypes[0]
+		t.Date = lastTransDate(uid)
+		t.Type = cashTypes[0].Name
+		t.Currency = homeCurrency
 	}
 
-	// Adjust withdrawal amounts to be positive
-	if t.Type == "Withdrawal" {
-		t.Amount *= -1.0
+	// Adjust amounts to be entered as positive, e.g., withdrawals
+	if ct := cashType(t.Type); ct != nil {
+		t.Amount *= ct.Sign
 	}
 
 	// Show the form to edit cash
-	c.HTML(http.StatusOK, "edit_cash.html",
-		gin.H{"c": t, "types": cashTypes, "menu": menu, "current": "Cash"})
+	showPage(c, "edit_cash.html",
+		gin.H{"c": t, "types": cashTypes, "currencies": currencies,
+			"accounts": getAccounts(uid), "current": "Cash"})
 }
 
 // Process form to update or add a cash transaction
 func saveCash(c *gin.Context) {
 
 	// Get cash ID (will be 0 to add a cash)
+	uid := portfolioOwner(c)
 	tid_, ok := c.GetPostForm("id")
 	if !ok {
 		c.String(http.StatusOK, "saveCash: Missing cash ID")
@@ -98,7 +190,7 @@ func saveCash(c *gin.Context) {
 	// Get the cash or create "blank" cash
 	t := &Cash{}
 	if tid > 0 {
-		t = getCashTransaction(tid)
+		t = getCashTransaction(uid, tid)
 		if t == nil {
 			c.String(http.StatusOK, "saveCash: cash not found")
 			return
@@ -111,24 +203,53 @@ func saveCash(c *gin.Context) {
 	t.Type, _ = c.GetPostForm("type")
 	amt, _ := c.GetPostForm("amount")
 	t.Amount = parseFloat(amt)
+	t.Currency = strings.TrimSpace(c.PostForm("currency"))
+	t.Account = strings.TrimSpace(c.PostForm("account"))
 	t.Comments, _ = c.GetPostForm("comments")
 
 	// Some validation
-	if !validDate(t.Date) || t.Amount == 0 {
-		c.String(http.StatusOK, "Invalid date, or amount is zero")
+	ct := cashType(t.Type)
+	if !validDate(t.Date) || t.Amount == 0 || ct == nil {
+		c.String(http.StatusOK, "Invalid date or type, or amount is zero")
 		return
 	}
+	if t.Currency == "" {
+		t.Currency = homeCurrency
+	}
 
-	// If a withdrawal, make amount negative
-	if t.Type == "Withdrawal" {
-		t.Amount *= -1.0
+	// Amount is entered as positive, make negative if money out
+	t.Amount = math.Abs(t.Amount) * ct.Sign
+
+	// A transfer moves the amount to another account
+	t.Account2 = ""
+	if t.Type == "Transfer" {
+		t.Account2 = strings.TrimSpace(c.PostForm("account2"))
+		if t.Account2 == t.Account {
+			c.String(http.StatusOK, "Invalid inputs: transfer requires a different account")
+			return
+		}
+	}
+
+	// An FX conversion sells the amount in one currency and buys another,
+	// either entered or at the rate given
+	t.Currency2, t.Amount2 = "", 0
+	if t.Type == "FX conversion" {
+		t.Currency2 = strings.TrimSpace(c.PostForm("currency2"))
+		t.Amount2 = parseFloatOr(c.PostForm("amount2"), 0)
+		if t.Amount2 == 0 {
+			t.Amount2 = -t.Amount * parseFloatOr(c.PostForm("rate"), 0)
+		}
+		if t.Currency2 == "" || t.Currency2 == t.Currency || t.Amount2 <= 0 {
+			c.String(http.StatusOK, "Invalid inputs: FX conversion requires another currency, and the amount bought or the rate")
+			return
+		}
 	}
 
 	// Create or update transaction in database
-	addUpdateCash(t)
+	addUpdateCash(uid, t)
 
 	// Remember last transaction date
-	lastTransDate = t.Date
+	setLastTransDate(uid, t.Date)
 
 	// Go back to cash page or list
 	if tid == 0 {
@@ -138,41 +259,71 @@ func saveCash(c *gin.Context) {
 	}
 }
 
-// Delete cash: ask for confirmation first
+// Delete cash: show form to ask for confirmation first, which
+// posts to doDeleteCash()
 func delCash(c *gin.Context) {
 
 	// Get the cash (URL positional param)
+	uid := portfolioOwner(c)
 	tid := parseInt(c.Param("id"))
-	t := getCashTransaction(tid)
+	t := getCashTransaction(uid, tid)
 	if tid <= 0 || t == nil {
 		c.String(http.StatusOK, "Cash not found")
 		return
 	}
 
-	// Ask for confirmation, or go ahead and delete if confirmed
-	confirm, _ := c.GetQuery("confirm")
-	if confirm == "" { // no confirmation, show form
-		c.HTML(http.StatusOK, "del_cash.html", gin.H{"c": t, "menu": menu, "current": "Cash"})
-	} else if confirm == "yes" { // confirmed, delete cash
-		deleteCash(tid)
-		c.Redirect(http.StatusFound, "/Cash")
-	} else { // confirmation denied, back to cash page
-		c.Redirect(http.StatusFound, fmt.Sprintf("/cash/%d", tid))
+	// Ask for confirmation
+	showPage(c, "del_cash.html", gin.H{"c": t, "current": "Cash"})
+}
+
+// Delete cash transaction, after confirmation
+func doDeleteCash(c *gin.Context) {
+
+	// Get the cash (URL positional param)
+	uid := portfolioOwner(c)
+	tid := parseInt(c.Param("id"))
+	t := getCashTransaction(uid, tid)
+	if tid <= 0 || t == nil {
+		c.String(http.StatusNotFound, "Cash not found")
+		return
 	}
+
+	// Delete transaction and go back to cash page
+	deleteCash(uid, tid)
+	c.Redirect(http.StatusFound, "/Cash")
 }
 
-// Get cash transactions up to a particular date, including
-// "virtual" buy/sell and dividends
-func getAllCash(d time.Time) []Cash {
+// Get a user's cash transactions up to a particular date, including
+// "virtual" buy/sell and dividends, using exchange rates to convert cash
+// from corporate actions
+func getAllCash(uid int, d time.Time, rates *Rates) []Cash {
 
-	// Get all explicit transactions, e.g., deposits & withdrawals
-	cc := getCashTransactions()
+	// Get all explicit transactions, e.g., deposits & withdrawals. An FX
+	// conversion is split into the currency sold and the currency bought,
+	// and a transfer into the accounts moved from and to.
+	cc := []Cash{}
+	for _, c := range getCashTransactions(uid) {
+		cc = append(cc, c)
+		if c.Type == "FX conversion" {
+			c2 := c
+			c2.Currency, c2.Amount = c.Currency2, c.Amount2
+			cc = append(cc, c2)
+		} else if c.Type == "Transfer" {
+			c2 := c
+			c2.Account, c2.Amount = c.Account2, -c.Amount
+			cc = append(cc, c2)
+		}
+	}
 
-	// Transactions: buy reduces cash, sell increases cash
-	tt := getTransactions(0)
+	// Transactions: buy reduces cash, sell increases cash, in the currency
+	// they were settled in
+	tt := getTransactions(uid, 0)
 	for _, t := range tt {
-		s := getStock(t.Stock)
-		a := t.Amount
+		s := getStock(uid, t.Stock)
+		a, cur := t.Amount, homeCurrency
+		if t.Currency != "" {
+			a, cur = t.AmountX, t.Currency
+		}
 		q := t.Q
 		ttype := "Sell"
 		if q > 0 {
@@ -181,25 +332,141 @@ func getAllCash(d time.Time) []Cash {
 			q *= -1
 		}
 		cmt := fmt.Sprintf("%s %.1f %s", ttype, t.Q, s.Name)
-		c := Cash{Type: ttype, Id: t.Id, Date: t.Date, Amount: a, Comments: cmt}
+		c := Cash{Type: ttype, Id: t.Id, Date: t.Date, Account: t.Account, Currency: cur,
+			Amount: a, Comments: cmt}
 		cc = append(cc, c)
 	}
 
 	// Dividends increase cash
-	dd := getDividends(0)
+	dd := getDividends(uid, 0)
 	for _, d := range dd {
-		s := getStock(d.Stock)
+		s := getStock(uid, d.Stock)
 		cmt := fmt.Sprintf("Dividends on %s", s.Name)
-		c := Cash{Type: "Dividends", Id: d.Id, Date: d.Date, Amount: d.Amount, Comments: cmt}
+		a, cur := d.Amount, homeCurrency
+		if d.Currency != "" {
+			a, cur = d.Net, d.Currency
+		}
+		c := Cash{Type: "Dividends", Id: d.Id, Date: d.Date, Currency: cur, Amount: a, Comments: cmt}
 		cc = append(cc, c)
 	}
 
-	// TODO: filter by date
+	// Cash received from corporate actions, e.g., cash in lieu of
+	// fractional shares, or cash paid in a merger. The amount is in home
+	// currency, but is paid in the stock's currency, so is converted back
+	// at the rate on the date (left in home currency if there is none).
+	for _, a := range getActions(uid, 0) {
+		if a.Cash > 0 {
+			s := getStock(uid, a.Stock)
+			cmt := fmt.Sprintf("%s of %s", a.Type, s.Name)
+			amt, cur := a.Cash, homeCurrency
+			if s.Currency != "" && s.Currency != homeCurrency {
+				if rate, ok := rates.On(s.Currency, a.Date); ok && rate > 0 {
+					amt, cur = a.Cash/rate, s.Currency
+				}
+			}
+			c := Cash{Type: "Corporate action", Id: a.Id, Date: a.Date, Currency: cur,
+				Amount: amt, Comments: cmt}
+			cc = append(cc, c)
+		}
+	}
 
-	// Sort by ascending date
-	sort.Slice(cc, func(i, j int) bool {
+	// Leave out transactions after the date, and sort by ascending date
+	cc = slices.DeleteFunc(cc, func(c Cash) bool {
+		return later(c.Date, d)
+	})
+	sort.SliceStable(cc, func(i, j int) bool {
 		return cc[i].Date.Before(cc[j].Date)
 	})
 
 	return cc
 }
+
+// Cash balance in one currency
+type CashBalance struct {
+	Currency string  // currency code
+	Amount   float64 // balance in the currency
+	Rate     float64 // exchange rate to home currency, 0 if unknown
+	Value    float64 // balance in home currency, 0 if rate unknown
+}
+
+// Get a user's cash balance in each currency on a date, home currency
+// first, valued in home currency at the latest rate on the date
+func cashBalances(uid int, d time.Time, rates *Rates) []CashBalance {
+
+	// Sum transactions in each currency
+	sums := map[string]float64{homeCurrency: 0}
+	for _, c := range getAllCash(uid, d, rates) {
+		sums[c.Currency] += c.Amount
+	}
+
+	// Value each in home currency, leaving out foreign currencies with
+	// no balance
+	bb := []CashBalance{}
+	for cur, amt := range sums {
+		if cur != homeCurrency && math.Abs(amt) < 0.005 {
+			continue
+		}
+		b := CashBalance{Currency: cur, Amount: amt}
+		if rate, ok := rates.On(cur, d); ok {
+			b.Rate = rate
+			b.Value = amt * rate
+		}
+		bb = append(bb, b)
+	}
+	sort.Slice(bb, func(i, j int) bool {
+		if bb[i].Currency == homeCurrency || bb[j].Currency == homeCurrency {
+			return bb[i].Currency == homeCurrency
+		}
+		return bb[i].Currency < bb[j].Currency
+	})
+	return bb
+}
+
+// Get a user's cash balance in each account on a date, in home currency
+// at the latest rates on the date (leaving out currencies with no rate)
+func cashByAccount(uid int, d time.Time, rates *Rates) map[string]float64 {
+
+	// Sum transactions in each account and currency
+	type key struct{ account, currency string }
+	sums := map[key]float64{}
+	for _, c := range getAllCash(uid, d, rates) {
+		sums[key{c.Account, c.Currency}] += c.Amount
+	}
+
+	// Convert each to home currency
+	accts := map[string]float64{}
+	for k, amt := range sums {
+		if rate, ok := rates.On(k.currency, d); ok {
+			accts[k.account] += amt * rate
+		}
+	}
+	return accts
+}
+
+// Get a type of cash transaction entered by the user by name, nil if
+// not found
+func cashType(name string) *CashType {
+	for i := range cashTypes {
+		if cashTypes[i].Name == name {
+			return &cashTypes[i]
+		}
+	}
+	return nil
+}
+
+// Category of a cash transaction for reporting, including the "virtual"
+// transactions from getAllCash()
+func cashCategory(ttype string) string {
+	switch ttype {
+	case "Buy", "Sell":
+		return "Trades"
+	case "Dividends":
+		return "Dividends"
+	case "Corporate action":
+		return "Corporate actions"
+	}
+	if ct := cashType(ttype); ct != nil {
+		return ct.Category
+	}
+	return "Other"
+}
@@ -0,0 +1,207 @@
+// Period comparison: how the value of each holding changed between two
+// dates, from purchases, sales, prices and exchange rates
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Change in the value of a holding, or all holdings, between two dates, in
+// home currency. Start + Purchases - Sales + PriceChange + FxEffect = End.
+type PeriodChange struct {
+	Stock       Stock    // zero for the total
+	Start       float64  // value at the start
+	Purchases   float64  // paid for units bought, including fees
+	Sales       float64  // received for units sold, and cash from corporate actions
+	Dividends   float64  // received, not part of the value
+	PriceChange float64  // change in value from the stock's price
+	FxEffect    float64  // change in value from exchange rates
+	End         float64  // value at the end
+	StartPrice  *PriceAt // price used for the start value, nil if none held
+	EndPrice    *PriceAt // price used for the end value, nil if none held
+	Return      float64  // percent, including dividends (Modified Dietz)
+	invested    float64  // start value plus flows weighted by time invested
+}
+
+// Money put into a holding on a date, negative if taken out
+type valueFlow struct {
+	date   time.Time
+	amount float64
+}
+
+// Total gain: change in value not from purchases or sales, plus dividends
+func (pc *PeriodChange) Gain() float64 {
+	return pc.PriceChange + pc.FxEffect + pc.Dividends
+}
+
+// Show page comparing holdings on two dates, from the query string (default
+// from the end of last year to today), with a waterfall of the total change,
+// valued using the price policy in the query string (see reportPricePolicy)
+func showComparison(c *gin.Context) {
+
+	// Get dates, and make sure they are in order
+	uid := portfolioOwner(c)
+	now := today()
+	from := time.Date(now.Year()-1, 12, 31, 0, 0, 0, 0, time.UTC)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if d := parseDate(c.Query("from")); c.Query("from") != "" && validDate(d) {
+		from = d
+	}
+	if d := parseDate(c.Query("to")); c.Query("to") != "" && validDate(d) {
+		to = d
+	}
+	if to.Before(from) {
+		from, to = to, from
+	}
+
+	// Changes in each holding, and the total
+	policy := reportPricePolicy(c.Query)
+	changes := getPeriodChanges(uid, from, to, policy)
+	total := changes[len(changes)-1]
+	labels := []string{"Start", "Purchases", "Sales", "Prices", "Exchange rates", "End"}
+	values := []float64{total.Start, total.Purchases, -total.Sales, total.PriceChange,
+		total.FxEffect, total.End}
+
+	// Show page
+	showPage(c, "comparison.html",
+		gin.H{"from": from, "to": to, "changes": changes, "total": total,
+			"policy": policy, "methods": priceMethods, "labels": labels, "values": values, "home": homeCurrency, "current": "Performance"})
+}
+
+// Get the change in value of each of a user's holdings between two dates,
+// for stocks held on either date or bought or sold between them, and the
+// total last. Flows are transactions and dividends after the start date,
+// up to and including the end date. The effect of exchange rates is the
+// change in value less what it would have been at the start date's rate.
+// Stocks are valued using a price policy.
+func getPeriodChanges(uid int, from, to time.Time, policy PricePolicy) []PeriodChange {
+
+	// Units held on each date, and exchange rates
+	units := unitsOnDates(uid, []time.Time{from, to})
+	rates := newRates(uid)
+	inPeriod := func(d time.Time) bool {
+		return d.After(from) && !later(d, to)
+	}
+	weight := func(d time.Time) float64 {
+		if !to.After(from) {
+			return 0
+		}
+		return float64(to.Sub(d)) / float64(to.Sub(from))
+	}
+
+	// Changes for each stock, from values and flows
+	changes := map[int]*PeriodChange{}
+	flows := map[int][]valueFlow{}
+	change := func(sid int) *PeriodChange {
+		if changes[sid] == nil {
+			changes[sid] = &PeriodChange{}
+		}
+		return changes[sid]
+	}
+	for _, t := range getTransactions(uid, 0) {
+		if !inPeriod(t.Date) {
+			continue
+		}
+		pc := change(t.Stock)
+		if t.Q > 0 {
+			pc.Purchases += t.Amount
+			flows[t.Stock] = append(flows[t.Stock], valueFlow{t.Date, t.Amount})
+		} else {
+			pc.Sales += t.Amount
+			flows[t.Stock] = append(flows[t.Stock], valueFlow{t.Date, -t.Amount})
+		}
+	}
+	for _, a := range getActions(uid, 0) {
+		if a.Cash != 0 && inPeriod(a.Date) {
+			change(a.Stock).Sales += a.Cash
+			flows[a.Stock] = append(flows[a.Stock], valueFlow{a.Date, -a.Cash})
+		}
+	}
+	for _, d := range getDividends(uid, 0) {
+		if inPeriod(d.Date) {
+			change(d.Stock).Dividends += d.Amount
+		}
+	}
+
+	// Values on each date, and the change explained by prices and rates
+	list := []PeriodChange{}
+	total := PeriodChange{}
+	for _, s := range getStocks(uid) {
+		q0, q1 := units[0][s.Id], units[1][s.Id]
+		if q0 == 0 && q1 == 0 && changes[s.Id] == nil {
+			continue
+		}
+		pc := change(s.Id)
+		pc.Stock = s
+		if q0 != 0 {
+			price := stockValue(uid, s.Id, from, policy)
+			pc.Start, pc.StartPrice = q0*price.Price, &price
+		}
+		if q1 != 0 {
+			price := stockValue(uid, s.Id, to, policy)
+			pc.End, pc.EndPrice = q1*price.Price, &price
+		}
+		market := pc.End - pc.Start - pc.Purchases + pc.Sales
+		pc.FxEffect = fxEffect(rates, s.Currency, from, to, pc.End, flows[s.Id])
+		pc.PriceChange = market - pc.FxEffect
+
+		// Return on the start value plus flows, weighted by the time they
+		// were invested
+		pc.invested = pc.Start
+		for _, f := range flows[s.Id] {
+			pc.invested += f.amount * weight(f.date)
+		}
+		if pc.invested > 0 {
+			pc.Return = pc.Gain() / pc.invested * 100
+		}
+
+		// Add to total
+		total.Start += pc.Start
+		total.Purchases += pc.Purchases
+		total.Sales += pc.Sales
+		total.Dividends += pc.Dividends
+		total.PriceChange += pc.PriceChange
+		total.FxEffect += pc.FxEffect
+		total.End += pc.End
+		total.invested += pc.invested
+		list = append(list, *pc)
+	}
+	if total.invested > 0 {
+		total.Return = total.Gain() / total.invested * 100
+	}
+
+	// Largest end value first, then total
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].End > list[j].End
+	})
+	return append(list, total)
+}
+
+// Effect of exchange rates on the value of a holding in a foreign currency:
+// the value at the end and each flow (negative for sales) converted back
+// to the foreign currency at the rate on its date, then to home currency
+// at the start rate, compared with the actual amounts. 0 for home currency
+// or if any rate is missing.
+func fxEffect(rates *Rates, cur string, from, to time.Time, end float64, flows []valueFlow) float64 {
+	if cur == "" || cur == homeCurrency {
+		return 0
+	}
+	r0, ok := rates.On(cur, from)
+	r1, ok1 := rates.On(cur, to)
+	if !ok || !ok1 || r0 <= 0 || r1 <= 0 {
+		return 0
+	}
+	fx := end * (1 - r0/r1)
+	for _, f := range flows {
+		r, _ := rates.On(cur, f.date)
+		if r <= 0 {
+			return 0
+		}
+		fx -= f.amount * (1 - r0/r)
+	}
+	return fx
+}
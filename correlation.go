@@ -0,0 +1,167 @@
+// Correlation of the returns of holdings and currencies, to check how
+// diversified a portfolio is
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Fewest returns in common to work out a correlation
+const minReturns = 3
+
+// Correlation of each pair of a list of series
+type Correlations struct {
+	Labels []string    // stock codes, and currency codes
+	Matrix [][]float64 // correlation of returns, NaN if not enough returns
+	Counts [][]int     // number of returns in common
+}
+
+// Show page with heatmap of correlations of stocks held and currencies,
+// with returns and window in the query string (see riskOptions)
+func showCorrelation(c *gin.Context) {
+
+	// Get correlations
+	uid := portfolioOwner(c)
+	opts := riskOptions(c.Query, nil)
+	corr := getCorrelations(uid, today(), opts)
+
+	// Matrix for the heatmap, with nulls where not enough returns
+	cells := [][]any{}
+	for _, row := range corr.Matrix {
+		cc := []any{}
+		for _, x := range row {
+			if math.IsNaN(x) {
+				cc = append(cc, nil)
+			} else {
+				cc = append(cc, x)
+			}
+		}
+		cells = append(cells, cc)
+	}
+
+	// Show page
+	showPage(c, "correlation.html",
+		gin.H{"corr": corr, "cells": cells, "opts": opts, "current": "Risk"})
+}
+
+// Download the correlations as a CSV file, with the same query string as
+// the page
+func downloadCorrelation(c *gin.Context) {
+
+	// Get correlations
+	uid := portfolioOwner(c)
+	corr := getCorrelations(uid, today(), riskOptions(c.Query, nil))
+
+	// Header row, then a row for each series, blank if not enough returns
+	c.Header("Content-Disposition", "attachment; filename=correlation.csv")
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write(append([]string{""}, corr.Labels...))
+	for i, row := range corr.Matrix {
+		rec := []string{corr.Labels[i]}
+		for _, x := range row {
+			if math.IsNaN(x) {
+				rec = append(rec, "")
+			} else {
+				rec = append(rec, fmt.Sprintf("%.4f", x))
+			}
+		}
+		w.Write(rec)
+	}
+	w.Flush()
+}
+
+// Get correlations of returns of the stocks a user holds (from
+// split-adjusted prices) and currencies other than the home currency (from
+// rates), over a window up to a date. All series are sampled on the same
+// dates (filled forward from the last value), and each pair uses the
+// returns they have in common.
+func getCorrelations(uid int, to time.Time, opts RiskOptions) Correlations {
+
+	// Series for each stock held, then each currency
+	corr := Correlations{}
+	series := []TimeSeries{}
+	for _, h := range getPortfolio(uid, to, true) {
+		corr.Labels = append(corr.Labels, h.Stock.Code)
+		series = append(series, adjustedSeries(uid, h.Stock.Id))
+	}
+	for _, cur := range getCurrencies(uid) {
+		if cur.Code != homeCurrency {
+			ts, _ := rateSeries(uid, cur.Code)
+			corr.Labels = append(corr.Labels, cur.Code)
+			series = append(series, ts)
+		}
+	}
+
+	// Dates to sample, from the earliest data or start of the window
+	first := to
+	for _, ts := range series {
+		if len(ts) > 0 && ts[0].d.Before(first) {
+			first = ts[0].d
+		}
+	}
+	dates := sampleDates(windowStart(first, to, opts), to, opts.Weekly)
+
+	// Returns of each series on the dates, then correlation of each pair
+	returns := []TimeSeries{}
+	for _, ts := range series {
+		returns = append(returns, ts.FillForward(dates).Returns())
+	}
+	n := len(series)
+	corr.Matrix = make([][]float64, n)
+	corr.Counts = make([][]int, n)
+	for i := 0; i < n; i++ {
+		corr.Matrix[i] = make([]float64, n)
+		corr.Counts[i] = make([]int, n)
+		for j := 0; j < n; j++ {
+			corr.Matrix[i][j], corr.Counts[i][j] = correlation(returns[i], returns[j])
+		}
+	}
+	return corr
+}
+
+// Pearson correlation of two series of returns, using only the returns
+// both have on the same dates, and the number of them. Correlation is NaN
+// if fewer than minReturns, or if either does not vary.
+func correlation(a, b TimeSeries) (float64, int) {
+
+	// Returns both have
+	x, y := []float64{}, []float64{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case sameDate(a[i].d, b[j].d):
+			x = append(x, a[i].p)
+			y = append(y, b[j].p)
+			i++
+			j++
+		case a[i].d.Before(b[j].d):
+			i++
+		default:
+			j++
+		}
+	}
+	if len(x) < minReturns {
+		return math.NaN(), len(x)
+	}
+
+	// Covariance over product of standard deviations
+	mx, my := meanOf(x), meanOf(y)
+	var cov, vx, vy float64
+	for i := range x {
+		cov += (x[i] - mx) * (y[i] - my)
+		vx += (x[i] - mx) * (x[i] - mx)
+		vy += (y[i] - my) * (y[i] - my)
+	}
+	if vx == 0 || vy == 0 {
+		return math.NaN(), len(x)
+	}
+	return cov / math.Sqrt(vx*vy), len(x)
+}
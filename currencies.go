@@ -13,36 +13,53 @@ import (
 func showCurrencies(c *gin.Context) {
 
 	// Get a list of currencies
-	currencies := getCurrencies()
+	currencies := getCurrencies(portfolioOwner(c))
 
 	// Show page
-	c.HTML(http.StatusOK, "currencies.html",
-		gin.H{"currencies": currencies, "menu": menu, "current": "Currencies"})
+	showPage(c, "currencies.html",
+		gin.H{"currencies": currencies, "current": "Currencies"})
 }
 
 // Page to show one currency
 func showCurrency(c *gin.Context) {
 
 	// Parse the ID and get the currency
+	uid := portfolioOwner(c)
 	cid := parseInt(c.Param("id"))
-	cur := getCurrency(cid)
+	cur := getCurrency(uid, cid)
 	if cur == nil {
 		c.String(http.StatusNotFound, fmt.Sprintf("Currency %d not found", cid))
 		return
 	}
 
-	// Get all rates for this currency
-	rates := getRates(cid)
+	// Get all rates for this currency, compared with rates inferred from
+	// prices
+	rates := compareRates(getRates(uid, cid), getInferredRates(uid, cur.Code))
+	disagree := 0
+	for i, r := range rates {
+		if r.Disagree {
+			disagree++
+		}
+		rates[i].Used = cur.Infer && r.Stored == nil && r.Inferred != nil
+	}
+
+	// Rate used for values today, and whether it is inferred
+	rr := newRates(uid)
+	rate, ok := rr.On(cur.Code, today())
+	inferred, rateDate := rr.Inferred(cur.Code, today())
 
 	// Show page
-	c.HTML(http.StatusOK, "currency.html",
-		gin.H{"cur": cur, "rates": rates, "menu": menu, "current": "Currencies"})
+	showPage(c, "currency.html",
+		gin.H{"cur": cur, "rates": rates, "disagree": disagree,
+			"tolerance": rateTolerance * 100, "rate": rate, "hasRate": ok,
+			"inferred": inferred, "rateDate": rateDate, "current": "Currencies"})
 }
 
 // Show form to edit a currency (including a new one)
 func editCurrency(c *gin.Context) {
 
 	// Get currency ID (will be 0 to add an currency)
+	uid := portfolioOwner(c)
 	cid := parseInt(c.Param("id"))
 	if cid < 0 {
 		c.String(http.StatusNotFound, "Invalid currency ID")
@@ -52,7 +69,7 @@ func editCurrency(c *gin.Context) {
 	// Get the currency or create "blank" currency
 	cur := &Currency{}
 	if cid > 0 {
-		cur = getCurrency(cid)
+		cur = getCurrency(uid, cid)
 		if cur == nil {
 			c.String(http.StatusNotFound, "Currency not found")
 			return
@@ -60,14 +77,15 @@ func editCurrency(c *gin.Context) {
 	}
 
 	// Show the form to edit currency
-	c.HTML(http.StatusOK, "edit_currency.html",
-		gin.H{"cur": cur, "menu": menu, "current": "Currencies"})
+	showPage(c, "edit_currency.html",
+		gin.H{"cur": cur, "current": "Currencies"})
 }
 
 // Process form to update or add an currency
 func saveCurrency(c *gin.Context) {
 
 	// Get currency ID (will be 0 to add a currency)
+	uid := portfolioOwner(c)
 	cid_, ok := c.GetPostForm("cid")
 	if !ok {
 		c.String(http.StatusNotFound, "saveCurrency: Missing currency ID")
@@ -82,7 +100,7 @@ func saveCurrency(c *gin.Context) {
 	// Get the currency or create "blank" currency
 	cur := &Currency{}
 	if cid > 0 {
-		cur = getCurrency(cid)
+		cur = getCurrency(uid, cid)
 		if cur == nil {
 			c.String(http.StatusNotFound, "saveCurrency: currency not found")
 			return
@@ -92,6 +110,7 @@ func saveCurrency(c *gin.Context) {
 	// Update the currency with the form inputs
 	cur.Code, _ = c.GetPostForm("code")
 	cur.Name, _ = c.GetPostForm("name")
+	_, cur.Infer = c.GetPostForm("infer")
 
 	// Some validation
 	// TODO: make sure can't create a currency that already eixsts,
@@ -104,32 +123,42 @@ func saveCurrency(c *gin.Context) {
 	}
 
 	// Create or update currency in database
-	addUpdateCurrency(cur)
+	addUpdateCurrency(uid, cur)
 
 	// Go back to currencies page
 	c.Redirect(http.StatusFound, "/Currencies")
 }
 
-// Delete currency: ask for confirmation first
+// Delete currency: show form to ask for confirmation first, which
+// posts to doDeleteCurrency()
 func delCurrency(c *gin.Context) {
 
 	// Get the currency (URL positional param)
+	uid := portfolioOwner(c)
 	cid := parseInt(c.Param("id"))
-	cur := getCurrency(cid)
+	cur := getCurrency(uid, cid)
 	if cid <= 0 || cur == nil {
 		c.String(http.StatusNotFound, "Currency not found")
 		return
 	}
 
-	// Ask for confirmation, or go ahead and delete if confirmed
-	confirm, _ := c.GetQuery("confirm")
-	if confirm == "" { // no confirmation, show form
-		c.HTML(http.StatusOK, "del_currency.html",
-			gin.H{"cur": cur, "menu": menu, "current": "Currencies"})
-	} else if confirm == "yes" { // confirmed, delete currency
-		deleteCurrency(cid)
-		c.Redirect(http.StatusFound, "/Currencies")
-	} else { // confirmation denied, back to currency page
-		c.Redirect(http.StatusFound, fmt.Sprintf("/currency/%d", cid))
+	// Ask for confirmation
+	showPage(c, "del_currency.html", gin.H{"cur": cur, "current": "Currencies"})
+}
+
+// Delete currency, after confirmation
+func doDeleteCurrency(c *gin.Context) {
+
+	// Get the currency (URL positional param)
+	uid := portfolioOwner(c)
+	cid := parseInt(c.Param("id"))
+	cur := getCurrency(uid, cid)
+	if cid <= 0 || cur == nil {
+		c.String(http.StatusNotFound, "Currency not found")
+		return
 	}
+
+	// Delete currency and go back to list of currencies
+	deleteCurrency(uid, cid)
+	c.Redirect(http.StatusFound, "/Currencies")
 }
@@ -9,21 +9,183 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// File the database is kept in
+var dbFile = "data.db"
+
 // Connect to database
 // Don't forget to "defer db.Close() after calling this
 func dbConnect() *sql.DB {
-	db, err := sql.Open("sqlite3", "data.db")
+	db, err := sql.Open("sqlite3", dbFile)
 	if err != nil {
 		panic("dbConnect: " + err.Error())
 	}
 	return db
 }
 
+// Columns added to tables since the first version of schema.sql, which an
+// older database won't have
+var addedColumns = []struct{ table, column, def string }{
+	{"stock", "owner_id", "integer"},
+	{"stock", "asset_class", "text default ''"},
+	{"stock", "sector", "text default ''"},
+	{"stock", "region", "text default ''"},
+	{"stock", "isin", "text default ''"},
+	{"stock", "tags", "text default ''"},
+	{"stock", "benchmark", "integer default 0"},
+	{"price", "owner_id", "integer"},
+	{"currency", "owner_id", "integer"},
+	{"currency", "infer", "integer default 0"},
+	{"currency_rate", "owner_id", "integer"},
+	{"trans", "owner_id", "integer"},
+	{"trans", "amountx", "float default 0"},
+	{"trans", "currency", "text default ''"},
+	{"trans", "account", "text default ''"},
+	{"trans", "draft", "integer default 0"},
+	{"dividend", "owner_id", "integer"},
+	{"dividend", "per_share", "float default 0"},
+	{"dividend", "gross", "float default 0"},
+	{"dividend", "withholding", "float default 0"},
+	{"dividend", "net", "float default 0"},
+	{"dividend", "fx_rate", "float default 1"},
+	{"dividend", "trans_id", "integer default 0"},
+	{"dividend", "currency", "text default ''"},
+	{"cash", "owner_id", "integer"},
+	{"cash", "account", "text default ''"},
+	{"cash", "currency", "text default ''"},
+	{"cash", "currency2", "text default ''"},
+	{"cash", "amount2", "float default 0"},
+	{"cash", "account2", "text default ''"},
+}
+
+// Tables with an owner_id, the user each row belongs to
+var ownedTables = []string{"stock", "price", "currency", "currency_rate", "trans",
+	"corporate_action", "target", "transfer", "dividend", "cash"}
+
+// Bring the database up to date with schema.sql: add columns to existing
+// tables, create any tables and indexes it doesn't have, give data from
+// before there were users to the first user (once there is one), and
+// convert old splits to corporate actions
+func migrateDB() {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Add missing columns to tables that exist
+	for _, col := range addedColumns {
+		cols := tableColumns(db, col.table)
+		if len(cols) > 0 && !cols[col.column] {
+			q := "alter table " + col.table + " add column " + col.column + " " + col.def
+			if _, err := db.Exec(q); err != nil {
+				panic("migrateDB: " + err.Error())
+			}
+		}
+	}
+
+	// Create missing tables and indexes from the schema
+	schema, err := os.ReadFile("schema.sql")
+	if err != nil {
+		panic("migrateDB: " + err.Error())
+	}
+	q := strings.NewReplacer("CREATE TABLE ", "CREATE TABLE IF NOT EXISTS ",
+		"create index ", "create index if not exists ").Replace(string(schema))
+	if _, err := db.Exec(q); err != nil {
+		panic("migrateDB: " + err.Error())
+	}
+
+	// Rows without an owner belong to the first user
+	for _, t := range ownedTables {
+		q := "update " + t + " set owner_id = (select min(id) from user) where owner_id is null"
+		if _, err := db.Exec(q); err != nil {
+			panic("migrateDB: " + err.Error())
+		}
+	}
+
+	// Splits recorded the old way become corporate actions
+	migrateSplits(db)
+}
+
+// Convert splits recorded the old way, before corporate actions, into
+// split actions. A split was a transaction with no amount adding the new
+// units, and a price on the split date worked out from the price before.
+// Both are deleted, as the action now adjusts units and prices.
+func migrateSplits(db *sql.DB) {
+
+	// Find the transactions, by their comments, e.g., "2024-01-02: 10.000
+	// split to 20.000 => delta 10.000"
+	q := `select id, owner_id, stock_id, tdate, q, comments from trans
+		where coalesce(amount, 0) = 0 and coalesce(fees, 0) = 0
+		and comments like '%split to%=> delta%' and owner_id is not null`
+	rows, err := db.Query(q)
+	if err != nil {
+		panic("migrateSplits query: " + err.Error())
+	}
+	type split struct {
+		id, uid, sid int
+		ds, cmt      string
+		q            float64
+	}
+	splits := []split{}
+	for rows.Next() {
+		var s split
+		if err := rows.Scan(&s.id, &s.uid, &s.sid, &s.ds, &s.q, &s.cmt); err != nil {
+			panic("migrateSplits next: " + err.Error())
+		}
+		splits = append(splits, s)
+	}
+	rows.Close()
+
+	// Add an action for each, with the units before and after (the units
+	// added are exact, the units before are rounded in the comment)
+	for _, s := range splits {
+		var before float64
+		ds := formatDate(parseDate(s.ds))
+		_, err := fmt.Sscanf(strings.TrimPrefix(s.cmt, ds+": "), "%f split to", &before)
+		if err != nil || before <= 0 || before+s.q <= 0 {
+			continue
+		}
+		q := `insert into corporate_action(owner_id, stock_id, adate, atype, ratio_old, ratio_new,
+			new_stock_id, cost_fraction, cash, old_code, new_code, comments)
+			values ($1, $2, $3, $4, $5, $6, 0, 0, 0, '', '', $7)`
+		cmt := "Split recorded before corporate actions: " + strings.TrimSpace(s.cmt)
+		if _, err := db.Exec(q, s.uid, s.sid, ds, ActionSplit, before, before+s.q, cmt); err != nil {
+			panic("migrateSplits: " + err.Error())
+		}
+		if _, err := db.Exec("delete from trans where id = $1", s.id); err != nil {
+			panic("migrateSplits: " + err.Error())
+		}
+		q = "delete from price where stock_id = $1 and owner_id = $2 and comments like $3"
+		if _, err := db.Exec(q, s.sid, s.uid, "% split on "+ds+" to %"); err != nil {
+			panic("migrateSplits: " + err.Error())
+		}
+	}
+}
+
+// Names of the columns of a table, empty if there is no such table
+func tableColumns(db *sql.DB, table string) map[string]bool {
+	rows, err := db.Query("select name from pragma_table_info($1)", table)
+	if err != nil {
+		panic("tableColumns: " + err.Error())
+	}
+	defer rows.Close()
+	cols := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			panic("tableColumns: " + err.Error())
+		}
+		cols[name] = true
+	}
+	return cols
+}
+
 //----------------------------------------------------------------//
 //                              STOCKS                            //
 //----------------------------------------------------------------//
@@ -33,21 +195,50 @@ func dbConnect() *sql.DB {
 
 // Record format for one stock
 type Stock struct {
-	Id       int
-	Code     string
-	Name     string
-	Currency string
+	Id         int
+	Code       string
+	Name       string
+	Currency   string
+	AssetClass string // one of assetClasses, or blank if not classified
+	Sector     string
+	Region     string // region or country
+	ISIN       string
+	Tags       string // comma separated
+	Benchmark  bool   // used to compare performance, see performance.go
 }
 
-// Get a list of all stocks, in alphabetical order
-func getStocks() []Stock {
+// List of tags, trimmed, without blanks
+func (s *Stock) TagList() []string {
+	tags := []string{}
+	for _, t := range strings.Split(s.Tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// Columns of the stock table, in the order read by scanStock()
+const stockCols = "id, code, name, currency, asset_class, sector, region, isin, tags, benchmark"
+
+// Read one stock from a query result
+func scanStock(scan func(...any) error) (Stock, error) {
+	s := Stock{}
+	err := scan(&s.Id, &s.Code, &s.Name, &s.Currency, &s.AssetClass, &s.Sector,
+		&s.Region, &s.ISIN, &s.Tags, &s.Benchmark)
+	return s, err
+}
+
+// Get a list of all stocks for a user, in alphabetical order
+func getStocks(uid int) []Stock {
 
 	// Connect to database
 	db := dbConnect()
 	defer db.Close()
 
 	// Execute query to get all stocks, in alphabetical order
-	rows, err := db.Query("select id, code, name, currency from stock order by code")
+	q := "select " + stockCols + " from stock where owner_id = $1 order by code"
+	rows, err := db.Query(q, uid)
 	if err != nil {
 		panic("getStocks query: " + err.Error())
 	}
@@ -56,8 +247,7 @@ func getStocks() []Stock {
 	// Collect into a list
 	ss := []Stock{}
 	for rows.Next() {
-		s := Stock{}
-		err := rows.Scan(&s.Id, &s.Code, &s.Name, &s.Currency)
+		s, err := scanStock(rows.Scan)
 		if err != nil {
 			panic("getStocks next: " + err.Error())
 		}
@@ -71,17 +261,16 @@ func getStocks() []Stock {
 	return ss
 }
 
-// Get one stock by id
-func getStock(sid int) *Stock {
+// Get one of a user's stocks by id
+func getStock(uid, sid int) *Stock {
 
 	// Connect to database
 	db := dbConnect()
 	defer db.Close()
 
 	// Find stock, return nil if not found
-	s := Stock{}
-	q := "select id, code, name, currency from stock where id = $1"
-	err := db.QueryRow(q, sid).Scan(&s.Id, &s.Code, &s.Name, &s.Currency)
+	q := "select " + stockCols + " from stock where id = $1 and owner_id = $2"
+	s, err := scanStock(db.QueryRow(q, sid, uid).Scan)
 	if err != nil {
 		return nil
 	}
@@ -89,8 +278,8 @@ func getStock(sid int) *Stock {
 	return &s
 }
 
-// Update an existing stock, or add new
-func addUpdateStock(s *Stock) {
+// Update an existing stock, or add new one for a user
+func addUpdateStock(uid int, s *Stock) {
 
 	// Connect to database
 	db := dbConnect()
@@ -99,11 +288,16 @@ func addUpdateStock(s *Stock) {
 	// Attempt insert or update
 	var err error
 	if s.Id == 0 {
-		q := "insert into stock(code, name, currency) values ($1, $2, $3)"
-		_, err = db.Exec(q, s.Code, s.Name, s.Currency)
+		q := `insert into stock(owner_id, code, name, currency, asset_class, sector, region,
+			isin, tags, benchmark) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+		_, err = db.Exec(q, uid, s.Code, s.Name, s.Currency, s.AssetClass, s.Sector,
+			s.Region, s.ISIN, s.Tags, s.Benchmark)
 	} else {
-		q := "update stock set code = $1, name = $2, currency = $3 where id = $4"
-		_, err = db.Exec(q, s.Code, s.Name, s.Currency, s.Id)
+		q := `update stock set code = $1, name = $2, currency = $3, asset_class = $4,
+			sector = $5, region = $6, isin = $7, tags = $8, benchmark = $9
+			where id = $10 and owner_id = $11`
+		_, err = db.Exec(q, s.Code, s.Name, s.Currency, s.AssetClass, s.Sector, s.Region,
+			s.ISIN, s.Tags, s.Benchmark, s.Id, uid)
 	}
 
 	// Check for error
@@ -112,14 +306,14 @@ func addUpdateStock(s *Stock) {
 	}
 }
 
-// Delete a stock by ID
+// Delete one of a user's stocks by ID
 // TODO: also delete all child records
-func deleteStock(sid int) {
+func deleteStock(uid, sid int) {
 
 	db := dbConnect()
 	defer db.Close()
 
-	_, err := db.Exec("delete from stock where id = $1", sid)
+	_, err := db.Exec("delete from stock where id = $1 and owner_id = $2", sid, uid)
 	if err != nil {
 		panic("deleteStock: " + err.Error())
 	}
@@ -141,8 +335,8 @@ type Price struct {
 	Comments string    // any comments
 }
 
-// Get price by price ID
-func getPrice(pid int) *Price {
+// Get one of a user's prices by price ID
+func getPrice(uid, pid int) *Price {
 
 	// Connect to database
 	db := dbConnect()
@@ -150,8 +344,8 @@ func getPrice(pid int) *Price {
 
 	// Find price, return nil if not found
 	p := Price{}
-	q := "select id, stock_id, pdate, price, pricex, comments from price where id = $1"
-	err := db.QueryRow(q, pid).Scan(&p.Id, &p.Stock, &p.Date, &p.Price, &p.PriceX, &p.Comments)
+	q := "select id, stock_id, pdate, price, pricex, comments from price where id = $1 and owner_id = $2"
+	err := db.QueryRow(q, pid, uid).Scan(&p.Id, &p.Stock, &p.Date, &p.Price, &p.PriceX, &p.Comments)
 	if err != nil {
 		return nil
 	}
@@ -159,15 +353,16 @@ func getPrice(pid int) *Price {
 	return &p
 }
 
-// Get all prices for a stock, sorted by ascending date
-func getPrices(sid int) []Price {
+// Get all prices for one of a user's stocks, sorted by ascending date
+func getPrices(uid, sid int) []Price {
 
 	// Connect to database
 	db := dbConnect()
 	defer db.Close()
 
 	// Execute query to get all prices for this stock, in date order
-	rows, err := db.Query("select id, pdate, price, pricex, comments from price where stock_id = $1 order by pdate", sid)
+	q := "select id, pdate, price, pricex, comments from price where stock_id = $1 and owner_id = $2 order by pdate"
+	rows, err := db.Query(q, sid, uid)
 	if err != nil {
 		panic("getPrices query: " + err.Error())
 	}
@@ -193,8 +388,8 @@ func getPrices(sid int) []Price {
 	return pp
 }
 
-// Update an existing price, or add new
-func addUpdatePrice(p *Price) {
+// Update an existing price, or add new one for a user
+func addUpdatePrice(uid int, p *Price) {
 
 	// Connect to database
 	db := dbConnect()
@@ -203,11 +398,11 @@ func addUpdatePrice(p *Price) {
 	// Attempt insert or update
 	var err error
 	if p.Id == 0 {
-		q := "insert into price(stock_id, pdate, price, pricex, comments) values ($1, $2, $3, $4, $5)"
-		_, err = db.Exec(q, p.Stock, p.Date, p.Price, p.PriceX, p.Comments)
+		q := "insert into price(owner_id, stock_id, pdate, price, pricex, comments) values ($1, $2, $3, $4, $5, $6)"
+		_, err = db.Exec(q, uid, p.Stock, p.Date, p.Price, p.PriceX, p.Comments)
 	} else {
-		q := "update price set pdate = $1, price = $2, pricex = $3, comments = $4 where id = $5"
-		_, err = db.Exec(q, p.Date, p.Price, p.PriceX, p.Comments, p.Id)
+		q := "update price set pdate = $1, price = $2, pricex = $3, comments = $4 where id = $5 and owner_id = $6"
+		_, err = db.Exec(q, p.Date, p.Price, p.PriceX, p.Comments, p.Id, uid)
 	}
 
 	// Check for error
@@ -216,6 +411,25 @@ func addUpdatePrice(p *Price) {
 	}
 }
 
+// Add or replace the price of one of a user's stocks on a date, so there
+// is only one price per day
+func setPriceOnDate(uid int, p *Price) {
+
+	// Look for a price on the same date
+	db := dbConnect()
+	q := "select id from price where stock_id = $1 and owner_id = $2 and date(pdate) = $3"
+	err := db.QueryRow(q, p.Stock, uid, formatDate(p.Date)).Scan(&p.Id)
+	db.Close()
+	if err == sql.ErrNoRows {
+		p.Id = 0
+	} else if err != nil {
+		panic("setPriceOnDate: " + err.Error())
+	}
+
+	// Add or update it
+	addUpdatePrice(uid, p)
+}
+
 //----------------------------------------------------------------//
 //                      BUY/SELL TRANSACTIONS                     //
 //----------------------------------------------------------------//
@@ -231,11 +445,29 @@ type Transaction struct {
 	Q        float64   // the number of shares
 	Amount   float64   // the total amount paid, including fees
 	Fees     float64   // commission or fees paid
+	AmountX  float64   // total amount in the stock's currency, if known
+	Currency string    // currency of the cash paid or received, blank for home
+	Account  string    // account bought or sold in, blank for the main account
+	Draft    bool      // proposed (e.g., by rebalancing) but not yet done
 	Comments string    // any comments
 }
 
-// Get a list of all transactions, for a stock if argument is nonzero
-func getTransactions(sid int) []Transaction {
+// Columns of the trans table, in the order read by scanTransaction()
+const transCols = "id, stock_id, tdate, q, amount, fees, amountx, currency, account, draft, comments"
+
+// Read one transaction from a query result
+func scanTransaction(scan func(...any) error) (Transaction, error) {
+	t := Transaction{}
+	var ds string
+	err := scan(&t.Id, &t.Stock, &ds, &t.Q, &t.Amount, &t.Fees, &t.AmountX, &t.Currency,
+		&t.Account, &t.Draft, &t.Comments)
+	t.Date = parseDate(ds)
+	return t, err
+}
+
+// Get a list of all of a user's transactions, for a stock if argument is
+// nonzero, not including drafts
+func getTransactions(uid, sid int) []Transaction {
 
 	// Connect to database
 	db := dbConnect()
@@ -244,10 +476,13 @@ func getTransactions(sid int) []Transaction {
 	// Execute query to get all transactions
 	var err error
 	var rows *sql.Rows
+	q := "select " + transCols + " from trans where owner_id = $1 and draft = 0"
 	if sid > 0 {
-		rows, err = db.Query("select id, stock_id, tdate, q, amount, fees, comments from trans where stock_id == $1 order by tdate", sid)
+		q += " and stock_id == $2 order by tdate"
+		rows, err = db.Query(q, uid, sid)
 	} else {
-		rows, err = db.Query("select id, stock_id, tdate, q, amount, fees, comments from trans order by tdate")
+		q += " order by tdate"
+		rows, err = db.Query(q, uid)
 	}
 	if err != nil {
 		panic("getTransactions query: " + err.Error())
@@ -257,13 +492,10 @@ func getTransactions(sid int) []Transaction {
 	// Collect into a list
 	tt := []Transaction{}
 	for rows.Next() {
-		t := Transaction{}
-		var ds string
-		err := rows.Scan(&t.Id, &t.Stock, &ds, &t.Q, &t.Amount, &t.Fees, &t.Comments)
+		t, err := scanTransaction(rows.Scan)
 		if err != nil {
 			panic("getTransactions next: " + err.Error())
 		}
-		t.Date = parseDate(ds)
 		tt = append(tt, t)
 	}
 	if rows.Err() != nil {
@@ -274,29 +506,27 @@ func getTransactions(sid int) []Transaction {
 	return tt
 }
 
-// Get one transaction by id
-func getTransaction(tid int) *Transaction {
+// Get one of a user's transactions by id
+func getTransaction(uid, tid int) *Transaction {
 
 	// Connect to database
 	db := dbConnect()
 	defer db.Close()
 
 	// Find and read transaction, return nil if not found
-	t := Transaction{}
-	var ds string
-	q := "select id, stock_id, tdate, q, amount, fees, comments from trans where id = $1"
-	err := db.QueryRow(q, tid).Scan(&t.Id, &t.Stock, &ds, &t.Q, &t.Amount, &t.Fees, &t.Comments)
+	q := "select " + transCols + " from trans where id = $1 and owner_id = $2"
+	t, err := scanTransaction(db.QueryRow(q, tid, uid).Scan)
 	if err != nil {
 		fmt.Println(err)
 		return nil
 	}
-	t.Date = parseDate(ds)
 
 	return &t
 }
 
-// Update an existing transaction, or add new
-func addUpdateTransaction(t *Transaction) {
+// Update an existing transaction, or add new one for a user (setting
+// the ID of the new transaction)
+func addUpdateTransaction(uid int, t *Transaction) {
 
 	// Connect to database
 	db := dbConnect()
@@ -305,11 +535,21 @@ func addUpdateTransaction(t *Transaction) {
 	// Attempt insert or update
 	var err error
 	if t.Id == 0 {
-		q := "insert into trans(stock_id, tdate, q, amount, fees, comments) values ($1, $2, $3, $4, $5, $6)"
-		_, err = db.Exec(q, t.Stock, formatDate(t.Date), t.Q, t.Amount, t.Fees, t.Comments)
+		var res sql.Result
+		q := `insert into trans(owner_id, stock_id, tdate, q, amount, fees, amountx, currency,
+			account, draft, comments) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+		res, err = db.Exec(q, uid, t.Stock, formatDate(t.Date), t.Q, t.Amount, t.Fees,
+			t.AmountX, t.Currency, t.Account, t.Draft, t.Comments)
+		if err == nil {
+			id, _ := res.LastInsertId()
+			t.Id = int(id)
+		}
 	} else {
-		q := "update trans set tdate = $1, q = $2, amount = $3, fees = $4, comments = $5 where id = $6"
-		_, err = db.Exec(q, formatDate(t.Date), t.Q, t.Amount, t.Fees, t.Comments, t.Id)
+		q := `update trans set tdate = $1, q = $2, amount = $3, fees = $4, amountx = $5,
+			currency = $6, account = $7, draft = $8, comments = $9
+			where id = $10 and owner_id = $11`
+		_, err = db.Exec(q, formatDate(t.Date), t.Q, t.Amount, t.Fees, t.AmountX, t.Currency,
+			t.Account, t.Draft, t.Comments, t.Id, uid)
 	}
 
 	// Check for error
@@ -318,16 +558,126 @@ func addUpdateTransaction(t *Transaction) {
 	}
 }
 
-// Delete a transaction by ID
+// Delete one of a user's transactions by ID
 // TODO: also delete all child records
-func deleteTransaction(tid int) {
+func deleteTransaction(uid, tid int) {
 
 	db := dbConnect()
 	defer db.Close()
 
-	_, err := db.Exec("delete from trans where id = $1", tid)
+	_, err := db.Exec("delete from trans where id = $1 and owner_id = $2", tid, uid)
 	if err != nil {
-		panic("deleteStock: " + err.Error())
+		panic("deleteTransaction: " + err.Error())
+	}
+}
+
+// Get a list of all of a user's draft transactions, in date order
+func getDraftTransactions(uid int) []Transaction {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Execute query to get drafts
+	q := "select " + transCols + " from trans where owner_id = $1 and draft != 0 order by tdate"
+	rows, err := db.Query(q, uid)
+	if err != nil {
+		panic("getDraftTransactions query: " + err.Error())
+	}
+	defer rows.Close()
+
+	// Collect into a list
+	tt := []Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows.Scan)
+		if err != nil {
+			panic("getDraftTransactions next: " + err.Error())
+		}
+		tt = append(tt, t)
+	}
+	return tt
+}
+
+// Delete all of a user's draft transactions
+func deleteDraftTransactions(uid int) {
+
+	db := dbConnect()
+	defer db.Close()
+
+	_, err := db.Exec("delete from trans where owner_id = $1 and draft != 0", uid)
+	if err != nil {
+		panic("deleteDraftTransactions: " + err.Error())
+	}
+}
+
+//----------------------------------------------------------------//
+//                       TARGET ALLOCATIONS                       //
+//----------------------------------------------------------------//
+
+// Target weight for a stock or a group of stocks (see groupings), with a
+// tolerance band, used for rebalancing
+type Target struct {
+	Id     int
+	By     string  // "stock", or key of one of the groupings
+	Group  string  // stock code, group name, or "Cash"
+	Weight float64 // target percentage of the portfolio
+	Band   float64 // percentage points either side before rebalancing
+}
+
+// Get all of a user's targets for a grouping, in order of group
+func getTargets(uid int, by string) []Target {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Execute query to get all targets
+	q := "select id, grouping, grp, weight, band from target where owner_id = $1 and grouping = $2 order by grp"
+	rows, err := db.Query(q, uid, by)
+	if err != nil {
+		panic("getTargets query: " + err.Error())
+	}
+	defer rows.Close()
+
+	// Collect into a list
+	tt := []Target{}
+	for rows.Next() {
+		t := Target{}
+		err := rows.Scan(&t.Id, &t.By, &t.Group, &t.Weight, &t.Band)
+		if err != nil {
+			panic("getTargets next: " + err.Error())
+		}
+		tt = append(tt, t)
+	}
+	return tt
+}
+
+// Replace all of a user's targets for a grouping
+func setTargets(uid int, by string, tt []Target) {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Delete old targets and add new ones in one transaction
+	tx, err := db.Begin()
+	if err != nil {
+		panic("setTargets begin: " + err.Error())
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("delete from target where owner_id = $1 and grouping = $2", uid, by)
+	if err != nil {
+		panic("setTargets delete: " + err.Error())
+	}
+	for _, t := range tt {
+		q := "insert into target(owner_id, grouping, grp, weight, band) values ($1, $2, $3, $4, $5)"
+		_, err = tx.Exec(q, uid, by, t.Group, t.Weight, t.Band)
+		if err != nil {
+			panic("setTargets insert: " + err.Error())
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		panic("setTargets commit: " + err.Error())
 	}
 }
 
@@ -335,17 +685,53 @@ func deleteTransaction(tid int) {
 //                            DIVIDENDS                           //
 //----------------------------------------------------------------//
 
-// Record format for one dividend
+// Record format for one dividend. Per share, gross, withholding and net
+// amounts are in the stock's currency, and may be zero for dividends
+// recorded before these were added. Amount is always the net amount
+// received in home currency.
 type Dividend struct {
-	Id       int       // ID of the transaction
-	Stock    int       // ID of the stock
-	Date     time.Time // the date for this transaction
-	Amount   float64   // the total amount paid, including fees
-	Comments string
+	Id          int       // ID of the transaction
+	Stock       int       // ID of the stock
+	Date        time.Time // the date for this transaction
+	PerShare    float64   // dividend per share
+	Gross       float64   // gross amount, before withholding tax
+	Withholding float64   // foreign tax withheld
+	Net         float64   // net amount, gross less withholding
+	FxRate      float64   // multiplier to convert to home currency
+	Amount      float64   // net amount received, in home currency
+	Trans       int       // ID of transaction if reinvested, otherwise 0
+	Currency    string    // currency the net amount was paid in, blank for home
+	Comments    string
+}
+
+// Withholding tax in home currency
+func (d *Dividend) WithholdingHome() float64 {
+	return d.Withholding * d.FxRate
+}
+
+// Gross amount in home currency (just the net amount if gross unknown)
+func (d *Dividend) GrossHome() float64 {
+	if d.Gross == 0 {
+		return d.Amount
+	}
+	return d.Gross * d.FxRate
+}
+
+// Columns of the dividend table, in the order read by scanDividend()
+const dividendCols = "id, stock_id, tdate, per_share, gross, withholding, net, fx_rate, amount, trans_id, currency, comments"
+
+// Read one dividend from a query result
+func scanDividend(scan func(...any) error) (Dividend, error) {
+	d := Dividend{}
+	var ds string
+	err := scan(&d.Id, &d.Stock, &ds, &d.PerShare, &d.Gross, &d.Withholding, &d.Net,
+		&d.FxRate, &d.Amount, &d.Trans, &d.Currency, &d.Comments)
+	d.Date = parseDate(ds)
+	return d, err
 }
 
-// Get a list of all dividends for a stock, or for all stocks if ID is 0
-func getDividends(sid int) []Dividend {
+// Get a list of all of a user's dividends for a stock, or for all stocks if ID is 0
+func getDividends(uid, sid int) []Dividend {
 
 	// Connect to database
 	db := dbConnect()
@@ -354,13 +740,13 @@ func getDividends(sid int) []Dividend {
 	// Execute query to get all transactions
 	var err error
 	var rows *sql.Rows
-	q := "select id, stock_id, tdate, amount, comments from dividend"
+	q := "select " + dividendCols + " from dividend where owner_id = $1"
 	if sid > 0 {
-		q += " where stock_id == $1 order by tdate"
-		rows, err = db.Query(q, sid)
+		q += " and stock_id == $2 order by tdate"
+		rows, err = db.Query(q, uid, sid)
 	} else {
 		q += " order by tdate"
-		rows, err = db.Query(q)
+		rows, err = db.Query(q, uid)
 	}
 	if err != nil {
 		panic("getDividends query: " + err.Error())
@@ -370,13 +756,10 @@ func getDividends(sid int) []Dividend {
 	// Collect into a list
 	dd := []Dividend{}
 	for rows.Next() {
-		d := Dividend{}
-		var ds string
-		err := rows.Scan(&d.Id, &d.Stock, &ds, &d.Amount, &d.Comments)
+		d, err := scanDividend(rows.Scan)
 		if err != nil {
 			panic("getDividends next: " + err.Error())
 		}
-		d.Date = parseDate(ds)
 		dd = append(dd, d)
 	}
 	if rows.Err() != nil {
@@ -387,29 +770,26 @@ func getDividends(sid int) []Dividend {
 	return dd
 }
 
-// Get one dividend by id
-func getDividend(did int) *Dividend {
+// Get one of a user's dividends by id
+func getDividend(uid, did int) *Dividend {
 
 	// Connect to database
 	db := dbConnect()
 	defer db.Close()
 
-	// Find and read transaction, return nil if not found
-	d := Dividend{}
-	var ds string
-	q := "select id, stock_id, tdate, amount, comments from dividend where id = $1"
-	err := db.QueryRow(q, did).Scan(&d.Id, &d.Stock, &ds, &d.Amount, &d.Comments)
+	// Find and read dividend, return nil if not found
+	q := "select " + dividendCols + " from dividend where id = $1 and owner_id = $2"
+	d, err := scanDividend(db.QueryRow(q, did, uid).Scan)
 	if err != nil {
 		fmt.Println(err)
 		return nil
 	}
-	d.Date = parseDate(ds)
 
 	return &d
 }
 
-// Update an existing dividend, or add new
-func addUpdateDividend(d *Dividend) {
+// Update an existing dividend, or add new one for a user
+func addUpdateDividend(uid int, d *Dividend) {
 
 	// Connect to database
 	db := dbConnect()
@@ -418,11 +798,17 @@ func addUpdateDividend(d *Dividend) {
 	// Attempt insert or update
 	var err error
 	if d.Id == 0 {
-		q := "insert into dividend(stock_id, tdate, amount, comments) values ($1, $2, $3, $4)"
-		_, err = db.Exec(q, d.Stock, formatDate(d.Date), d.Amount, d.Comments)
+		q := `insert into dividend(owner_id, stock_id, tdate, per_share, gross, withholding,
+			net, fx_rate, amount, trans_id, currency, comments)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+		_, err = db.Exec(q, uid, d.Stock, formatDate(d.Date), d.PerShare, d.Gross,
+			d.Withholding, d.Net, d.FxRate, d.Amount, d.Trans, d.Currency, d.Comments)
 	} else {
-		q := "update dividend set tdate = $1, amount = $2, comments = $3 where id = $4"
-		_, err = db.Exec(q, formatDate(d.Date), d.Amount, d.Comments, d.Id)
+		q := `update dividend set tdate = $1, per_share = $2, gross = $3, withholding = $4,
+			net = $5, fx_rate = $6, amount = $7, trans_id = $8, currency = $9, comments = $10
+			where id = $11 and owner_id = $12`
+		_, err = db.Exec(q, formatDate(d.Date), d.PerShare, d.Gross, d.Withholding,
+			d.Net, d.FxRate, d.Amount, d.Trans, d.Currency, d.Comments, d.Id, uid)
 	}
 
 	// Check for error
@@ -431,33 +817,341 @@ func addUpdateDividend(d *Dividend) {
 	}
 }
 
-// Delete a dividend by ID
-func deleteDividend(did int) {
+// Delete one of a user's dividends by ID
+func deleteDividend(uid, did int) {
 
 	db := dbConnect()
 	defer db.Close()
 
-	_, err := db.Exec("delete from dividend where id = $1", did)
+	_, err := db.Exec("delete from dividend where id = $1 and owner_id = $2", did, uid)
 	if err != nil {
 		panic("deleteDividend: " + err.Error())
 	}
 }
 
+//----------------------------------------------------------------//
+//                        CORPORATE ACTIONS                       //
+//----------------------------------------------------------------//
+
+// An event that changes the units or cost basis of a holding without
+// a buy or sell: split (forward or reverse), spin-off, merger, or a
+// change of code. See lots.go for how each is applied.
+
+// Types of corporate action
+const (
+	ActionSplit      = "Split"
+	ActionSpinOff    = "Spin-off"
+	ActionMerger     = "Merger"
+	ActionCodeChange = "Code change"
+)
+
+var actionTypes = []string{ActionSplit, ActionSpinOff, ActionMerger, ActionCodeChange}
+
+// Record format for one corporate action
+type Action struct {
+	Id           int       // ID of the action
+	Stock        int       // ID of the stock affected
+	Date         time.Time // effective date
+	Type         string    // one of actionTypes
+	RatioOld     float64   // old units ...
+	RatioNew     float64   // ... exchanged for new units, e.g., 1 for 4 in a split
+	NewStock     int       // stock received in a spin-off or merger (0 if none)
+	CostFraction float64   // fraction of cost basis going to the new stock
+	Cash         float64   // total cash received in home currency (in lieu of fractions, or merger)
+	OldCode      string    // code before a code change
+	NewCode      string    // code after a code change
+	Comments     string
+}
+
+// Units received for each unit held
+func (a *Action) Ratio() float64 {
+	if a.RatioOld == 0 {
+		return 1
+	}
+	return a.RatioNew / a.RatioOld
+}
+
+// Columns of the corporate_action table, in the order read by scanAction()
+const actionCols = "id, stock_id, adate, atype, ratio_old, ratio_new, new_stock_id, cost_fraction, cash, old_code, new_code, comments"
+
+// Read one corporate action from a query result
+func scanAction(scan func(...any) error) (Action, error) {
+	a := Action{}
+	var ds string
+	err := scan(&a.Id, &a.Stock, &ds, &a.Type, &a.RatioOld, &a.RatioNew, &a.NewStock,
+		&a.CostFraction, &a.Cash, &a.OldCode, &a.NewCode, &a.Comments)
+	a.Date = parseDate(ds)
+	return a, err
+}
+
+// Get a list of all of a user's corporate actions in date order, either
+// for all stocks if the stock ID is 0, or those that affect a stock,
+// including spin-offs and mergers that created units of the stock
+func getActions(uid, sid int) []Action {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Execute query to get all actions
+	var err error
+	var rows *sql.Rows
+	q := "select " + actionCols + " from corporate_action where owner_id = $1"
+	if sid > 0 {
+		q += " and (stock_id = $2 or new_stock_id = $2) order by adate"
+		rows, err = db.Query(q, uid, sid)
+	} else {
+		q += " order by adate"
+		rows, err = db.Query(q, uid)
+	}
+	if err != nil {
+		panic("getActions query: " + err.Error())
+	}
+	defer rows.Close()
+
+	// Collect into a list
+	aa := []Action{}
+	for rows.Next() {
+		a, err := scanAction(rows.Scan)
+		if err != nil {
+			panic("getActions next: " + err.Error())
+		}
+		aa = append(aa, a)
+	}
+	if rows.Err() != nil {
+		panic("getActions exit: " + err.Error())
+	}
+
+	// Return list
+	return aa
+}
+
+// Get one of a user's corporate actions by id
+func getAction(uid, aid int) *Action {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Find and read action, return nil if not found
+	q := "select " + actionCols + " from corporate_action where id = $1 and owner_id = $2"
+	a, err := scanAction(db.QueryRow(q, aid, uid).Scan)
+	if err != nil {
+		return nil
+	}
+
+	return &a
+}
+
+// Update an existing corporate action, or add new one for a user
+func addUpdateAction(uid int, a *Action) {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Attempt insert or update
+	var err error
+	if a.Id == 0 {
+		q := `insert into corporate_action(owner_id, stock_id, adate, atype, ratio_old, ratio_new,
+			new_stock_id, cost_fraction, cash, old_code, new_code, comments)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+		_, err = db.Exec(q, uid, a.Stock, formatDate(a.Date), a.Type, a.RatioOld, a.RatioNew,
+			a.NewStock, a.CostFraction, a.Cash, a.OldCode, a.NewCode, a.Comments)
+	} else {
+		q := `update corporate_action set adate = $1, atype = $2, ratio_old = $3, ratio_new = $4,
+			new_stock_id = $5, cost_fraction = $6, cash = $7, old_code = $8, new_code = $9,
+			comments = $10 where id = $11 and owner_id = $12`
+		_, err = db.Exec(q, formatDate(a.Date), a.Type, a.RatioOld, a.RatioNew, a.NewStock,
+			a.CostFraction, a.Cash, a.OldCode, a.NewCode, a.Comments, a.Id, uid)
+	}
+
+	// Check for error
+	if err != nil {
+		panic("addUpdateAction: " + err.Error())
+	}
+}
+
+// Delete one of a user's corporate actions by ID
+func deleteAction(uid, aid int) {
+
+	db := dbConnect()
+	defer db.Close()
+
+	_, err := db.Exec("delete from corporate_action where id = $1 and owner_id = $2", aid, uid)
+	if err != nil {
+		panic("deleteAction: " + err.Error())
+	}
+}
+
+//----------------------------------------------------------------//
+//                    TRANSFERS BETWEEN ACCOUNTS                  //
+//----------------------------------------------------------------//
+
+// Record format for an in-kind transfer of units of a stock from one
+// account to another, keeping the original dates and cost of the lots
+type Transfer struct {
+	Id       int       // ID of the transfer
+	Stock    int       // ID of the stock
+	Date     time.Time // date of the transfer
+	Q        float64   // units moved
+	From     string    // account moved from, blank for the main account
+	To       string    // account moved to, blank for the main account
+	Comments string
+}
+
+// Columns of the transfer table, in the order read by scanTransfer()
+const transferCols = "id, stock_id, tdate, q, from_account, to_account, comments"
+
+// Read one transfer from a query result
+func scanTransfer(scan func(...any) error) (Transfer, error) {
+	t := Transfer{}
+	var ds string
+	err := scan(&t.Id, &t.Stock, &ds, &t.Q, &t.From, &t.To, &t.Comments)
+	t.Date = parseDate(ds)
+	return t, err
+}
+
+// Get a list of all of a user's transfers in date order, for one stock,
+// or for all stocks if the stock ID is 0
+func getTransfers(uid, sid int) []Transfer {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Execute query to get all transfers
+	var err error
+	var rows *sql.Rows
+	q := "select " + transferCols + " from transfer where owner_id = $1"
+	if sid > 0 {
+		q += " and stock_id = $2 order by tdate"
+		rows, err = db.Query(q, uid, sid)
+	} else {
+		q += " order by tdate"
+		rows, err = db.Query(q, uid)
+	}
+	if err != nil {
+		panic("getTransfers query: " + err.Error())
+	}
+	defer rows.Close()
+
+	// Collect into a list
+	tt := []Transfer{}
+	for rows.Next() {
+		t, err := scanTransfer(rows.Scan)
+		if err != nil {
+			panic("getTransfers next: " + err.Error())
+		}
+		tt = append(tt, t)
+	}
+
+	// Return list
+	return tt
+}
+
+// Get one of a user's transfers by ID, nil if not found
+func getTransfer(uid, tid int) *Transfer {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Find and read transfer, return nil if not found
+	q := "select " + transferCols + " from transfer where id = $1 and owner_id = $2"
+	t, err := scanTransfer(db.QueryRow(q, tid, uid).Scan)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	return &t
+}
+
+// Add or update one of a user's transfers
+func addUpdateTransfer(uid int, t *Transfer) {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Add or update transfer
+	var err error
+	if t.Id == 0 {
+		q := `insert into transfer(owner_id, stock_id, tdate, q, from_account, to_account, comments)
+			values ($1, $2, $3, $4, $5, $6, $7)`
+		_, err = db.Exec(q, uid, t.Stock, formatDate(t.Date), t.Q, t.From, t.To, t.Comments)
+	} else {
+		q := `update transfer set tdate = $1, q = $2, from_account = $3, to_account = $4,
+			comments = $5 where id = $6 and owner_id = $7`
+		_, err = db.Exec(q, formatDate(t.Date), t.Q, t.From, t.To, t.Comments, t.Id, uid)
+	}
+
+	// Check for error
+	if err != nil {
+		panic("addUpdateTransfer: " + err.Error())
+	}
+}
+
+// Delete one of a user's transfers by ID
+func deleteTransfer(uid, tid int) {
+
+	db := dbConnect()
+	defer db.Close()
+
+	_, err := db.Exec("delete from transfer where id = $1 and owner_id = $2", tid, uid)
+	if err != nil {
+		panic("deleteTransfer: " + err.Error())
+	}
+}
+
 //----------------------------------------------------------------//
 //                        CASH TRANSACTIONS                       //
 //----------------------------------------------------------------//
 
-// Record format for one cash transaction
+// Record format for one cash transaction. An FX conversion sells the
+// (negative) amount in one currency, and buys amount2 of currency2. A
+// transfer moves the (negative) amount from account to account2.
 type Cash struct {
-	Id       int       // ID of the transaction
-	Date     time.Time // the date for this transaction
-	Type     string    // "deposit", "withdraw"
-	Amount   float64   // + for deposit, - for withdraw
-	Comments string
+	Id        int       // ID of the transaction
+	Date      time.Time // the date for this transaction
+	Type      string    // one of cashTypes, see main.go
+	Account   string    // account (e.g., broker), blank for the main account
+	Currency  string    // currency of the amount, blank for home
+	Amount    float64   // + for money in, - for money out or FX sold
+	Currency2 string    // currency bought in an FX conversion
+	Amount2   float64   // amount bought in an FX conversion
+	Account2  string    // account transferred to
+	Comments  string
+	Balance   float64 // running balance in the currency, for display only
+}
+
+// Exchange rate of an FX conversion, i.e., units bought per unit sold
+func (c *Cash) Rate() float64 {
+	if c.Amount == 0 {
+		return 0
+	}
+	return -c.Amount2 / c.Amount
+}
+
+// Columns of the cash table, in the order read by scanCash()
+const cashCols = "id, tdate, ttype, account, currency, amount, currency2, amount2, account2, comments"
+
+// Read one cash transaction from a query result
+func scanCash(scan func(...any) error) (Cash, error) {
+	c := Cash{}
+	var ds string
+	err := scan(&c.Id, &ds, &c.Type, &c.Account, &c.Currency, &c.Amount, &c.Currency2,
+		&c.Amount2, &c.Account2, &c.Comments)
+	c.Date = parseDate(ds)
+	if c.Currency == "" {
+		c.Currency = homeCurrency
+	}
+	return c, err
 }
 
-// Get a list of all cash transactions
-func getCashTransactions() []Cash {
+// Get a list of all of a user's cash transactions
+func getCashTransactions(uid int) []Cash {
 
 	// Connect to database
 	db := dbConnect()
@@ -466,7 +1160,8 @@ func getCashTransactions() []Cash {
 	// Execute query to get all transactions
 	var err error
 	var rows *sql.Rows
-	rows, err = db.Query("select id, tdate, ttype, amount, comments from cash order by tdate")
+	q := "select " + cashCols + " from cash where owner_id = $1 order by tdate"
+	rows, err = db.Query(q, uid)
 	if err != nil {
 		panic("getCashTransactions query: " + err.Error())
 	}
@@ -475,13 +1170,10 @@ func getCashTransactions() []Cash {
 	// Collect into a list
 	cc := []Cash{}
 	for rows.Next() {
-		c := Cash{}
-		var ds string
-		err := rows.Scan(&c.Id, &ds, &c.Type, &c.Amount, &c.Comments)
+		c, err := scanCash(rows.Scan)
 		if err != nil {
 			panic("getCashTransactions next: " + err.Error())
 		}
-		c.Date = parseDate(ds)
 		cc = append(cc, c)
 	}
 	if rows.Err() != nil {
@@ -492,29 +1184,26 @@ func getCashTransactions() []Cash {
 	return cc
 }
 
-// Get one cash transaction by id
-func getCashTransaction(tid int) *Cash {
+// Get one of a user's cash transactions by id
+func getCashTransaction(uid, tid int) *Cash {
 
 	// Connect to database
 	db := dbConnect()
 	defer db.Close()
 
 	// Find and read transaction, return nil if not found
-	c := Cash{}
-	var ds string
-	q := "select id, tdate, ttype, amount, comments from cash where id = $1"
-	err := db.QueryRow(q, tid).Scan(&c.Id, &ds, &c.Type, &c.Amount, &c.Comments)
+	q := "select " + cashCols + " from cash where id = $1 and owner_id = $2"
+	c, err := scanCash(db.QueryRow(q, tid, uid).Scan)
 	if err != nil {
 		fmt.Println(err)
 		return nil
 	}
-	c.Date = parseDate(ds)
 
 	return &c
 }
 
-// Update an existing transaction, or add new
-func addUpdateCash(t *Cash) {
+// Update an existing cash transaction, or add new one for a user
+func addUpdateCash(uid int, t *Cash) {
 
 	// Connect to database
 	db := dbConnect()
@@ -523,11 +1212,16 @@ func addUpdateCash(t *Cash) {
 	// Attempt insert or update
 	var err error
 	if t.Id == 0 {
-		q := "insert into cash(tdate, ttype, amount, comments) values ($1, $2, $3, $4)"
-		_, err = db.Exec(q, formatDate(t.Date), t.Type, t.Amount, t.Comments)
+		q := `insert into cash(owner_id, tdate, ttype, account, currency, amount, currency2,
+			amount2, account2, comments) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+		_, err = db.Exec(q, uid, formatDate(t.Date), t.Type, t.Account, t.Currency, t.Amount,
+			t.Currency2, t.Amount2, t.Account2, t.Comments)
 	} else {
-		q := "update cash set tdate = $1, ttype = $2, amount = $3, comments = $4 where id = $5"
-		_, err = db.Exec(q, formatDate(t.Date), t.Type, t.Amount, t.Comments, t.Id)
+		q := `update cash set tdate = $1, ttype = $2, account = $3, currency = $4, amount = $5,
+			currency2 = $6, amount2 = $7, account2 = $8, comments = $9
+			where id = $10 and owner_id = $11`
+		_, err = db.Exec(q, formatDate(t.Date), t.Type, t.Account, t.Currency, t.Amount,
+			t.Currency2, t.Amount2, t.Account2, t.Comments, t.Id, uid)
 	}
 
 	// Check for error
@@ -536,38 +1230,70 @@ func addUpdateCash(t *Cash) {
 	}
 }
 
-// Delete a cash transaction by ID
-func deleteCash(tid int) {
+// Delete one of a user's cash transactions by ID
+func deleteCash(uid, tid int) {
 
 	db := dbConnect()
 	defer db.Close()
 
-	_, err := db.Exec("delete from cash where id = $1", tid)
+	_, err := db.Exec("delete from cash where id = $1 and owner_id = $2", tid, uid)
 	if err != nil {
 		panic("deleteCash: " + err.Error())
 	}
 }
 
+// Get the names of all of a user's accounts that have been used for
+// cash, transactions or transfers, in alphabetical order, not including
+// the main (blank) account
+func getAccounts(uid int) []string {
+
+	db := dbConnect()
+	defer db.Close()
+
+	q := `select account from cash where owner_id = $1 and account != ''
+		union select account2 from cash where owner_id = $1 and account2 != ''
+		union select account from trans where owner_id = $1 and account != ''
+		union select from_account from transfer where owner_id = $1 and from_account != ''
+		union select to_account from transfer where owner_id = $1 and to_account != ''
+		order by 1`
+	rows, err := db.Query(q, uid)
+	if err != nil {
+		panic("getAccounts query: " + err.Error())
+	}
+	defer rows.Close()
+
+	aa := []string{}
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			panic("getAccounts next: " + err.Error())
+		}
+		aa = append(aa, a)
+	}
+	return aa
+}
+
 //----------------------------------------------------------------//
 //                          CURRENCIES                            //
 //----------------------------------------------------------------//
 
 // Record format for one currency
 type Currency struct {
-	Id   int
-	Code string
-	Name string
+	Id    int
+	Code  string
+	Name  string
+	Infer bool // use rates inferred from prices where none is stored, see rates.go
 }
 
-// Get a list of all currencys, in alphabetical order
-func getCurrencies() []Currency {
+// Get a list of all of a user's currencies, in alphabetical order
+func getCurrencies(uid int) []Currency {
 
 	// Connect to database
 	db := dbConnect()
 	defer db.Close()
 
 	// Execute query to get all currencys, in alphabetical order
-	rows, err := db.Query("select id, code, name from currency order by code")
+	rows, err := db.Query("select id, code, name, infer from currency where owner_id = $1 order by code", uid)
 	if err != nil {
 		panic("getCurrencies query: " + err.Error())
 	}
@@ -577,7 +1303,7 @@ func getCurrencies() []Currency {
 	curs := []Currency{}
 	for rows.Next() {
 		cur := Currency{}
-		err := rows.Scan(&cur.Id, &cur.Code, &cur.Name)
+		err := rows.Scan(&cur.Id, &cur.Code, &cur.Name, &cur.Infer)
 		if err != nil {
 			panic("getCurrencies next: " + err.Error())
 		}
@@ -591,8 +1317,8 @@ func getCurrencies() []Currency {
 	return curs
 }
 
-// Get one currency by id
-func getCurrency(id int) *Currency {
+// Get one of a user's currencies by id
+func getCurrency(uid, id int) *Currency {
 
 	// Connect to database
 	db := dbConnect()
@@ -600,8 +1326,8 @@ func getCurrency(id int) *Currency {
 
 	// Find currency, return nil if not found
 	cur := Currency{}
-	q := "select id, code, name from currency where id = $1"
-	err := db.QueryRow(q, id).Scan(&cur.Id, &cur.Code, &cur.Name)
+	q := "select id, code, name, infer from currency where id = $1 and owner_id = $2"
+	err := db.QueryRow(q, id, uid).Scan(&cur.Id, &cur.Code, &cur.Name, &cur.Infer)
 	if err != nil {
 		return nil
 	}
@@ -609,8 +1335,8 @@ func getCurrency(id int) *Currency {
 	return &cur
 }
 
-// Get one currency by code
-func getCurrencyCode(code string) *Currency {
+// Get one of a user's currencies by code
+func getCurrencyCode(uid int, code string) *Currency {
 
 	// Connect to database
 	db := dbConnect()
@@ -618,18 +1344,17 @@ func getCurrencyCode(code string) *Currency {
 
 	// Find currency, return nil if not found
 	cur := Currency{}
-	q := "select id, code, name from currency where code = $1"
-	err := db.QueryRow(q, code).Scan(&cur.Id, &cur.Code, &cur.Name)
+	q := "select id, code, name, infer from currency where code = $1 and owner_id = $2"
+	err := db.QueryRow(q, code, uid).Scan(&cur.Id, &cur.Code, &cur.Name, &cur.Infer)
 	if err != nil {
-		fmt.Println("getCurrencyCode: " + err.Error())
 		return nil
 	}
 
 	return &cur
 }
 
-// Update an existing currency, or add new
-func addUpdateCurrency(cur *Currency) {
+// Update an existing currency, or add new one for a user
+func addUpdateCurrency(uid int, cur *Currency) {
 
 	// Connect to database
 	db := dbConnect()
@@ -638,11 +1363,11 @@ func addUpdateCurrency(cur *Currency) {
 	// Attempt insert or update
 	var err error
 	if cur.Id == 0 {
-		q := "insert into currency(code, name) values ($1, $2)"
-		_, err = db.Exec(q, cur.Code, cur.Name)
+		q := "insert into currency(owner_id, code, name, infer) values ($1, $2, $3, $4)"
+		_, err = db.Exec(q, uid, cur.Code, cur.Name, cur.Infer)
 	} else {
-		q := "update currency set code = $1, name = $2 where id = $3"
-		_, err = db.Exec(q, cur.Code, cur.Name, cur.Id)
+		q := "update currency set code = $1, name = $2, infer = $3 where id = $4 and owner_id = $5"
+		_, err = db.Exec(q, cur.Code, cur.Name, cur.Infer, cur.Id, uid)
 	}
 
 	// Check for error
@@ -651,14 +1376,14 @@ func addUpdateCurrency(cur *Currency) {
 	}
 }
 
-// Delete a currency by ID
+// Delete one of a user's currencies by ID
 // TODO: also delete all child records
-func deleteCurrency(cid int) {
+func deleteCurrency(uid, cid int) {
 
 	db := dbConnect()
 	defer db.Close()
 
-	_, err := db.Exec("delete from currency where id = $1", cid)
+	_, err := db.Exec("delete from currency where id = $1 and owner_id = $2", cid, uid)
 	if err != nil {
 		panic("deleteCurrency: " + err.Error())
 	}
@@ -679,8 +1404,8 @@ type Rate struct {
 	Rate     float64   // rate on this date
 }
 
-// Get rate by rate ID
-func getRate(rid int) *Rate {
+// Get one of a user's rates by rate ID
+func getRate(uid, rid int) *Rate {
 
 	// Connect to database
 	db := dbConnect()
@@ -688,8 +1413,8 @@ func getRate(rid int) *Rate {
 
 	// Find rate, return nil if not found
 	r := Rate{}
-	q := "select id, currency_id, rdate, rate from currency_rate where id = $1"
-	err := db.QueryRow(q, rid).Scan(&r.Id, &r.Currency, &r.Date, &r.Rate)
+	q := "select id, currency_id, rdate, rate from currency_rate where id = $1 and owner_id = $2"
+	err := db.QueryRow(q, rid, uid).Scan(&r.Id, &r.Currency, &r.Date, &r.Rate)
 	if err != nil {
 		return nil
 	}
@@ -697,15 +1422,16 @@ func getRate(rid int) *Rate {
 	return &r
 }
 
-// Get all rates for a currency
-func getRates(cid int) []Rate {
+// Get all rates for one of a user's currencies
+func getRates(uid, cid int) []Rate {
 
 	// Connect to database
 	db := dbConnect()
 	defer db.Close()
 
 	// Execute query to get all rates, in date order
-	rows, err := db.Query("select id, rdate, rate from currency_rate where currency_id = $1 order by rdate desc", cid)
+	q := "select id, rdate, rate from currency_rate where currency_id = $1 and owner_id = $2 order by rdate desc"
+	rows, err := db.Query(q, cid, uid)
 	if err != nil {
 		panic("getRates query: " + err.Error())
 	}
@@ -731,8 +1457,8 @@ func getRates(cid int) []Rate {
 	return rr
 }
 
-// Update an existing rate, or add new
-func addUpdateRate(r *Rate) {
+// Update an existing rate, or add new one for a user
+func addUpdateRate(uid int, r *Rate) {
 
 	// Connect to database
 	db := dbConnect()
@@ -741,11 +1467,11 @@ func addUpdateRate(r *Rate) {
 	// Attempt insert or update
 	var err error
 	if r.Id == 0 {
-		q := "insert into currency_rate(currency_id, rdate, rate) values ($1, $2, $3)"
-		_, err = db.Exec(q, r.Currency, r.Date, r.Rate)
+		q := "insert into currency_rate(owner_id, currency_id, rdate, rate) values ($1, $2, $3, $4)"
+		_, err = db.Exec(q, uid, r.Currency, r.Date, r.Rate)
 	} else {
-		q := "update currency_rate set rdate = $1, rate = $2 where id = $3"
-		_, err = db.Exec(q, r.Date, r.Rate, r.Id)
+		q := "update currency_rate set rdate = $1, rate = $2 where id = $3 and owner_id = $4"
+		_, err = db.Exec(q, r.Date, r.Rate, r.Id, uid)
 	}
 
 	// Check for error
@@ -753,3 +1479,240 @@ func addUpdateRate(r *Rate) {
 		panic("addUpdateRate: " + err.Error())
 	}
 }
+
+// Set the rate of one of a user's currencies on a date, replacing any rate
+// already on that date. Returns an error rather than panicking, so an
+// import can go on with the other rates.
+func setRateOnDate(uid int, r *Rate) error {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Look for a rate on the same date
+	q := "select id from currency_rate where currency_id = $1 and owner_id = $2 and date(rdate) = $3"
+	err := db.QueryRow(q, r.Currency, uid, formatDate(r.Date)).Scan(&r.Id)
+	if err == sql.ErrNoRows {
+		r.Id = 0
+	} else if err != nil {
+		return fmt.Errorf("setRateOnDate: %w", err)
+	}
+
+	// Add or update it
+	if r.Id == 0 {
+		q = "insert into currency_rate(owner_id, currency_id, rdate, rate) values ($1, $2, $3, $4)"
+		_, err = db.Exec(q, uid, r.Currency, r.Date, r.Rate)
+	} else {
+		q = "update currency_rate set rdate = $1, rate = $2 where id = $3 and owner_id = $4"
+		_, err = db.Exec(q, r.Date, r.Rate, r.Id, uid)
+	}
+	if err != nil {
+		return fmt.Errorf("setRateOnDate: %w", err)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------//
+//                       USERS AND SESSIONS                       //
+//----------------------------------------------------------------//
+
+// Each user owns their own stocks, transactions, cash, currencies
+// and rates, and may share their portfolio read-only with others
+
+// Record format for a user
+type User struct {
+	Id     int    // ID of the user
+	Name   string // login name
+	PwHash string // salt and hash of password, see hashPassword()
+}
+
+// Get a user by login name
+func getUserByName(name string) *User {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Find user, return nil if not found
+	u := User{}
+	q := "select id, name, pwhash from user where name = $1"
+	err := db.QueryRow(q, name).Scan(&u.Id, &u.Name, &u.PwHash)
+	if err != nil {
+		return nil
+	}
+
+	return &u
+}
+
+// Add a new user, or update the password of an existing one
+func addUpdateUser(u *User) {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Attempt insert or update
+	var err error
+	if u.Id == 0 {
+		q := "insert into user(name, pwhash) values ($1, $2)"
+		_, err = db.Exec(q, u.Name, u.PwHash)
+	} else {
+		q := "update user set name = $1, pwhash = $2 where id = $3"
+		_, err = db.Exec(q, u.Name, u.PwHash, u.Id)
+	}
+
+	// Check for error
+	if err != nil {
+		panic("addUpdateUser: " + err.Error())
+	}
+}
+
+// Record a new login session for a user
+func addSession(token string, uid int) {
+
+	db := dbConnect()
+	defer db.Close()
+
+	q := "insert into session(token, user_id, created) values ($1, $2, $3)"
+	_, err := db.Exec(q, token, uid, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		panic("addSession: " + err.Error())
+	}
+}
+
+// Get the user logged in with a session token, nil if the token is
+// unknown or older than the maximum session age
+func getSessionUser(token string) *User {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Find session and its user, return nil if not found or expired
+	u := User{}
+	var created string
+	q := `select u.id, u.name, u.pwhash, s.created from session s
+		join user u on u.id = s.user_id where s.token = $1`
+	err := db.QueryRow(q, token).Scan(&u.Id, &u.Name, &u.PwHash, &created)
+	if err != nil {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, created)
+	if err != nil || time.Since(t) > sessionMaxAge {
+		return nil
+	}
+
+	return &u
+}
+
+// Delete a login session
+func deleteSession(token string) {
+
+	db := dbConnect()
+	defer db.Close()
+
+	_, err := db.Exec("delete from session where token = $1", token)
+	if err != nil {
+		panic("deleteSession: " + err.Error())
+	}
+}
+
+//----------------------------------------------------------------//
+//                        SHARED PORTFOLIOS                       //
+//----------------------------------------------------------------//
+
+// An owner may give other users read-only access to their portfolio
+
+// Get the users that an owner has shared their portfolio with
+func getSharedWith(owner int) []User {
+	q := `select u.id, u.name from share s join user u on u.id = s.user_id
+		where s.owner_id = $1 order by u.name`
+	return queryUsers(q, owner)
+}
+
+// Get the owners who have shared their portfolio with a user
+func getSharedTo(uid int) []User {
+	q := `select u.id, u.name from share s join user u on u.id = s.owner_id
+		where s.user_id = $1 order by u.name`
+	return queryUsers(q, uid)
+}
+
+// Get all users, in order of name
+func getAllUsers() []User {
+	return queryUsers("select id, name from user order by name")
+}
+
+// Run a query on users that returns id and name for each
+func queryUsers(q string, args ...any) []User {
+
+	// Connect to database
+	db := dbConnect()
+	defer db.Close()
+
+	// Execute query
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		panic("queryUsers query: " + err.Error())
+	}
+	defer rows.Close()
+
+	// Collect into a list
+	uu := []User{}
+	for rows.Next() {
+		u := User{}
+		err := rows.Scan(&u.Id, &u.Name)
+		if err != nil {
+			panic("queryUsers next: " + err.Error())
+		}
+		uu = append(uu, u)
+	}
+	if rows.Err() != nil {
+		panic("queryUsers exit: " + err.Error())
+	}
+
+	// Return list
+	return uu
+}
+
+// Determine whether an owner has shared their portfolio with a user
+func isShared(owner, uid int) bool {
+
+	db := dbConnect()
+	defer db.Close()
+
+	var n int
+	q := "select count(*) from share where owner_id = $1 and user_id = $2"
+	err := db.QueryRow(q, owner, uid).Scan(&n)
+	if err != nil {
+		panic("isShared: " + err.Error())
+	}
+	return n > 0
+}
+
+// Share an owner's portfolio with a user, if not already shared
+func addShare(owner, uid int) {
+
+	if isShared(owner, uid) {
+		return
+	}
+
+	db := dbConnect()
+	defer db.Close()
+
+	_, err := db.Exec("insert into share(owner_id, user_id) values ($1, $2)", owner, uid)
+	if err != nil {
+		panic("addShare: " + err.Error())
+	}
+}
+
+// Stop sharing an owner's portfolio with a user
+func deleteShare(owner, uid int) {
+
+	db := dbConnect()
+	defer db.Close()
+
+	_, err := db.Exec("delete from share where owner_id = $1 and user_id = $2", owner, uid)
+	if err != nil {
+		panic("deleteShare: " + err.Error())
+	}
+}
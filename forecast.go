@@ -0,0 +1,213 @@
+// Dividend forecast: income expected over the next 12 months, from the
+// pattern of past dividends and the units held now
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A dividend payment expected from a stock
+type ExpectedDividend struct {
+	Date    time.Time // expected date, from a past payment
+	PerUnit float64   // net amount per unit, in home currency
+	Amount  float64   // for the units held
+}
+
+// Dividends expected from one stock over 12 months, and total for each
+// month
+type StockForecast struct {
+	Stock    Stock
+	PerYear  int     // payments per year, see paymentsPerYear
+	Units    float64 // units held at the start
+	Payments []ExpectedDividend
+	Months   []float64 // total expected in each month
+	Total    float64
+}
+
+// Frequency of payments, for display
+func (f *StockForecast) Frequency() string {
+	switch f.PerYear {
+	case 12:
+		return "Monthly"
+	case 4:
+		return "Quarterly"
+	case 2:
+		return "Half-yearly"
+	}
+	return "Yearly"
+}
+
+// Dividend income forecast and actually received in one month
+type MonthIncome struct {
+	Month    time.Time // first day of the month
+	Forecast float64
+	Actual   float64
+}
+
+// Show page with a calendar of dividends expected over the next 12
+// months, and the forecast for the last 12 months (as it would have been
+// made a year ago) compared with what was received
+func showForecast(c *gin.Context) {
+
+	// Forecast from the start of this month
+	uid := portfolioOwner(c)
+	now := today()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	forecast := getDividendForecast(uid, start)
+	months, totals := []time.Time{}, make([]float64, 12)
+	var total float64
+	for i := 0; i < 12; i++ {
+		months = append(months, start.AddDate(0, i, 0))
+	}
+	for _, f := range forecast {
+		for i, m := range f.Months {
+			totals[i] += m
+		}
+		total += f.Total
+	}
+
+	// Compare last year's forecast with dividends received
+	yearAgo := start.AddDate(-1, 0, 0)
+	past := []MonthIncome{}
+	for i := 0; i < 12; i++ {
+		past = append(past, MonthIncome{Month: yearAgo.AddDate(0, i, 0)})
+	}
+	var pastForecast, pastActual float64
+	for _, f := range getDividendForecast(uid, yearAgo) {
+		for i, m := range f.Months {
+			past[i].Forecast += m
+			pastForecast += m
+		}
+	}
+	for _, d := range getDividends(uid, 0) {
+		if i := monthIndex(yearAgo, d.Date); i >= 0 && i < 12 {
+			past[i].Actual += d.Amount
+			pastActual += d.Amount
+		}
+	}
+
+	// Show page
+	showPage(c, "forecast.html",
+		gin.H{"forecast": forecast, "months": months, "totals": totals, "total": total,
+			"past": past, "pastForecast": pastForecast, "pastActual": pastActual,
+			"home": homeCurrency, "current": "Income"})
+}
+
+// Forecast a user's dividends for the 12 months from a date, using only
+// what was known then: for each stock held on the date, the frequency of
+// payments is inferred from dividends in the previous 3 years, and each of
+// the last year's payments (as many as the frequency) is expected again,
+// with the same net amount per unit, for the units held on the date. A
+// stock with no dividend in the last 15 months is not expected to pay.
+func getDividendForecast(uid int, from time.Time) []StockForecast {
+
+	// Units held on the date, and on each dividend date before it
+	units := unitsOnDates(uid, []time.Time{from})[0]
+	dd := []Dividend{}
+	dates := []time.Time{}
+	for _, d := range getDividends(uid, 0) {
+		if d.Date.Before(from) && !d.Date.Before(from.AddDate(-3, 0, 0)) {
+			dd = append(dd, d)
+			dates = append(dates, d.Date)
+		}
+	}
+	unitsThen := unitsOnDates(uid, dates)
+
+	// Net amount per unit of each dividend, adjusted for splits since,
+	// grouped by stock
+	type paid struct {
+		date    time.Time
+		perUnit float64
+	}
+	byStock := map[int][]paid{}
+	actions := getActions(uid, 0)
+	for i, d := range dd {
+		q := unitsThen[i][d.Stock]
+		if q <= 0 || d.Amount <= 0 {
+			continue
+		}
+		f := splitFactor(actions, d.Stock, d.Date) / splitFactor(actions, d.Stock, from)
+		byStock[d.Stock] = append(byStock[d.Stock], paid{d.Date, d.Amount / q / f})
+	}
+
+	// Expected payments from each stock held
+	end := from.AddDate(1, 0, 0)
+	ff := []StockForecast{}
+	for _, s := range getStocks(uid) {
+		pp := byStock[s.Id]
+		q := units[s.Id]
+		if q <= 0 || len(pp) == 0 || pp[len(pp)-1].date.Before(from.AddDate(0, -15, 0)) {
+			continue
+		}
+		pdates := []time.Time{}
+		for _, p := range pp {
+			pdates = append(pdates, p.date)
+		}
+		f := StockForecast{Stock: s, PerYear: paymentsPerYear(pdates), Units: q,
+			Months: make([]float64, 12)}
+
+		// Each of the last payments again a year later (or a whole number
+		// of intervals after that, if still before the date)
+		n := min(f.PerYear, len(pp))
+		for _, p := range pp[len(pp)-n:] {
+			d := p.date.AddDate(1, 0, 0)
+			for d.Before(from) {
+				d = d.AddDate(0, 12/f.PerYear, 0)
+			}
+			if !d.Before(end) {
+				continue
+			}
+			e := ExpectedDividend{Date: d, PerUnit: p.perUnit, Amount: p.perUnit * q}
+			f.Payments = append(f.Payments, e)
+			f.Months[monthIndex(from, d)] += e.Amount
+			f.Total += e.Amount
+		}
+		sort.Slice(f.Payments, func(i, j int) bool {
+			return f.Payments[i].Date.Before(f.Payments[j].Date)
+		})
+		ff = append(ff, f)
+	}
+	return ff
+}
+
+// Number of payments per year from the dates of past payments (in
+// order): the median interval between them, as monthly, quarterly,
+// half-yearly or yearly. Yearly if only one payment.
+func paymentsPerYear(dates []time.Time) int {
+
+	// Intervals in days, leaving out payments on the same day
+	days := []float64{}
+	for i := 1; i < len(dates); i++ {
+		if !sameDate(dates[i], dates[i-1]) {
+			days = append(days, dates[i].Sub(dates[i-1]).Hours()/24)
+		}
+	}
+	if len(days) == 0 {
+		return 1
+	}
+	sort.Float64s(days)
+	median := days[len(days)/2]
+	if len(days)%2 == 0 {
+		median = (days[len(days)/2-1] + days[len(days)/2]) / 2
+	}
+
+	// Round to the nearest usual frequency
+	switch perYear := 365 / median; {
+	case perYear >= 8:
+		return 12
+	case perYear >= 3:
+		return 4
+	case perYear >= 1.5:
+		return 2
+	}
+	return 1
+}
+
+// Number of months from the month of one date to the month of another
+func monthIndex(from, d time.Time) int {
+	return (d.Year()-from.Year())*12 + int(d.Month()) - int(from.Month())
+}
@@ -0,0 +1,326 @@
+// Import of exchange rates from a feed: ECB eurofxref XML files (daily or
+// historical), or CSV files, uploaded or from a configured URL
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Exchange rates on one date, as units of each currency per unit of a base
+// currency (the ECB's convention, where the base is EUR)
+type FxRates struct {
+	Date    time.Time
+	Base    string
+	PerBase map[string]float64
+}
+
+// Result of importing the rates of one of a user's currencies
+type RateImport struct {
+	Currency Currency
+	Added    int
+	Updated  int
+	Failed   int       // rates that could not be saved
+	Error    string    // first error saving a rate
+	From, To time.Time // first and last date imported
+}
+
+// Show form to import rates from a file, or from the feed URL if
+// configured
+func showImportRates(c *gin.Context) {
+	showPage(c, "import_rates.html",
+		gin.H{"url": os.Getenv("RATES_URL"), "base": "EUR", "home": homeCurrency,
+			"current": "Currencies"})
+}
+
+// Import rates from an uploaded file, or from the feed URL if no file, and
+// show the results
+func doImportRates(c *gin.Context) {
+
+	// Read the file, or get the feed
+	uid := portfolioOwner(c)
+	base := strings.ToUpper(strings.TrimSpace(c.PostForm("base")))
+	if base == "" {
+		base = "EUR"
+	}
+	var data []byte
+	var err error
+	if fh, ferr := c.FormFile("file"); ferr == nil {
+		f, oerr := fh.Open()
+		if oerr != nil {
+			c.String(http.StatusOK, "doImportRates: "+oerr.Error())
+			return
+		}
+		defer f.Close()
+		data, err = io.ReadAll(f)
+	} else if u := os.Getenv("RATES_URL"); u != "" {
+		data, err = fetchRates(u)
+	} else {
+		err = errors.New("no file uploaded")
+	}
+	if err != nil {
+		c.String(http.StatusOK, "Cannot read rates: "+err.Error())
+		return
+	}
+
+	// Parse and save the rates
+	rates, err := parseRates(data, base)
+	if err != nil {
+		c.String(http.StatusOK, "Cannot read rates: "+err.Error())
+		return
+	}
+	results, skipped := importRates(uid, rates)
+
+	// Show the results
+	showPage(c, "import_rates.html",
+		gin.H{"url": os.Getenv("RATES_URL"), "base": base, "results": results,
+			"skipped": skipped, "dates": len(rates), "done": true, "home": homeCurrency,
+			"current": "Currencies"})
+}
+
+// Get the contents of a URL
+func fetchRates(u string) ([]byte, error) {
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Parse rates from ECB XML, or CSV quoted against a base currency, in date
+// order
+func parseRates(data []byte, base string) ([]FxRates, error) {
+	var rates []FxRates
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		rates, err = parseECBRates(data)
+	} else {
+		rates, err = parseCSVRates(data, base)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rates) == 0 {
+		return nil, errors.New("no rates found")
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].Date.Before(rates[j].Date)
+	})
+	return rates, nil
+}
+
+// Parse an ECB eurofxref XML file (daily, last 90 days, or historical):
+// a Cube for each date, with a Cube for each currency's rate per EUR
+func parseECBRates(data []byte) ([]FxRates, error) {
+	var doc struct {
+		Days []struct {
+			Time  string `xml:"time,attr"`
+			Rates []struct {
+				Currency string `xml:"currency,attr"`
+				Rate     string `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube>Cube"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	rates := []FxRates{}
+	for _, day := range doc.Days {
+		d := parseDate(day.Time)
+		if !validDate(d) {
+			return nil, fmt.Errorf("invalid date: %q", day.Time)
+		}
+		fx := FxRates{Date: d, Base: "EUR", PerBase: map[string]float64{}}
+		for _, r := range day.Rates {
+			x, err := strconv.ParseFloat(strings.TrimSpace(r.Rate), 64)
+			if err != nil || x <= 0 {
+				return nil, fmt.Errorf("invalid rate for %s on %s: %q", r.Currency, day.Time, r.Rate)
+			}
+			fx.PerBase[strings.ToUpper(r.Currency)] = x
+		}
+		rates = append(rates, fx)
+	}
+	return rates, nil
+}
+
+// Parse a CSV file with a header line, of rates as units of each currency
+// per unit of a base currency. Either a column for date, currency and rate
+// on each line, or a date column followed by a column for each currency
+// (as in the ECB's eurofxref-hist.csv), where a blank or N/A is no rate.
+func parseCSVRates(data []byte, base string) ([]FxRates, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no header line")
+	}
+
+	// Find columns from the header
+	cols := map[string]int{}
+	for i, h := range rows[0] {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	di, ok := cols["date"]
+	if !ok {
+		return nil, errors.New("no date column")
+	}
+	ci, long := cols["currency"]
+	ri, hasRate := cols["rate"]
+	long = long && hasRate
+
+	// Rates for each date, in order first seen
+	byDate := map[string]*FxRates{}
+	dates := []string{}
+	add := func(ds, cur, rate string) error {
+		rate = strings.TrimSpace(rate)
+		cur = strings.ToUpper(strings.TrimSpace(cur))
+		if cur == "" || rate == "" || strings.EqualFold(rate, "N/A") {
+			return nil
+		}
+		x, err := strconv.ParseFloat(rate, 64)
+		if err != nil || x <= 0 {
+			return fmt.Errorf("invalid rate for %s on %s: %q", cur, ds, rate)
+		}
+		fx := byDate[ds]
+		if fx == nil {
+			d := parseDate(ds)
+			if !validDate(d) {
+				return fmt.Errorf("invalid date: %q", ds)
+			}
+			fx = &FxRates{Date: d, Base: base, PerBase: map[string]float64{}}
+			byDate[ds] = fx
+			dates = append(dates, ds)
+		}
+		fx.PerBase[cur] = x
+		return nil
+	}
+	for _, row := range rows[1:] {
+		if di >= len(row) {
+			continue
+		}
+		ds := strings.TrimSpace(row[di])
+		if long {
+			if ci < len(row) && ri < len(row) {
+				if err := add(ds, row[ci], row[ri]); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		for i, h := range rows[0] {
+			if i != di && i < len(row) {
+				if err := add(ds, h, row[i]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// Rates in the order of dates in the file
+	rates := []FxRates{}
+	for _, ds := range dates {
+		rates = append(rates, *byDate[ds])
+	}
+	return rates, nil
+}
+
+// Rate of a currency as a multiplier to convert to home currency, from
+// rates against a base currency (cross rate if neither is the base), false
+// if either currency has no rate
+func (fx *FxRates) homeRate(code string) (float64, bool) {
+	perBase := func(cur string) (float64, bool) {
+		if cur == fx.Base {
+			return 1, true
+		}
+		x, ok := fx.PerBase[cur]
+		return x, ok && x > 0
+	}
+	home, ok1 := perBase(homeCurrency)
+	cur, ok2 := perBase(code)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return home / cur, true
+}
+
+// Save rates for each of a user's currencies other than the home currency,
+// replacing any rate on the same date. Returns the results for each
+// currency, including rates that could not be saved, and codes in the
+// rates that are not the user's currencies.
+func importRates(uid int, rates []FxRates) ([]RateImport, []string) {
+
+	// Dates of existing rates for each currency, to count updates
+	results := []RateImport{}
+	mine := map[string]bool{homeCurrency: true}
+	for _, cur := range getCurrencies(uid) {
+		mine[cur.Code] = true
+		if cur.Code == homeCurrency {
+			continue
+		}
+		existing := map[string]bool{}
+		for _, r := range getRates(uid, cur.Id) {
+			existing[formatDate(r.Date)] = true
+		}
+
+		// Save the rate on each date there is one
+		ri := RateImport{Currency: cur}
+		for _, fx := range rates {
+			x, ok := fx.homeRate(cur.Code)
+			if !ok {
+				continue
+			}
+			if err := setRateOnDate(uid, &Rate{Currency: cur.Id, Date: fx.Date, Rate: x}); err != nil {
+				ri.Failed++
+				if ri.Error == "" {
+					ri.Error = err.Error()
+				}
+				continue
+			}
+			if existing[formatDate(fx.Date)] {
+				ri.Updated++
+			} else {
+				ri.Added++
+			}
+			if ri.From.IsZero() {
+				ri.From = fx.Date
+			}
+			ri.To = fx.Date
+		}
+		results = append(results, ri)
+	}
+
+	// Currencies in the file that were not imported
+	skipped := []string{}
+	seen := map[string]bool{}
+	for _, fx := range rates {
+		for code := range fx.PerBase {
+			if !mine[code] && !seen[code] {
+				skipped = append(skipped, code)
+				seen[code] = true
+			}
+		}
+	}
+	sort.Strings(skipped)
+	return results, skipped
+}
@@ -0,0 +1,85 @@
+// Classifications: grouping stocks by asset class, sector, region,
+// currency or tag for reports, and filtering lists of stocks
+
+package main
+
+import (
+	"slices"
+	"sort"
+)
+
+// Group shown for stocks with no classification
+const unclassified = "Unclassified"
+
+// Get the groups a stock belongs to for one of the groupings (see
+// groupings in main.go, or "stock" for each stock in its own group). A
+// stock is in one group, except for tags, where it is in one group for
+// each tag (see groupShares). Blank values are "Unclassified".
+func stockGroups(s *Stock, by string) []string {
+	var g string
+	switch by {
+	case "stock":
+		g = s.Code
+	case "class":
+		g = s.AssetClass
+	case "sector":
+		g = s.Sector
+	case "region":
+		g = s.Region
+	case "currency":
+		g = s.Currency
+	case "tag":
+		if tags := s.TagList(); len(tags) > 0 {
+			return tags
+		}
+	}
+	if g == "" {
+		g = unclassified
+	}
+	return []string{g}
+}
+
+// Get the groups a stock belongs to for a grouping, with the share of
+// its value, income, etc. that counts in each. A stock with several tags
+// is split equally between them, so the groups in a report add up to the
+// total, as they do for the other groupings.
+func groupShares(s *Stock, by string) map[string]float64 {
+	groups := stockGroups(s, by)
+	shares := map[string]float64{}
+	for _, g := range groups {
+		shares[g] += 1 / float64(len(groups))
+	}
+	return shares
+}
+
+// Whether a stock matches a filter, i.e., is in the group selected for
+// each grouping in the filter (blank to match all)
+func stockMatches(s *Stock, filter map[string]string) bool {
+	for by, g := range filter {
+		if g != "" && !slices.Contains(stockGroups(s, by), g) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get all the groups used by a list of stocks for each grouping, in
+// alphabetical order, e.g., to offer as filters
+func groupOptions(ss []Stock) map[string][]string {
+	options := map[string][]string{}
+	for _, gr := range groupings {
+		found := map[string]bool{}
+		for i := range ss {
+			for _, g := range stockGroups(&ss[i], gr.Key) {
+				found[g] = true
+			}
+		}
+		gg := []string{}
+		for g := range found {
+			gg = append(gg, g)
+		}
+		sort.Strings(gg)
+		options[gr.Key] = gg
+	}
+	return options
+}
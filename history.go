@@ -0,0 +1,213 @@
+// Value history: the value of a portfolio over time, and the money added
+// or taken out, from which performance is measured
+
+package main
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// Value of a portfolio on a date
+type ValuePoint struct {
+	Date      time.Time
+	Value     float64   // holdings, and cash if tracked, in home currency
+	Flow      float64   // money added since the previous point, negative if taken out
+	PriceDate time.Time // date of the oldest price or rate used, zero if none
+	Missing   int       // holdings and currencies with no price or rate, left out of the value
+}
+
+// Get the value of a user's portfolio on each of a list of dates (in
+// order), and on each date between them that money was added or taken
+// out, so the flows are on the dates of the points. Holdings and cash are
+// valued using a price policy, and converted using exchange rates. Returns
+// the points in date order, and whether cash is tracked.
+//
+// Cash is tracked if there are deposits or withdrawals: the value includes
+// cash, and the flows are the deposits and withdrawals. Otherwise the value
+// is just the holdings, and the flows are money paid for purchases less
+// money received from sales, dividends, etc. Either way, the first point's
+// flow is its value, as if all the money was added then.
+func getValueHistory(uid int, dates []time.Time, policy PricePolicy, rates *Rates) ([]ValuePoint, bool) {
+
+	// Exchange rates using the policy. Flows happened, so are converted at
+	// the latest rate if strict finds none recent enough.
+	rate := func(cur string, d time.Time, policy PricePolicy) PriceAt {
+		if cur == "" || cur == homeCurrency {
+			return PriceAt{Price: 1, OK: true}
+		}
+		return priceOn(rates.Series(cur), d, policy)
+	}
+	flowPolicy := policy
+	if flowPolicy.Method == PriceStrict {
+		flowPolicy.Method = PriceLast
+	}
+
+	// Get all cash, and work out if it is tracked
+	from, to := dates[0], dates[len(dates)-1]
+	cash := getAllCash(uid, to, rates)
+	tracked := false
+	for _, c := range cash {
+		if cat := cashCategory(c.Type); cat == "Deposits" || cat == "Withdrawals" {
+			tracked = true
+		}
+	}
+	isFlow := func(c Cash) bool {
+		cat := cashCategory(c.Type)
+		return !tracked || cat == "Deposits" || cat == "Withdrawals"
+	}
+
+	// Add dates of flows
+	dates = slices.Clone(dates)
+	for _, c := range cash {
+		if isFlow(c) && c.Date.After(from) && c.Date.Before(to) {
+			dates = append(dates, c.Date)
+		}
+	}
+	dates = uniqueDates(dates)
+
+	// Split-adjusted prices of each stock, and splits to convert them back
+	prices := map[int]TimeSeries{}
+	for _, s := range getStocks(uid) {
+		prices[s.Id] = adjustedSeries(uid, s.Id)
+	}
+	actions := getActions(uid, 0)
+
+	// Value of holdings and cash on each date, and the flows since the
+	// previous date
+	units := unitsOnDates(uid, dates)
+	pts := []ValuePoint{}
+	balances := map[string]float64{}
+	i := 0
+	for n, d := range dates {
+		p := ValuePoint{Date: d}
+		for ; i < len(cash) && !cash[i].Date.After(d); i++ {
+			c := cash[i]
+			balances[c.Currency] += c.Amount
+			if !isFlow(c) {
+				continue
+			}
+			if tracked {
+				p.Flow += c.Amount * rate(c.Currency, c.Date, flowPolicy).Price
+			} else {
+				p.Flow -= c.Amount * rate(c.Currency, c.Date, flowPolicy).Price
+			}
+		}
+		value := func(amt float64, price PriceAt) {
+			if !price.OK {
+				p.Missing++
+				return
+			}
+			p.Value += amt * price.Price
+			if !price.Date.IsZero() && (p.PriceDate.IsZero() || price.Date.Before(p.PriceDate)) {
+				p.PriceDate = price.Date
+			}
+		}
+		for sid, q := range units[n] {
+			if q != 0 {
+				value(q, unadjustedPriceOn(prices[sid], actions, sid, d, policy))
+			}
+		}
+		if tracked {
+			for cur, amt := range balances {
+				if amt != 0 {
+					value(amt, rate(cur, d, policy))
+				}
+			}
+		}
+		if n == 0 {
+			p.Flow = p.Value
+		}
+		pts = append(pts, p)
+	}
+	return pts, tracked
+}
+
+// Points of a value history with every price and rate, leaving out the
+// others if the price policy is strict, with their flows added to the next
+// point. Returns the points kept, and the number left out.
+func pricedPoints(pts []ValuePoint, policy PricePolicy) ([]ValuePoint, int) {
+	if policy.Method != PriceStrict {
+		return pts, 0
+	}
+	kept := []ValuePoint{}
+	var flow float64
+	for _, p := range pts {
+		if p.Missing > 0 {
+			flow += p.Flow
+			continue
+		}
+		p.Flow += flow
+		flow = 0
+		if len(kept) == 0 {
+			p.Flow = p.Value
+		}
+		kept = append(kept, p)
+	}
+	return kept, len(pts) - len(kept)
+}
+
+// Dates at the end of each month after one date and before another, with
+// the dates themselves at each end
+func monthEnds(from, to time.Time) []time.Time {
+	dd := []time.Time{from}
+	d := time.Date(from.Year(), from.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+	for ; d.Before(to); d = time.Date(d.Year(), d.Month()+2, 0, 0, 0, 0, 0, time.UTC) {
+		if d.After(from) {
+			dd = append(dd, d)
+		}
+	}
+	return append(dd, to)
+}
+
+// Sort dates, leaving out any on the same day as the one before
+func uniqueDates(dd []time.Time) []time.Time {
+	sort.Slice(dd, func(i, j int) bool {
+		return dd[i].Before(dd[j])
+	})
+	out := []time.Time{}
+	for _, d := range dd {
+		if len(out) == 0 || !sameDate(d, out[len(out)-1]) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Time-weighted return index of a value history, starting at 100. As the
+// flows are on the dates of the points, the return from one point to the
+// next is the change in value less the flow, relative to the value before.
+func returnIndex(pts []ValuePoint) []float64 {
+	idx := make([]float64, len(pts))
+	for i, p := range pts {
+		if i == 0 {
+			idx[i] = 100
+			continue
+		}
+		r := 0.0
+		if v0 := pts[i-1].Value; v0 > 0 {
+			r = (p.Value-p.Flow)/v0 - 1
+		}
+		idx[i] = idx[i-1] * (1 + r)
+	}
+	return idx
+}
+
+// Value at each point had each flow of money been used to buy (or sell)
+// units of a benchmark at its price on the date instead, using a price
+// policy. Money is held as cash until there is a price to buy at.
+func whatIfValues(pts []ValuePoint, bench TimeSeries, policy PricePolicy) []float64 {
+	vv := make([]float64, len(pts))
+	var units, pending, price float64
+	for i, p := range pts {
+		pending += p.Flow
+		if pa := priceOn(bench, p.Date, policy); pa.OK && pa.Price > 0 {
+			price = pa.Price
+			units += pending / price
+			pending = 0
+		}
+		vv[i] = units*price + pending
+	}
+	return vv
+}
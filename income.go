@@ -0,0 +1,107 @@
+// Income: dividends received per year and stock (or classification),
+// with tax withheld
+
+package main
+
+import (
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dividend income from one stock or group of stocks (or total for all
+// stocks) in a year, all amounts in home currency
+type Income struct {
+	Stock       Stock   // the stock, blank for groups and totals
+	Group       string  // group of stocks, if grouped by classification
+	Gross       float64 // gross dividends, before withholding tax
+	Withholding float64 // foreign tax withheld, e.g., to reclaim
+	Net         float64 // net dividends received
+	Reinvested  float64 // part of net that was reinvested
+}
+
+// Add a share of a dividend to income (1 for all of it)
+func (inc *Income) add(d *Dividend, share float64) {
+	inc.Gross += d.GrossHome() * share
+	inc.Withholding += d.WithholdingHome() * share
+	inc.Net += d.Amount * share
+	if d.Trans > 0 {
+		inc.Reinvested += d.Amount * share
+	}
+}
+
+// Income for one year, per stock and total
+type IncomeYear struct {
+	Year   int
+	Stocks []Income
+	Total  Income
+}
+
+// Show page with dividend income and withholding tax for each year, per
+// stock, or per group if a grouping is given in the query string
+func showIncome(c *gin.Context) {
+	uid := portfolioOwner(c)
+	by := c.Query("by")
+	showPage(c, "income.html",
+		gin.H{"years": getIncome(uid, by), "by": by, "groupings": groupings,
+			"home": homeCurrency, "current": "Income"})
+}
+
+// Get a user's dividend income per year, latest year first, and per
+// stock in each year in order of stock code. If grouped by one of the
+// groupings, income is per group instead, and a stock with several tags
+// has its income split equally between them (see groupShares).
+func getIncome(uid int, by string) []IncomeYear {
+
+	// Accumulate income per year and stock or group, and total per year
+	stocks := map[int]Stock{}
+	for _, s := range getStocks(uid) {
+		stocks[s.Id] = s
+	}
+	byYear := map[int]map[string]*Income{}
+	totals := map[int]*Income{}
+	for _, d := range getDividends(uid, 0) {
+		y := d.Date.Year()
+		if byYear[y] == nil {
+			byYear[y] = map[string]*Income{}
+			totals[y] = &Income{}
+		}
+		totals[y].add(&d, 1)
+		s := stocks[d.Stock]
+		keys := map[string]float64{s.Code: 1}
+		if by != "" {
+			keys = groupShares(&s, by)
+		}
+		for k, share := range keys {
+			inc, ok := byYear[y][k]
+			if !ok {
+				inc = &Income{Stock: s}
+				if by != "" {
+					inc = &Income{Group: k}
+				}
+				byYear[y][k] = inc
+			}
+			inc.add(&d, share)
+		}
+	}
+
+	// Convert to sorted lists, with totals for each year
+	years := []IncomeYear{}
+	for y, m := range byYear {
+		iy := IncomeYear{Year: y, Total: *totals[y]}
+		for _, inc := range m {
+			iy.Stocks = append(iy.Stocks, *inc)
+		}
+		sort.Slice(iy.Stocks, func(i, j int) bool {
+			if iy.Stocks[i].Group != iy.Stocks[j].Group {
+				return iy.Stocks[i].Group < iy.Stocks[j].Group
+			}
+			return iy.Stocks[i].Stock.Code < iy.Stocks[j].Stock.Code
+		})
+		years = append(years, iy)
+	}
+	sort.Slice(years, func(i, j int) bool {
+		return years[i].Year > years[j].Year
+	})
+	return years
+}
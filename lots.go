@@ -0,0 +1,397 @@
+// Lots and positions: replays buy/sell transactions, corporate actions
+// and transfers between accounts in date order to get the units held and
+// cost basis of each stock
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// A lot is a number of units acquired together, which keeps its original
+// date and cost through splits, spin-offs, mergers and transfers between
+// accounts. Cost is the price paid excluding fees, in home currency.
+type Lot struct {
+	Date    time.Time // date the units were originally acquired
+	Units   float64   // units remaining in this lot
+	Cost    float64   // cost basis of the remaining units
+	Account string    // account the lot is held in, blank for main account
+}
+
+// Position in one stock: the lots still held, plus gains realized from
+// sales and any cash received from corporate actions
+type Position struct {
+	Stock    int     // ID of the stock
+	Lots     []Lot   // lots held, oldest first
+	Realized float64 // gains realized so far, in home currency
+}
+
+// Total units held
+func (p *Position) Units() float64 {
+	var q float64
+	for _, l := range p.Lots {
+		q += l.Units
+	}
+	return q
+}
+
+// Total cost basis of units held
+func (p *Position) Cost() float64 {
+	var cost float64
+	for _, l := range p.Lots {
+		cost += l.Cost
+	}
+	return cost
+}
+
+// Units held in each account, by account name (blank for main account)
+func (p *Position) Accounts() map[string]float64 {
+	accts := map[string]float64{}
+	for _, l := range p.Lots {
+		accts[l.Account] += l.Units
+	}
+	return accts
+}
+
+// Add a lot to an account
+func (p *Position) buy(acct string, d time.Time, units, cost float64) {
+	p.Lots = append(p.Lots, Lot{Date: d, Units: units, Cost: cost, Account: acct})
+}
+
+// Remove units held in an account, oldest lots first, and return the lots
+// removed, which are split if only part of a lot is needed. If removing
+// more than is held, the account goes negative at zero cost.
+func (p *Position) remove(acct string, units float64) []Lot {
+	removed := []Lot{}
+	kept := []Lot{}
+	for _, l := range p.Lots {
+		if l.Account != acct || units < 1e-9 || l.Units <= 0 {
+			kept = append(kept, l)
+		} else if l.Units <= units+1e-9 { // whole lot
+			units -= l.Units
+			removed = append(removed, l)
+		} else { // part of lot
+			part := l
+			part.Units = units
+			part.Cost = l.Cost * units / l.Units
+			l.Units -= units
+			l.Cost -= part.Cost
+			kept = append(kept, l)
+			removed = append(removed, part)
+			units = 0
+		}
+	}
+	p.Lots = kept
+	if units > 1e-9 {
+		p.Lots = append(p.Lots, Lot{Units: -units, Account: acct})
+	}
+	return removed
+}
+
+// Sell units held in an account, oldest lots first, and return the cost
+// basis removed
+func (p *Position) sell(acct string, units float64) float64 {
+	var cost float64
+	for _, l := range p.remove(acct, units) {
+		cost += l.Cost
+	}
+	return cost
+}
+
+// Move units from one account to another, oldest lots first, keeping
+// their original dates and cost
+func (p *Position) transfer(from, to string, units float64) {
+	for _, l := range p.remove(from, units) {
+		l.Account = to
+		p.Lots = append(p.Lots, l)
+	}
+	sort.SliceStable(p.Lots, func(i, j int) bool {
+		return p.Lots[i].Date.Before(p.Lots[j].Date)
+	})
+}
+
+// Sell any fractional unit left after a corporate action for the cash
+// received in lieu, realizing a gain or loss on the fraction. The
+// fraction is sold from the account of the oldest lot.
+func (p *Position) cashInLieu(cash float64) {
+	units := p.Units()
+	frac := units - math.Floor(units+1e-9)
+	if frac > 1e-9 && len(p.Lots) > 0 {
+		cost := p.sell(p.Lots[0].Account, frac)
+		p.Realized += cash - cost
+	} else {
+		p.Realized += cash
+	}
+}
+
+// Get positions in all of a user's stocks on a date (inclusive), as a
+// map from stock ID to position. Corporate actions on a date are applied
+// before transactions on the same date, i.e., they take effect at the
+// start of the day.
+func getPositions(uid int, d time.Time) map[int]*Position {
+	positions := map[int]*Position{}
+	for _, e := range getPositionEvents(uid) {
+		if later(e.date, d) {
+			break
+		}
+		e.apply(positionFor(positions))
+	}
+	return positions
+}
+
+// Get units held of each of a user's stocks on each of a list of dates,
+// which must be in order. Same as getPositions() for each date, but only
+// reads the transactions once.
+func unitsOnDates(uid int, dates []time.Time) []map[int]float64 {
+	events := getPositionEvents(uid)
+	positions := map[int]*Position{}
+	uu := []map[int]float64{}
+	i := 0
+	for _, d := range dates {
+		for ; i < len(events) && !later(events[i].date, d); i++ {
+			events[i].apply(positionFor(positions))
+		}
+		units := map[int]float64{}
+		for sid, p := range positions {
+			units[sid] = p.Units()
+		}
+		uu = append(uu, units)
+	}
+	return uu
+}
+
+// Function to get the position for a stock from a map of positions,
+// created when first needed
+func positionFor(positions map[int]*Position) func(int) *Position {
+	return func(sid int) *Position {
+		p, ok := positions[sid]
+		if !ok {
+			p = &Position{Stock: sid}
+			positions[sid] = p
+		}
+		return p
+	}
+}
+
+// A transaction, corporate action or transfer that changes positions
+type positionEvent struct {
+	date     time.Time
+	trans    *Transaction
+	action   *Action
+	transfer *Transfer
+}
+
+// Get all of a user's transactions, corporate actions and transfers, in
+// date order, with corporate actions first on each date
+func getPositionEvents(uid int) []positionEvent {
+	events := []positionEvent{}
+	for _, t := range getTransactions(uid, 0) {
+		events = append(events, positionEvent{date: t.Date, trans: &t})
+	}
+	for _, a := range getActions(uid, 0) {
+		events = append(events, positionEvent{date: a.Date, action: &a})
+	}
+	for _, t := range getTransfers(uid, 0) {
+		events = append(events, positionEvent{date: t.Date, transfer: &t})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if sameDate(events[i].date, events[j].date) {
+			return events[i].action != nil && events[j].action == nil
+		}
+		return events[i].date.Before(events[j].date)
+	})
+	return events
+}
+
+// Apply an event to the positions it affects
+func (e *positionEvent) apply(pos func(int) *Position) {
+	if e.trans != nil {
+		t := e.trans
+		p := pos(t.Stock)
+		if t.Q > 0 { // purchase
+			p.buy(t.Account, t.Date, t.Q, t.Amount-t.Fees)
+		} else if t.Q < 0 { // sale, amount is proceeds
+			cost := p.sell(t.Account, -t.Q)
+			p.Realized += t.Amount - cost
+		}
+	} else if e.transfer != nil {
+		t := e.transfer
+		pos(t.Stock).transfer(t.From, t.To, t.Q)
+	} else {
+		applyAction(e.action, pos)
+	}
+}
+
+// Apply a corporate action to the positions it affects
+func applyAction(a *Action, pos func(int) *Position) {
+	p := pos(a.Stock)
+	switch a.Type {
+
+	// Split or reverse split: scale units, keeping cost
+	case ActionSplit:
+		r := a.Ratio()
+		for i := range p.Lots {
+			p.Lots[i].Units *= r
+		}
+		if a.Cash > 0 {
+			p.cashInLieu(a.Cash)
+		}
+
+	// Spin-off: new units of another stock for each unit held, taking
+	// a fraction of the cost basis but keeping acquisition dates
+	case ActionSpinOff:
+		if a.NewStock == 0 {
+			return
+		}
+		child := pos(a.NewStock)
+		r := a.Ratio()
+		for i := range p.Lots {
+			l := &p.Lots[i]
+			moved := l.Cost * a.CostFraction
+			l.Cost -= moved
+			child.buy(l.Account, l.Date, l.Units*r, moved)
+		}
+		if a.Cash > 0 {
+			child.cashInLieu(a.Cash)
+		}
+
+	// Merger: all units exchanged for new units of another stock and/or
+	// cash; the fraction of cost basis not carried to the new stock is
+	// set against the cash received
+	case ActionMerger:
+		basis := p.Cost()
+		var carried float64
+		if a.NewStock > 0 {
+			child := pos(a.NewStock)
+			r := a.Ratio()
+			for _, l := range p.Lots {
+				c := l.Cost * a.CostFraction
+				carried += c
+				child.buy(l.Account, l.Date, l.Units*r, c)
+			}
+		}
+		p.Realized += a.Cash - (basis - carried)
+		p.Lots = nil
+
+	// Code change has no effect on units or cost
+	case ActionCodeChange:
+	}
+}
+
+// Factor to convert a raw price on a date to a split-adjusted one,
+// i.e., the product of the ratios of all splits after the date
+func splitFactor(actions []Action, sid int, d time.Time) float64 {
+	f := 1.0
+	for _, a := range actions {
+		if a.Type == ActionSplit && a.Stock == sid && later(a.Date, d) {
+			f *= a.Ratio()
+		}
+	}
+	return f
+}
+
+// Get all prices for a stock, adjusted for splits so they are comparable
+// with the latest prices (a price on the day of a split is already
+// post-split, so is not adjusted)
+func getAdjustedPrices(uid, sid int) []Price {
+	actions := getActions(uid, sid)
+	prices := getPrices(uid, sid)
+	for i := range prices {
+		f := splitFactor(actions, sid, prices[i].Date)
+		prices[i].Price /= f
+		prices[i].PriceX /= f
+	}
+	return prices
+}
+
+// One event in the history of a stock, with the position after it. Amounts
+// are in home currency.
+type LedgerEntry struct {
+	Date     time.Time
+	Type     string  // Buy, Sell, Dividend, Transfer, or type of corporate action
+	Comments string  // e.g., accounts transferred between
+	Units    float64 // change in units held
+	Amount   float64 // cash received, negative if paid
+	Held     float64 // units held after
+	Cost     float64 // cost basis after
+	AvgCost  float64 // cost per unit after, 0 if none held
+	Realized float64 // gain realized by this event
+	Price    float64 // price on the date, adjusted for splits since
+	PriceAt  PriceAt // price used, before adjusting, and its date
+	Value    float64 // market value after, at the price
+}
+
+// Get the history of one of a user's stocks: each transaction, transfer,
+// corporate action and dividend in date order (dividends after the other
+// events on the same date), with the position after it, valued using a
+// price policy
+func getStockLedger(uid, sid int, policy PricePolicy) []LedgerEntry {
+
+	// Position before and after each event, and value at the price on the
+	// date (adjusted for any splits since the price)
+	positions := map[int]*Position{}
+	pos := positionFor(positions)
+	prices := adjustedSeries(uid, sid)
+	actions := getActions(uid, sid)
+	ledger := []LedgerEntry{}
+	add := func(e LedgerEntry, units, realized float64) {
+		p := pos(sid)
+		e.Held, e.Cost = p.Units(), p.Cost()
+		e.Units = e.Held - units
+		e.Realized = p.Realized - realized
+		if e.Held > 0 {
+			e.AvgCost = e.Cost / e.Held
+		}
+		price := priceOn(prices, e.Date, policy)
+		e.Price = price.Price * splitFactor(actions, sid, e.Date)
+		e.PriceAt = price
+		e.Value = e.Held * e.Price
+		ledger = append(ledger, e)
+	}
+
+	// Dividends are added before the first event on a later date
+	dividends := getDividends(uid, sid)
+	addDividends := func(before *time.Time) {
+		for len(dividends) > 0 && (before == nil ||
+			(dividends[0].Date.Before(*before) && !sameDate(dividends[0].Date, *before))) {
+			d := dividends[0]
+			add(LedgerEntry{Date: d.Date, Type: "Dividend", Comments: d.Comments,
+				Amount: d.Amount}, pos(sid).Units(), pos(sid).Realized)
+			dividends = dividends[1:]
+		}
+	}
+
+	// Apply all events, as one stock may affect another
+	for _, ev := range getPositionEvents(uid) {
+		e := LedgerEntry{Date: ev.date}
+		switch {
+		case ev.trans != nil && ev.trans.Stock == sid:
+			e.Type, e.Comments, e.Amount = "Sell", ev.trans.Comments, ev.trans.Amount
+			if ev.trans.Q > 0 {
+				e.Type, e.Amount = "Buy", -ev.trans.Amount
+			}
+		case ev.transfer != nil && ev.transfer.Stock == sid:
+			e.Type = "Transfer"
+			e.Comments = accountName(ev.transfer.From) + " to " + accountName(ev.transfer.To)
+		case ev.action != nil && (ev.action.Stock == sid || ev.action.NewStock == sid):
+			a := ev.action
+			e.Type, e.Comments = a.Type, a.Comments
+			if a.Type == ActionSpinOff && a.NewStock == sid {
+				e.Amount = a.Cash
+			} else if a.Type != ActionSpinOff && a.Stock == sid {
+				e.Amount = a.Cash
+			}
+		default:
+			ev.apply(pos)
+			continue
+		}
+		addDividends(&ev.date)
+		units, realized := pos(sid).Units(), pos(sid).Realized
+		ev.apply(pos)
+		add(e, units, realized)
+	}
+	addDividends(nil)
+	return ledger
+}
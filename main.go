@@ -2,31 +2,90 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"text/template"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // Default menu
-var menu = []string{"Portfolio", "Stocks", "Cash", "Currencies"}
+var menu = []string{"Portfolio", "Stocks", "Allocation", "Performance", "Risk", "Rebalance", "Cash", "Income", "Currencies", "Sharing"}
 
 // List of currency codes (TODO: in database)
 var currencies = []string{"EUR", "USD", "CHF", "GBP", "NZD", "AUD"}
 
+// A type of cash transaction entered by the user. Amounts are entered as
+// positive, and stored multiplied by the sign. Category is used to report
+// totals, e.g., to see the cost of holding an account.
+type CashType struct {
+	Name     string
+	Sign     float64
+	Category string
+}
+
 // List of cash transaction types
-var cashTypes = []string{"Deposit", "Withdrawal"}
+var cashTypes = []CashType{
+	{"Deposit", 1, "Deposits"},
+	{"Withdrawal", -1, "Withdrawals"},
+	{"Interest", 1, "Interest"},
+	{"Fee", -1, "Fees"},
+	{"Tax", -1, "Taxes"},
+	{"Tax refund", 1, "Taxes"},
+	{"Transfer", -1, "Transfers"},
+	{"FX conversion", -1, "FX conversions"},
+}
+
+// Categories for reporting cash, including "virtual" cash transactions
+// from buy/sell, dividends and corporate actions, in the order shown
+var cashCategories = []string{"Deposits", "Withdrawals", "Trades", "Dividends",
+	"Interest", "Fees", "Taxes", "Corporate actions", "Transfers", "FX conversions", "Other"}
+
+// Asset classes for stocks
+var assetClasses = []string{"Equity", "Bond", "Fund", "ETF", "Cash-like", "Crypto", "Real estate"}
+
+// A way of grouping stocks in reports, or filtering lists of stocks
+type Grouping struct {
+	Key  string // used in query strings
+	Name string
+}
+
+// List of ways to group stocks, see stockGroups()
+var groupings = []Grouping{
+	{"class", "Asset class"},
+	{"sector", "Sector"},
+	{"region", "Region"},
+	{"currency", "Currency"},
+	{"tag", "Tag"},
+}
 
 // Home currency (TODO: in database)
 var homeCurrency = currencies[0]
 
-// Last date entered on a transaction this session
-var lastTransDate time.Time
-
 func main() {
 
-	// Set the last time entered to now
-	lastTransDate = time.Now()
+	// Bring the database up to date, and add a user from the command line
+	// instead of running the server (data from before there were users
+	// goes to the first one added)
+	migrateDB()
+	if len(os.Args) == 3 && os.Args[1] == "adduser" {
+		addUserCommand(os.Args[2])
+		migrateDB()
+		return
+	}
+
+	// Create pages, set how to value stocks on dates with no price, and
+	// update prices from a provider every day, if one is configured
+	r := newRouter()
+	setPricePolicy()
+	startPriceUpdates()
+
+	// Start server
+	fmt.Println("Running on http://localhost:8080")
+	r.Run() // for different port: ":8222")
+}
+
+// Create the router with all pages
+func newRouter() *gin.Engine {
 
 	// Create router, define custom functions
 	r := gin.Default()
@@ -43,50 +102,106 @@ func main() {
 	r.LoadHTMLGlob("templates/*")
 	r.Static("/static", "./static")
 
+	// Login pages, the only ones that don't require a user (the login form
+	// has its own CSRF token, see showLoginForm)
+	r.GET("/login", showLogin)
+	r.POST("/login", doLogin)
+
+	// All other pages require a login, and those that change data
+	// require the user to be viewing their own portfolio. Data can
+	// only be changed with POST or DELETE requests, which must carry
+	// the session's CSRF token.
+	auth := r.Group("/", authRequired, csrfRequired)
+	edit := auth.Group("/", editRequired)
+
 	// Route for home page with portfolio
-	r.GET("/", showPortfolio)
-	r.GET("/Portfolio", showPortfolio)
+	auth.GET("/", showPortfolio)
+	auth.GET("/Portfolio", showPortfolio)
 
 	// Routes for stocks
-	r.GET("/Home", showStocks)
-	r.GET("/Stocks", showStocks)
-	r.GET("/stock/:id", showStock)
-	r.GET("/edit_stock/:id", editStock)
-	r.POST("/update_stock", saveStock)
-	r.GET("/split_stock/:id", splitStock)
-	r.POST("/do_split", doSplit)
-	r.GET("/delete_stock/:id", delStock)
+	auth.GET("/Home", showStocks)
+	auth.GET("/Stocks", showStocks)
+	auth.GET("/stock/:id", showStock)
+	edit.GET("/edit_stock/:id", editStock)
+	edit.POST("/update_stock", saveStock)
+	edit.GET("/delete_stock/:id", delStock)
+	edit.POST("/delete_stock/:id", doDeleteStock)
+	edit.DELETE("/stock/:id", doDeleteStock)
 
 	// Routes for stock prices
-	r.GET("/edit_price/:pid", editPrice)
-	r.POST("/update_price", updatePrice)
-	r.GET("/get_prices/:sid", getPricesJSON)
+	edit.GET("/edit_price/:pid", editPrice)
+	edit.POST("/update_price", updatePrice)
+	auth.GET("/get_prices/:sid", getPricesJSON)
+	auth.GET("/quality", showQuality)
+	auth.GET("/price_updates", showPriceUpdates)
+	edit.POST("/update_prices", doUpdatePrices)
 
 	// Routes for buy/sell transactions
-	r.GET("/edit_transaction/:tid", editTransaction)
-	r.POST("/update_transaction", saveTransaction)
+	edit.GET("/edit_transaction/:tid", editTransaction)
+	edit.POST("/update_transaction", saveTransaction)
+
+	// Routes for corporate actions (splits, spin-offs, mergers, code changes)
+	edit.GET("/edit_action/:aid", editAction)
+	edit.POST("/update_action", saveAction)
+	edit.POST("/delete_action/:aid", doDeleteAction)
+
+	// Routes for transfers of stocks between accounts
+	edit.GET("/edit_transfer/:tid", editTransfer)
+	edit.POST("/update_transfer", saveTransfer)
+	edit.POST("/delete_transfer/:tid", doDeleteTransfer)
 
 	// Routes for dividends
-	r.GET("/edit_dividend/:did", editDividend)
-	r.POST("/update_dividend", saveDividend)
+	edit.GET("/edit_dividend/:did", editDividend)
+	edit.POST("/update_dividend", saveDividend)
+
+	// Allocation report
+	auth.GET("/Allocation", showAllocation)
+
+	// Performance compared with a benchmark, between two dates, and risk
+	auth.GET("/Performance", showPerformance)
+	auth.GET("/comparison", showComparison)
+	auth.GET("/Risk", showRisk)
+	auth.GET("/correlation", showCorrelation)
+	auth.GET("/correlation.csv", downloadCorrelation)
+
+	// Target allocations and rebalancing
+	auth.GET("/Rebalance", showRebalance)
+	edit.POST("/update_targets", saveTargets)
+	edit.POST("/rebalance_drafts", saveRebalanceDrafts)
+	edit.POST("/delete_drafts", doDeleteDrafts)
+
+	// Dividend income report and forecast
+	auth.GET("/Income", showIncome)
+	auth.GET("/forecast", showForecast)
 
 	// Cash pages
-	r.GET("/Cash", showCashPage)
-	r.GET("/cash/:id", showCash)
-	r.GET("/edit_cash/:id", editCash)
-	r.POST("/update_cash", saveCash)
-	r.GET("/delete_cash/:id", delCash)
+	auth.GET("/Cash", showCashPage)
+	auth.GET("/cash/:id", showCash)
+	auth.GET("/cash_summary", showCashSummary)
+	edit.GET("/edit_cash/:id", editCash)
+	edit.POST("/update_cash", saveCash)
+	edit.GET("/delete_cash/:id", delCash)
+	edit.POST("/delete_cash/:id", doDeleteCash)
+	edit.DELETE("/cash/:id", doDeleteCash)
 
 	// Routes for currencies and rates
-	r.GET("/Currencies", showCurrencies)
-	r.GET("/currency/:id", showCurrency)
-	r.GET("/edit_currency/:id", editCurrency)
-	r.POST("/update_currency", saveCurrency)
-	r.GET("/delete_currency/:id", delCurrency)
-	r.GET("/edit_rate/:rid", editRate)
-	r.POST("/update_rate", updateRate)
-
-	// Start server
-	fmt.Println("Running on http://localhost:8080")
-	r.Run() // for different port: ":8222")
+	auth.GET("/Currencies", showCurrencies)
+	auth.GET("/currency/:id", showCurrency)
+	edit.GET("/edit_currency/:id", editCurrency)
+	edit.POST("/update_currency", saveCurrency)
+	edit.GET("/delete_currency/:id", delCurrency)
+	edit.POST("/delete_currency/:id", doDeleteCurrency)
+	edit.DELETE("/currency/:id", doDeleteCurrency)
+	edit.GET("/edit_rate/:rid", editRate)
+	edit.POST("/update_rate", updateRate)
+	edit.GET("/import_rates", showImportRates)
+	edit.POST("/import_rates", doImportRates)
+
+	// Sharing portfolios with other users
+	auth.GET("/Sharing", showSharing)
+	auth.POST("/view", viewPortfolio)
+	auth.POST("/add_share", saveShare)
+	auth.POST("/delete_share/:uid", delShare)
+	auth.POST("/logout", doLogout)
+	return r
 }
@@ -3,9 +3,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
-	//"time"
+	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 // Test date parsing and formatting
@@ -40,8 +50,9 @@ func TestDateInterpolation(t *testing.T) {
 	}
 
 	// Test prices on exact dates in time series
+	interpolate := PricePolicy{Method: PriceInterpolate}
 	for i := 0; i < len(ts); i++ {
-		p := priceOn(ts, ts[i].d)
+		p := priceOn(ts, ts[i].d, interpolate).Price
 		if p != ts[i].p {
 			t.Errorf("Invalid price %f on %s", p, ts[i].d)
 		}
@@ -54,10 +65,1292 @@ func TestDateInterpolation(t *testing.T) {
 	expected := []float64{100, 100, 200, 200, 105}
 	for i := 0; i < len(dd); i++ {
 		d := parseDate(dd[i])
-		p := priceOn(ts, d)
+		p := priceOn(ts, d, interpolate).Price
 		if p != expected[i] {
 			t.Errorf("Invalid price %f on %s", p, dd[i])
 		}
 	}
 
+	// Test other policies, and the dates of the prices used
+	policies := []PricePolicy{{PriceLast, 0}, {PriceStrict, 7}, {PriceStrict, 7},
+		{PriceStrict, 7}, {PriceInterpolate, 0}}
+	dd = []string{"2024-01-02", "2024-01-10", "2024-02-10", "2023-12-31", "2024-01-02"}
+	expectedAt := []PriceAt{
+		{100, parseDate("2024-01-01"), false, true},
+		{110, parseDate("2024-01-03"), false, true},
+		{0, parseDate("2024-01-31"), false, false},
+		{0, parseDate("2024-01-01"), false, false},
+		{105, parseDate("2024-01-01"), true, true},
+	}
+	for i, policy := range policies {
+		pa := priceOn(ts, parseDate(dd[i]), policy)
+		if pa != expectedAt[i] {
+			t.Errorf("Invalid price %v on %s with %v", pa, dd[i], policy)
+		}
+	}
+}
+
+// Test applying corporate actions to lots
+func TestCorporateActions(t *testing.T) {
+
+	// Positions, created when first needed
+	positions := map[int]*Position{}
+	pos := func(sid int) *Position {
+		if _, ok := positions[sid]; !ok {
+			positions[sid] = &Position{Stock: sid}
+		}
+		return positions[sid]
+	}
+
+	// Two lots of stock 1: 10 units for 1000, 5 units for 600
+	d1, d2 := parseDate("2020-01-01"), parseDate("2021-01-01")
+	pos(1).buy("", d1, 10, 1000)
+	pos(1).buy("", d2, 5, 600)
+
+	// Reverse split 1 for 2 leaves 7.5 units, 0.5 sold for 40 cash
+	// in lieu, taken from the oldest lot at cost 0.5 / 5 * 1000 = 100
+	applyAction(&Action{Stock: 1, Type: ActionSplit, RatioOld: 2, RatioNew: 1, Cash: 40}, pos)
+	if u := pos(1).Units(); u != 7 {
+		t.Errorf("Units after reverse split: %f", u)
+	}
+	if c := pos(1).Cost(); c != 1500 {
+		t.Errorf("Cost after reverse split: %f", c)
+	}
+	if r := pos(1).Realized; r != -60 {
+		t.Errorf("Realized cash in lieu: %f", r)
+	}
+
+	// Spin-off of 3 units of stock 2 per unit, with 20% of cost,
+	// keeping original dates
+	applyAction(&Action{Stock: 1, Type: ActionSpinOff, RatioOld: 1, RatioNew: 3,
+		NewStock: 2, CostFraction: 0.2}, pos)
+	if u, c := pos(2).Units(), pos(2).Cost(); u != 21 || c != 300 {
+		t.Errorf("Spin-off units %f, cost %f", u, c)
+	}
+	if c := pos(1).Cost(); c != 1200 {
+		t.Errorf("Cost after spin-off: %f", c)
+	}
+	if !pos(2).Lots[0].Date.Equal(d1) {
+		t.Errorf("Spin-off lot date %s", pos(2).Lots[0].Date)
+	}
+
+	// Merger of stock 2 into stock 3, 2 for 1 plus 50 cash, with 80% of
+	// cost carried over: realized 50 - 300 * 0.2 = -10
+	applyAction(&Action{Stock: 2, Type: ActionMerger, RatioOld: 2, RatioNew: 1,
+		NewStock: 3, CostFraction: 0.8, Cash: 50}, pos)
+	if u, c := pos(3).Units(), pos(3).Cost(); u != 10.5 || c != 240 {
+		t.Errorf("Merger units %f, cost %f", u, c)
+	}
+	if u, r := pos(2).Units(), pos(2).Realized; u != 0 || r != -10 {
+		t.Errorf("Merged stock units %f, realized %f", u, r)
+	}
+}
+
+// Test deriving dividend amounts from those entered
+func TestCompleteDividend(t *testing.T) {
+
+	// Foreign stock: per share, withholding and home amount entered
+	d := Dividend{PerShare: 0.5, Withholding: 7.5, Amount: 38.25}
+	completeDividend(&d, 100, false)
+	if d.Gross != 50 || d.Net != 42.5 || d.FxRate != 0.9 {
+		t.Errorf("Foreign dividend: %+v", d)
+	}
+
+	// Home stock: only gross entered
+	d = Dividend{Gross: 20}
+	completeDividend(&d, 40, true)
+	if d.PerShare != 0.5 || d.Net != 20 || d.FxRate != 1 || d.Amount != 20 {
+		t.Errorf("Home dividend: %+v", d)
+	}
+
+	// Old style: only home currency amount entered
+	d = Dividend{Amount: 12}
+	completeDividend(&d, 10, false)
+	if d.FxRate != 1 || d.Gross != 0 || d.GrossHome() != 12 {
+		t.Errorf("Amount only dividend: %+v", d)
+	}
+}
+
+// Test every cash type has a sign and a category that is reported
+func TestCashTypes(t *testing.T) {
+	for _, ct := range cashTypes {
+		if ct.Sign != 1 && ct.Sign != -1 {
+			t.Errorf("Cash type %s has sign %f", ct.Name, ct.Sign)
+		}
+		if cashCategory(ct.Name) != ct.Category || !slices.Contains(cashCategories, ct.Category) {
+			t.Errorf("Cash type %s has unreported category %s", ct.Name, ct.Category)
+		}
+	}
+	for _, tt := range []string{"Buy", "Sell", "Dividends", "Corporate action", "Unknown"} {
+		if !slices.Contains(cashCategories, cashCategory(tt)) {
+			t.Errorf("Cash type %s has unreported category", tt)
+		}
+	}
+}
+
+// Test cash totals per year, account and category, with the cost of
+// holding each account, and both legs of transfers and FX conversions
+func TestCashSummary(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	addTestRate(uid, "USD", "2023-01-01", 0.9)
+	for _, c := range []Cash{
+		{Date: parseDate("2023-01-02"), Type: "Deposit", Amount: 1000},
+		{Date: parseDate("2023-03-01"), Type: "Interest", Amount: 10},
+		{Date: parseDate("2023-03-01"), Type: "Fee", Amount: -5},
+		{Date: parseDate("2023-04-01"), Type: "Transfer", Amount: -200, Account2: "B"},
+		{Date: parseDate("2023-05-01"), Type: "Tax", Account: "B", Amount: -3},
+		{Date: parseDate("2024-02-01"), Type: "Interest", Account: "B", Currency: "USD", Amount: 20},
+		{Date: parseDate("2024-02-01"), Type: "Fee", Account: "B", Amount: -2},
+		{Date: parseDate("2024-03-01"), Type: "Tax refund", Amount: 4},
+		{Date: parseDate("2024-04-01"), Type: "FX conversion", Amount: -90, Currency2: "USD", Amount2: 100},
+	} {
+		addUpdateCash(uid, &c)
+	}
+
+	// Latest year first, then by account
+	want := []CashSummary{
+		{2024, "", map[string]float64{"Taxes": 4, "FX conversions": 0}, 4},
+		{2024, "B", map[string]float64{"Interest": 18, "Fees": -2}, 16},
+		{2023, "", map[string]float64{"Deposits": 1000, "Interest": 10, "Fees": -5, "Transfers": -200}, 5},
+		{2023, "B", map[string]float64{"Taxes": -3, "Transfers": 200}, -3},
+	}
+	summary := getCashSummary(uid, parseDate("2024-12-31"))
+	if len(summary) != len(want) {
+		t.Fatalf("Cash summary: %+v", summary)
+	}
+	for i, s := range summary {
+		w := want[i]
+		ok := s.Year == w.Year && s.Account == w.Account && len(s.Totals) == len(w.Totals) &&
+			math.Abs(s.Holding-w.Holding) < 1e-9
+		for cat, v := range w.Totals {
+			ok = ok && math.Abs(s.Totals[cat]-v) < 1e-9
+		}
+		if !ok {
+			t.Errorf("Cash summary %d: %+v, want %+v", i, s, w)
+		}
+	}
+
+	// Up to a date
+	if summary := getCashSummary(uid, parseDate("2023-12-31")); len(summary) != 2 {
+		t.Errorf("Cash summary for 2023: %+v", summary)
+	}
+}
+
+// Test moving lots between accounts keeps their dates and cost, and that
+// sales only take lots from the account sold in
+func TestTransferLots(t *testing.T) {
+
+	// Two lots in the main account: 10 units for 1000, 5 units for 600
+	d1, d2 := parseDate("2020-01-01"), parseDate("2021-01-01")
+	p := &Position{Stock: 1}
+	p.buy("", d1, 10, 1000)
+	p.buy("", d2, 5, 600)
+
+	// Move 12 units: all of the first lot, and 2 of the second
+	p.transfer("", "B", 12)
+	accts := p.Accounts()
+	if accts[""] != 3 || accts["B"] != 12 || p.Cost() != 1600 || p.Realized != 0 {
+		t.Errorf("After transfer: %v, cost %f, realized %f", accts, p.Cost(), p.Realized)
+	}
+	if l := p.Lots[0]; l.Account != "B" || !l.Date.Equal(d1) || l.Cost != 1000 {
+		t.Errorf("First lot after transfer: %+v", l)
+	}
+
+	// Selling 11 from B takes the oldest lot there first
+	if c := p.sell("B", 11); c != 1120 {
+		t.Errorf("Cost of units sold from B: %f", c)
+	}
+	if accts := p.Accounts(); accts[""] != 3 || accts["B"] != 1 {
+		t.Errorf("After sale: %v", accts)
+	}
+}
+
+// Test grouping and filtering stocks by classification
+func TestStockGroups(t *testing.T) {
+	s := Stock{Currency: "USD", AssetClass: "ETF", Tags: " core, ,dividend "}
+	if g := stockGroups(&s, "class"); len(g) != 1 || g[0] != "ETF" {
+		t.Errorf("Asset class groups: %v", g)
+	}
+	if g := stockGroups(&s, "sector"); len(g) != 1 || g[0] != unclassified {
+		t.Errorf("Sector groups: %v", g)
+	}
+	if g := stockGroups(&s, "tag"); len(g) != 2 || g[0] != "core" || g[1] != "dividend" {
+		t.Errorf("Tag groups: %v", g)
+	}
+	if sh := groupShares(&s, "tag"); len(sh) != 2 || sh["core"] != 0.5 || sh["dividend"] != 0.5 {
+		t.Errorf("Tag shares: %v", sh)
+	}
+	if sh := groupShares(&s, "class"); len(sh) != 1 || sh["ETF"] != 1 {
+		t.Errorf("Asset class shares: %v", sh)
+	}
+	if !stockMatches(&s, map[string]string{"currency": "USD", "tag": "dividend", "region": ""}) {
+		t.Errorf("Stock should match filter")
+	}
+	if stockMatches(&s, map[string]string{"class": "Bond"}) {
+		t.Errorf("Stock should not match filter")
+	}
+	if !validISIN("US0378331005") || validISIN("US037833100") || validISIN("1S0378331005") {
+		t.Errorf("ISIN validation")
+	}
+}
+
+// Test drift from targets and the trades proposed to rebalance
+func TestRebalance(t *testing.T) {
+
+	// 70 in A at 10, 20 in B at 5, 10 cash: targets 50/40/10
+	holdings := []Holding{
+		{Stock: Stock{Id: 1, Code: "A"}, Units: 7, CurPrice: 10, CurValue: 70},
+		{Stock: Stock{Id: 2, Code: "B"}, Units: 4, CurPrice: 5, CurValue: 20},
+	}
+	targets := []Target{{Group: "A", Weight: 50, Band: 5}, {Group: "B", Weight: 40, Band: 5},
+		{Group: cashGroup, Weight: 10}}
+	drift, trades, cash := rebalance(holdings, 10, targets, "stock", RebalanceOptions{})
+	if len(drift) != 3 || drift[0].Group != "A" || drift[0].Drift != 20 || !drift[0].OutOfBand {
+		t.Errorf("Drift: %+v", drift)
+	}
+
+	// Sell 2 A for 20, buy 4 B for 20, cash unchanged
+	if len(trades) != 2 || trades[0].Stock.Code != "A" || trades[0].Q != -2 ||
+		trades[1].Stock.Code != "B" || trades[1].Q != 4 || cash != 10 {
+		t.Errorf("Trades: %+v, cash %f", trades, cash)
+	}
+
+	// With a fee of 1, buying 20 of B only gets 3 units, and selling
+	// A leaves 20 - 1 = 19; minimum trade of 20 leaves out the purchase
+	_, trades, cash = rebalance(holdings, 10, targets, "stock", RebalanceOptions{Fee: 1, MinTrade: 20})
+	if len(trades) != 1 || trades[0].Amount != 19 || cash != 29 {
+		t.Errorf("Trades with fees: %+v, cash %f", trades, cash)
+	}
+
+	// 40 in A at 1, below its band, and 60 in B, inside its band: no cash
+	// to buy A, then only enough for 5 of the 10 needed
+	holdings = []Holding{
+		{Stock: Stock{Id: 1, Code: "A"}, Units: 40, CurPrice: 1, CurValue: 40},
+		{Stock: Stock{Id: 2, Code: "B"}, Units: 60, CurPrice: 1, CurValue: 60},
+	}
+	targets = []Target{{Group: "A", Weight: 50, Band: 5}, {Group: "B", Weight: 50, Band: 15}}
+	if _, trades, cash = rebalance(holdings, 0, targets, "stock", RebalanceOptions{}); len(trades) != 0 || cash != 0 {
+		t.Errorf("Trades without cash: %+v, cash %f", trades, cash)
+	}
+	_, trades, cash = rebalance(holdings, 0, targets, "stock", RebalanceOptions{AddCash: 5})
+	if len(trades) != 1 || trades[0].Stock.Code != "A" || trades[0].Q != 5 || cash != 0 {
+		t.Errorf("Trades with too little cash: %+v, cash %f", trades, cash)
+	}
+
+	// B has no target, so is not sold, and A is sold down to its target
+	targets = []Target{{Group: "A", Weight: 30, Band: 5}}
+	drift, trades, cash = rebalance(holdings, 0, targets, "stock", RebalanceOptions{})
+	for _, d := range drift {
+		if d.Group == "B" && (d.HasTarget || d.OutOfBand || d.Drift != 0) {
+			t.Errorf("Drift without target: %+v", d)
+		}
+	}
+	if len(trades) != 1 || trades[0].Stock.Code != "A" || trades[0].Q != -10 || cash != 10 {
+		t.Errorf("Trades with a group without target: %+v, cash %f", trades, cash)
+	}
+}
+
+// Test the return index, what-if values against a benchmark, and month ends
+func TestBenchmark(t *testing.T) {
+
+	// 100 invested, grows to 110, 100 more added making 210, falls to 189:
+	// time-weighted return is 10%, 0% then -10%, so -1%
+	d := func(m int) time.Time { return time.Date(2024, time.Month(m), 1, 0, 0, 0, 0, time.UTC) }
+	pts := []ValuePoint{{Date: d(1), Value: 100, Flow: 100}, {Date: d(2), Value: 110},
+		{Date: d(3), Value: 210, Flow: 100}, {Date: d(4), Value: 189}}
+	idx := returnIndex(pts)
+	if math.Abs(idx[3]-99) > 1e-9 {
+		t.Errorf("Return index: %v", idx)
+	}
+
+	// Benchmark at 10, 11, 10, 12: 10 units, then 10 more, worth 240
+	bench := TimeSeries{{d(1), 10}, {d(2), 11}, {d(3), 10}, {d(4), 12}}
+	vv := whatIfValues(pts, bench, PricePolicy{PriceLast, 7})
+	if math.Abs(vv[1]-110) > 1e-9 || math.Abs(vv[3]-240) > 1e-9 {
+		t.Errorf("What if values: %v", vv)
+	}
+
+	// Month ends between two dates, with the dates themselves
+	dd := monthEnds(time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), d(4))
+	if len(dd) != 5 || formatDate(dd[1]) != "2024-01-31" || formatDate(dd[2]) != "2024-02-29" {
+		t.Errorf("Month ends: %v", dd)
+	}
+}
+
+// Test drawdown, volatility, beta and Sortino ratio
+func TestRisk(t *testing.T) {
+
+	// Up 10%, down 50%, up 100%: drawdown from the 110 peak to 55
+	d := func(w int) time.Time { return time.Date(2024, 1, 1+7*w, 0, 0, 0, 0, time.UTC) }
+	dates := []time.Time{d(0), d(1), d(2), d(3)}
+	values := []float64{100, 110, 55, 110}
+	bench := []float64{100, 105, 78.75, 118.125}
+	r := riskMetrics(dates, values, bench, RiskOptions{Weekly: true})
+	if r.Returns != 3 || math.Abs(r.MaxDrawdown+50) > 1e-9 || !r.Peak.Equal(d(1)) || !r.Trough.Equal(d(2)) {
+		t.Errorf("Drawdown: %+v", r)
+	}
+
+	// Mean return 20% a week, variance (0.01 + 0.49 + 0.64) / 2, beta 2 as
+	// returns are twice the benchmark's
+	if math.Abs(r.Return-20*52) > 1e-9 || math.Abs(r.Volatility-100*math.Sqrt(0.57*52)) > 1e-9 ||
+		math.Abs(r.Beta-2) > 1e-9 {
+		t.Errorf("Return, volatility, beta: %+v", r)
+	}
+
+	// Only one return below zero, of -0.5
+	if math.Abs(r.Sortino-0.2/math.Sqrt(0.25/3)/math.Sqrt(52)*52) > 1e-9 {
+		t.Errorf("Sortino: %+v", r)
+	}
+}
+
+// Test correlation of returns, using the dates both have
+func TestCorrelation(t *testing.T) {
+
+	// Returns that move together, in opposite directions, and a missing one
+	dd := []string{"2024-01-05", "2024-01-12", "2024-01-19", "2024-01-26"}
+	a := series(dd, []float64{0.1, -0.1, 0.2, 0})
+	b := series([]string{dd[0], dd[1], dd[3]}, []float64{0.2, -0.2, 0})
+	c := series(dd, []float64{-0.1, 0.1, -0.2, 0})
+	if r, n := correlation(a, b); math.Abs(r-1) > 1e-9 || n != 3 {
+		t.Errorf("Correlation a, b: %f, %d", r, n)
+	}
+	if r, n := correlation(a, c); math.Abs(r+1) > 1e-9 || n != 4 {
+		t.Errorf("Correlation a, c: %f, %d", r, n)
+	}
+
+	// Not enough returns in common
+	if r, n := correlation(a[:2], c[2:]); !math.IsNaN(r) || n != 0 {
+		t.Errorf("Correlation without common dates: %f, %d", r, n)
+	}
+}
+
+// Test guessing how often a dividend is paid from its dates
+func TestDividendFrequency(t *testing.T) {
+	d := func(y, m, day int) time.Time { return time.Date(y, time.Month(m), day, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		dates   []time.Time
+		perYear int
+	}{
+		{[]time.Time{d(2024, 3, 1)}, 1},
+		{[]time.Time{d(2023, 5, 1), d(2024, 5, 3)}, 1},
+		{[]time.Time{d(2024, 1, 15), d(2024, 4, 12), d(2024, 7, 15), d(2024, 10, 14)}, 4},
+		{[]time.Time{d(2024, 4, 1), d(2024, 10, 1), d(2025, 4, 1)}, 2},
+		{[]time.Time{d(2024, 1, 31), d(2024, 2, 29), d(2024, 3, 28), d(2024, 3, 28)}, 12},
+	}
+	for _, tt := range tests {
+		if n := paymentsPerYear(tt.dates); n != tt.perYear {
+			t.Errorf("Payments per year for %v: %d, expected %d", tt.dates, n, tt.perYear)
+		}
+	}
+}
+
+// Test getting prices from a web service as JSON or CSV
+func TestHTTPProvider(t *testing.T) {
+
+	// Stub server with prices for ABC as JSON and CSV, and no others
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("code") != "ABC" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/csv" {
+			fmt.Fprint(w, "Date,Open,Close\n2024-03-01,9,10.5\n2024-03-04,10,11\n2024-03-05,11,12\n")
+			return
+		}
+		fmt.Fprint(w, `[{"date": "2024-03-01", "price": 10.5}, {"Date": "2024-03-04", "Price": "11"}]`)
+	}))
+	defer srv.Close()
+
+	// Both formats, only prices between the dates
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	for _, format := range []string{"json", "csv"} {
+		p := &HTTPProvider{URL: srv.URL + "/" + format + "?code={code}&from={from}&to={to}", Format: format}
+		qq, err := p.Quotes([]string{"ABC"}, from, to)
+		if err != nil || len(qq) != 2 || qq[0].Price != 10.5 || qq[1].Price != 11 ||
+			formatDate(qq[1].Date) != "2024-03-04" {
+			t.Errorf("Quotes %s: %+v, %v", format, qq, err)
+		}
+	}
+
+	// Failure for one code doesn't stop the others
+	p := &HTTPProvider{URL: srv.URL + "/json?code={code}"}
+	qq, err := p.Quotes([]string{"XYZ", "ABC"}, from, to)
+	var qe *QuoteError
+	if len(qq) != 2 || !errors.As(err, &qe) || qe.Code != "XYZ" || len(unjoin(err)) != 1 {
+		t.Errorf("Quotes with failure: %+v, %v", qq, err)
+	}
+}
+
+// Test parsing exchange rates from ECB XML and CSV files
+func TestParseRates(t *testing.T) {
+
+	// ECB daily XML, rates per EUR converted to multipliers to EUR
+	xmlData := `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+  <gesmes:subject>Reference rates</gesmes:subject>
+  <Cube>
+    <Cube time="2024-03-04">
+      <Cube currency="USD" rate="1.0850"/>
+      <Cube currency="GBP" rate="0.8560"/>
+    </Cube>
+    <Cube time="2024-03-01">
+      <Cube currency="USD" rate="1.0800"/>
+    </Cube>
+  </Cube>
+</gesmes:Envelope>`
+	rates, err := parseRates([]byte(xmlData), "EUR")
+	if err != nil || len(rates) != 2 || formatDate(rates[0].Date) != "2024-03-01" {
+		t.Fatalf("parseRates XML: %+v, %v", rates, err)
+	}
+	if x, ok := rates[1].homeRate("USD"); !ok || math.Abs(x-1/1.085) > 1e-9 {
+		t.Errorf("homeRate USD: %v, %v", x, ok)
+	}
+	if _, ok := rates[0].homeRate("GBP"); ok {
+		t.Errorf("homeRate GBP should be missing on %s", formatDate(rates[0].Date))
+	}
+
+	// Wide CSV like eurofxref-hist.csv, with N/A and trailing comma
+	csvData := "Date,USD,JPY,\n2024-03-04,1.0850,N/A,\n2024-03-01,1.0800,162.5,\n"
+	rates, err = parseRates([]byte(csvData), "EUR")
+	if err != nil || len(rates) != 2 || len(rates[1].PerBase) != 1 || rates[0].PerBase["JPY"] != 162.5 {
+		t.Errorf("parseRates wide CSV: %+v, %v", rates, err)
+	}
+
+	// Long CSV against USD: cross rate of GBP to EUR
+	csvData = "date,currency,rate\n2024-03-04,EUR,0.9217\n2024-03-04,GBP,0.7889\n"
+	rates, err = parseRates([]byte(csvData), "USD")
+	if err != nil || len(rates) != 1 {
+		t.Fatalf("parseRates long CSV: %+v, %v", rates, err)
+	}
+	if x, ok := rates[0].homeRate("GBP"); !ok || math.Abs(x-0.9217/0.7889) > 1e-9 {
+		t.Errorf("homeRate GBP: %v, %v", x, ok)
+	}
+	if x, ok := rates[0].homeRate("USD"); !ok || math.Abs(x-0.9217) > 1e-9 {
+		t.Errorf("homeRate USD: %v, %v", x, ok)
+	}
+
+	// Errors
+	if _, err := parseRates([]byte("date,USD\n2024-03-04,abc\n"), "EUR"); err == nil {
+		t.Error("parseRates should fail on invalid rate")
+	}
+	if _, err := parseRates([]byte("day,USD\n"), "EUR"); err == nil {
+		t.Error("parseRates should fail without date column")
+	}
+}
+
+// Test comparing inferred exchange rates with stored ones
+func TestCompareRates(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	stored := []Rate{{Id: 2, Date: day(4), Rate: 0.92}, {Id: 1, Date: day(1), Rate: 0.90}}
+	inferred := []InferredRate{{day(1), 0.905, 1}, {day(2), 0.95, 2}, {day(4), 0.92, 1}}
+
+	// Rows for each date, latest first, inferred compared with latest stored
+	cc := compareRates(stored, inferred)
+	if len(cc) != 3 || !sameDate(cc[0].Date, day(4)) || !sameDate(cc[2].Date, day(1)) {
+		t.Fatalf("compareRates: %+v", cc)
+	}
+	if cc[0].Stored == nil || cc[0].Inferred == nil || cc[0].Diff != 0 || cc[0].Disagree {
+		t.Errorf("compareRates same rate: %+v", cc[0])
+	}
+	if cc[1].Stored != nil || math.Abs(cc[1].Diff-(0.95/0.90-1)*100) > 1e-9 || !cc[1].Disagree {
+		t.Errorf("compareRates inferred only: %+v", cc[1])
+	}
+	if cc[2].Disagree || math.Abs(cc[2].Diff-(0.905/0.90-1)*100) > 1e-9 {
+		t.Errorf("compareRates small difference: %+v", cc[2])
+	}
+}
+
+// Use a new, empty database for a test, in place of the real one
+func testDB(t *testing.T) {
+	old := dbFile
+	dbFile = filepath.Join(t.TempDir(), "data.db")
+	t.Cleanup(func() { dbFile = old })
+	migrateDB()
+}
+
+// Add a user to the test database, returning their ID
+func addTestUser(name string) int {
+	addUpdateUser(&User{Name: name, PwHash: hashPassword("pw")})
+	return getUserByName(name).Id
+}
+
+// Add a stock for a user, returning its ID
+func addTestStock(uid int, s Stock) int {
+	addUpdateStock(uid, &s)
+	for _, x := range getStocks(uid) {
+		if x.Code == s.Code {
+			return x.Id
+		}
+	}
+	return 0
+}
+
+// Test prices adjusted for splits after them, but not on the same date
+func TestSplitAdjusted(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	sid := addTestStock(uid, Stock{Code: "S", Name: "S", Currency: "EUR"})
+	for _, p := range []Price{{Date: parseDate("2024-01-02"), Price: 120},
+		{Date: parseDate("2024-02-01"), Price: 50}, {Date: parseDate("2024-03-01"), Price: 55},
+		{Date: parseDate("2024-04-01"), Price: 20}} {
+		p.Stock, p.PriceX = sid, p.Price
+		addUpdatePrice(uid, &p)
+	}
+
+	// Splits of 2 for 1 and 3 for 1, and another stock's split
+	addUpdateAction(uid, &Action{Stock: sid, Date: parseDate("2024-02-01"), Type: ActionSplit,
+		RatioOld: 1, RatioNew: 2})
+	addUpdateAction(uid, &Action{Stock: sid, Date: parseDate("2024-04-01"), Type: ActionSplit,
+		RatioOld: 1, RatioNew: 3})
+	actions := append(getActions(uid, sid), Action{Stock: sid + 1, Date: parseDate("2024-05-01"),
+		Type: ActionSplit, RatioOld: 1, RatioNew: 10})
+	for ds, want := range map[string]float64{"2024-01-31": 6, "2024-02-01": 3, "2024-03-31": 3,
+		"2024-04-01": 1, "2024-06-01": 1} {
+		if f := splitFactor(actions, sid, parseDate(ds)); f != want {
+			t.Errorf("Split factor on %s: %f, want %f", ds, f, want)
+		}
+	}
+
+	// Adjusted prices, in date order
+	want := []float64{20, 50.0 / 3, 55.0 / 3, 20}
+	pp := getAdjustedPrices(uid, sid)
+	if len(pp) != len(want) {
+		t.Fatalf("Adjusted prices: %+v", pp)
+	}
+	for i, p := range pp {
+		if math.Abs(p.Price-want[i]) > 1e-9 || p.PriceX != p.Price {
+			t.Errorf("Adjusted price on %s: %f, %f, want %f", formatDate(p.Date), p.Price,
+				p.PriceX, want[i])
+		}
+	}
+}
+
+// Test that splits recorded the old way, as a transaction with no amount
+// and a price worked out from the one before, become split actions
+func TestMigrateSplits(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	sid := addTestStock(uid, Stock{Code: "S", Name: "S"})
+	addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate("2024-01-02"), Q: 10, Amount: 1000})
+	addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate("2024-01-02"), Price: 100})
+	addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate("2024-02-01"), Q: 10,
+		Comments: "2024-02-01: 10.000 split to 20.000 => delta 10.000\n"})
+	addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate("2024-02-01"), Price: 50,
+		Comments: "10.000 split on 2024-02-01 to 20.000 : price 100.000 => 50.000"})
+	migrateDB()
+
+	// A split action instead of the transaction and price
+	aa := getActions(uid, sid)
+	if len(aa) != 1 || aa[0].Type != ActionSplit || aa[0].Ratio() != 2 || formatDate(aa[0].Date) != "2024-02-01" {
+		t.Errorf("Actions: %+v", aa)
+	}
+	if n, m := len(getTransactions(uid, sid)), len(getPrices(uid, sid)); n != 1 || m != 1 {
+		t.Errorf("%d transactions and %d prices left", n, m)
+	}
+
+	// Units and value counted once, and migrating again changes nothing
+	d := parseDate("2024-03-01")
+	migrateDB()
+	if u := unitsHeld(uid, sid, d); u != 20 || len(getActions(uid, sid)) != 1 {
+		t.Errorf("Units after split: %f", u)
+	}
+	if p := stockValue(uid, sid, d, PricePolicy{PriceLast, 0}); p.Price != 50 {
+		t.Errorf("Price after split: %+v", p)
+	}
+}
+
+// Add an exchange rate for a user, and the currency if it's new
+func addTestRate(uid int, code, ds string, rate float64) {
+	cur := getCurrencyCode(uid, code)
+	if cur == nil {
+		addUpdateCurrency(uid, &Currency{Code: code, Name: code})
+		cur = getCurrencyCode(uid, code)
+	}
+	addUpdateRate(uid, &Rate{Date: parseDate(ds), Currency: cur.Id, Rate: rate})
+}
+
+// Test cash balances in each currency, including an FX conversion and a
+// purchase settled in a foreign currency
+func TestCashBalances(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	addTestRate(uid, "USD", "2024-01-01", 0.9)
+	sid := addTestStock(uid, Stock{Code: "S", Name: "S", Currency: "USD"})
+	for _, c := range []Cash{
+		{Date: parseDate("2024-01-02"), Type: "Deposit", Amount: 1000},
+		{Date: parseDate("2024-01-02"), Type: "Deposit", Currency: "USD", Amount: 500},
+		{Date: parseDate("2024-01-03"), Type: "FX conversion", Amount: -200, Currency2: "USD", Amount2: 220},
+		{Date: parseDate("2024-03-01"), Type: "Deposit", Amount: 5000},
+	} {
+		addUpdateCash(uid, &c)
+	}
+	addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate("2024-01-04"), Q: 1,
+		Amount: 90, AmountX: 100, Currency: "USD"})
+
+	// Home currency first, leaving out the later deposit
+	bb := cashBalances(uid, parseDate("2024-02-01"), newRates(uid))
+	want := []CashBalance{{"EUR", 800, 1, 800}, {"USD", 620, 0.9, 558}}
+	if len(bb) != len(want) {
+		t.Fatalf("Cash balances: %+v", bb)
+	}
+	for i, b := range bb {
+		w := want[i]
+		if b.Currency != w.Currency || math.Abs(b.Amount-w.Amount) > 1e-9 || b.Rate != w.Rate ||
+			math.Abs(b.Value-w.Value) > 1e-9 {
+			t.Errorf("Cash balance: %+v, want %+v", b, w)
+		}
+	}
+
+	// No USD balance before the deposit
+	if bb := cashBalances(uid, parseDate("2024-01-01"), newRates(uid)); len(bb) != 1 || bb[0].Amount != 0 {
+		t.Errorf("Cash balances before deposits: %+v", bb)
+	}
+}
+
+// Test allocation by class, tag and account, with cash in its own group
+// except by account
+func TestAllocation(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	a := addTestStock(uid, Stock{Code: "A", Name: "A", Currency: "EUR", AssetClass: "Equity",
+		Tags: "Tech, Europe"})
+	b := addTestStock(uid, Stock{Code: "B", Name: "B", Currency: "EUR", AssetClass: "Bond"})
+	d0 := parseDate("2024-01-02")
+	for _, p := range []Price{{Stock: a, Price: 100, PriceX: 100}, {Stock: b, Price: 60, PriceX: 60}} {
+		p.Date = d0
+		addUpdatePrice(uid, &p)
+	}
+	addUpdateCash(uid, &Cash{Date: d0, Type: "Deposit", Amount: 1500})
+	addUpdateCash(uid, &Cash{Date: d0, Type: "Deposit", Account: "Broker", Amount: 400})
+	for _, tr := range []Transaction{{Stock: a, Q: 6, Amount: 600}, {Stock: a, Q: 4, Amount: 400,
+		Account: "Broker"}, {Stock: b, Q: 5, Amount: 300}} {
+		tr.Date = d0
+		addUpdateTransaction(uid, &tr)
+	}
+
+	// Groups, largest first, and percentages
+	d := parseDate("2024-02-01")
+	for _, tt := range []struct {
+		by     string
+		groups []string
+		values []float64
+	}{
+		{"class", []string{"Equity", "Cash", "Bond"}, []float64{1000, 600, 300}},
+		{"tag", []string{"Cash", "Europe", "Tech", unclassified}, []float64{600, 500, 500, 300}},
+		{"account", []string{"Main", "Broker"}, []float64{1500, 400}},
+	} {
+		alloc := getAllocation(uid, d, tt.by)
+		ok := len(alloc) == len(tt.groups)
+		for i := 0; ok && i < len(alloc); i++ {
+			ok = alloc[i].Group == tt.groups[i] && math.Abs(alloc[i].Value-tt.values[i]) < 1e-9 &&
+				math.Abs(alloc[i].Percent-tt.values[i]/19) < 1e-9
+		}
+		if !ok {
+			t.Errorf("Allocation by %s: %+v", tt.by, alloc)
+		}
+	}
+}
+
+// Test the date and price policy a page is shown as of, and links to the
+// days before and after
+func TestAsOf(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	asOf := func(url string) AsOf {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", url, nil)
+		return getAsOf(c)
+	}
+
+	// Date in the past, keeping other parameters in the links
+	a := asOf("/Stocks?date=2024-01-15&class=Bond&policy=strict&days=3")
+	if a.Today || formatDate(a.Date) != "2024-01-15" || a.Policy != (PricePolicy{PriceStrict, 3}) {
+		t.Errorf("As of date in the past: %+v", a)
+	}
+	if len(a.Hidden) != 1 || a.Hidden["class"] != "Bond" {
+		t.Errorf("Hidden parameters: %v", a.Hidden)
+	}
+	if a.Prev != "/Stocks?class=Bond&date=2024-01-14&days=3&policy=strict" ||
+		a.Next != "/Stocks?class=Bond&date=2024-01-16&days=3&policy=strict" ||
+		a.Now != "/Stocks?class=Bond&days=3&policy=strict" {
+		t.Errorf("Links: %s, %s, %s", a.Prev, a.Next, a.Now)
+	}
+
+	// Today if the date is in the future, today or invalid
+	now := today()
+	yesterday := now.AddDate(0, 0, -1)
+	for _, ds := range []string{"2999-01-01", formatDate(now), "2024-13-45", ""} {
+		if a := asOf("/Portfolio?date=" + ds); !a.Today || !sameDate(a.Date, now) || a.Now != "/Portfolio" ||
+			a.Prev != template.URL("/Portfolio?date="+formatDate(yesterday)) {
+			t.Errorf("As of %q: %+v", ds, a)
+		}
+	}
+
+	// Day after yesterday is today, without a date
+	if a := asOf("/Portfolio?date=" + formatDate(yesterday)); a.Today || a.Next != "/Portfolio" {
+		t.Errorf("As of yesterday: %+v", a)
+	}
+}
+
+// Test the parts of a holding's gain, from price, dividends and the
+// exchange rate, and its annualized return
+func TestHoldingCard(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	sid := addTestStock(uid, Stock{Code: "S", Name: "S", Currency: "USD"})
+
+	// Bought at 100 USD = 100 EUR, now 120 USD, but the dollar fell 20%
+	addTestRate(uid, "USD", "2023-01-02", 1)
+	addTestRate(uid, "USD", "2023-07-03", 0.9)
+	addTestRate(uid, "USD", "2024-01-02", 0.8)
+	addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate("2023-01-02"), Price: 100, PriceX: 100})
+	addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate("2024-01-02"), Price: 96, PriceX: 120})
+	addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate("2023-01-02"), Q: 10,
+		Amount: 1000})
+	addUpdateDividend(uid, &Dividend{Stock: sid, Date: parseDate("2023-07-03"), Amount: 20})
+
+	// Gain of 10 x 20 USD at the start rate, the dividend, and the loss of
+	// 20% of the value from the rate
+	d := parseDate("2024-01-03")
+	hh := getPortfolio(uid, d, true)
+	if len(hh) != 1 || hh[0].CurValue != 960 {
+		t.Fatalf("Holdings: %+v", hh)
+	}
+	card := getHoldingCard(uid, hh[0], d, newRates(uid))
+	for _, x := range []struct {
+		name      string
+		got, want float64
+	}{{"Gain", card.Gain, -20}, {"Price gain", card.PriceGain, 200},
+		{"Dividend gain", card.DividendGain, 20}, {"Currency gain", card.CurrencyGain, -240}} {
+		if math.Abs(x.got-x.want) > 1e-9 {
+			t.Errorf("%s: %f, want %f", x.name, x.got, x.want)
+		}
+	}
+
+	// Annualized, as held over a year: the rate at which the flows grow
+	// to the value
+	if !card.Annualize || card.Annualized > 0 || card.Annualized < -5 {
+		t.Errorf("Annualized return: %v, %f", card.Annualize, card.Annualized)
+	}
+	r := card.Annualized / 100
+	fv := 1000*math.Pow(1+r, d.Sub(parseDate("2023-01-02")).Hours()/24/365.25) -
+		20*math.Pow(1+r, d.Sub(parseDate("2023-07-03")).Hours()/24/365.25)
+	if math.Abs(fv-960) > 1e-3 {
+		t.Errorf("Annualized return %f gives %f", r, fv)
+	}
+	if card := getHoldingCard(uid, hh[0], parseDate("2023-12-01"), newRates(uid)); card.Annualize {
+		t.Error("Annualized return for less than a year")
+	}
+}
+
+// Test money-weighted returns
+func TestAnnualizedReturn(t *testing.T) {
+	d0 := parseDate("2020-01-01")
+	year := func(n float64) time.Time { return d0.Add(time.Duration(n * 365.25 * 24 * float64(time.Hour))) }
+
+	// 10% a year, with and without money taken out
+	if r := annualizedReturn([]valueFlow{{d0, 100}}, year(2), 121); math.Abs(r-0.1) > 1e-6 {
+		t.Errorf("Annualized return: %f", r)
+	}
+	flows := []valueFlow{{d0, 100}, {year(1), -10}}
+	if r := annualizedReturn(flows, year(2), 110); math.Abs(r-0.1) > 1e-6 {
+		t.Errorf("Annualized return with withdrawal: %f", r)
+	}
+
+	// No rate without flows, or if the value can't be reached
+	if r := annualizedReturn(nil, year(1), 100); !math.IsNaN(r) {
+		t.Errorf("Annualized return without flows: %f", r)
+	}
+	if r := annualizedReturn([]valueFlow{{d0, 100}}, year(1), -50); !math.IsNaN(r) {
+		t.Errorf("Annualized return of negative value: %f", r)
+	}
+}
+
+// Test a stock's ledger: events in date order with the position and value
+// after each, prices adjusted for later splits, and dividends after other
+// events on the same date
+func TestStockLedger(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	sid := addTestStock(uid, Stock{Code: "S", Name: "S", Currency: "EUR"})
+	for _, p := range []Price{{Date: parseDate("2024-01-01"), Price: 100},
+		{Date: parseDate("2024-02-01"), Price: 50}, {Date: parseDate("2024-03-01"), Price: 60}} {
+		p.Stock, p.PriceX = sid, p.Price
+		addUpdatePrice(uid, &p)
+	}
+	addUpdateDividend(uid, &Dividend{Stock: sid, Date: parseDate("2024-03-01"), Amount: 10})
+	addUpdateDividend(uid, &Dividend{Stock: sid, Date: parseDate("2024-01-15"), Amount: 5})
+	addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate("2024-03-01"), Q: -5, Amount: 300})
+	addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate("2024-01-02"), Q: 10, Amount: 1000})
+	addUpdateAction(uid, &Action{Stock: sid, Date: parseDate("2024-02-01"), Type: ActionSplit,
+		RatioOld: 1, RatioNew: 2})
+
+	want := []LedgerEntry{
+		{Date: parseDate("2024-01-02"), Type: "Buy", Units: 10, Amount: -1000, Held: 10, Cost: 1000,
+			AvgCost: 100, Price: 100, Value: 1000},
+		{Date: parseDate("2024-01-15"), Type: "Dividend", Amount: 5, Held: 10, Cost: 1000,
+			AvgCost: 100, Price: 100, Value: 1000},
+		{Date: parseDate("2024-02-01"), Type: ActionSplit, Units: 10, Held: 20, Cost: 1000,
+			AvgCost: 50, Price: 50, Value: 1000},
+		{Date: parseDate("2024-03-01"), Type: "Sell", Units: -5, Amount: 300, Held: 15, Cost: 750,
+			AvgCost: 50, Realized: 50, Price: 60, Value: 900},
+		{Date: parseDate("2024-03-01"), Type: "Dividend", Amount: 10, Held: 15, Cost: 750,
+			AvgCost: 50, Price: 60, Value: 900},
+	}
+	ledger := getStockLedger(uid, sid, PricePolicy{PriceLast, 7})
+	if len(ledger) != len(want) {
+		t.Fatalf("Ledger: %+v", ledger)
+	}
+	for i, e := range ledger {
+		w := want[i]
+		e.Comments, e.PriceAt = "", PriceAt{}
+		if !sameDate(e.Date, w.Date) {
+			t.Errorf("Ledger entry %d: %+v, want %+v", i, e, w)
+			continue
+		}
+		e.Date = w.Date
+		if e != w {
+			t.Errorf("Ledger entry %d: %+v, want %+v", i, e, w)
+		}
+	}
+
+	// Price used, before adjusting for the split, and its date
+	if p := ledger[1].PriceAt; p.Price != 50 || formatDate(p.Date) != "2024-01-01" || !p.OK {
+		t.Errorf("Price for dividend: %+v", p)
+	}
+
+	// No price if too old for the policy
+	ledger = getStockLedger(uid, sid, PricePolicy{PriceStrict, 7})
+	if !ledger[0].PriceAt.OK || ledger[1].PriceAt.OK {
+		t.Errorf("Strict prices: %+v, %+v", ledger[0].PriceAt, ledger[1].PriceAt)
+	}
+}
+
+// Test data quality checks: stale prices, price jumps not explained by a
+// split, missing exchange rates, negative units and unpriced transactions
+func TestQualityIssues(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	prices := func(sid int, pp map[string]float64) {
+		for ds, p := range pp {
+			addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate(ds), Price: p, PriceX: p})
+		}
+	}
+	buy := func(sid int, ds string, q float64) {
+		addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate(ds), Q: q,
+			Amount: math.Abs(q) * 10})
+	}
+
+	// A: stale, and doubled; B: in dollars, with no prices or rates;
+	// C: more sold than bought; D: split, so no jump
+	a := addTestStock(uid, Stock{Code: "A", Name: "A", Currency: "EUR"})
+	b := addTestStock(uid, Stock{Code: "B", Name: "B", Currency: "USD"})
+	c := addTestStock(uid, Stock{Code: "C", Name: "C", Currency: "EUR"})
+	d := addTestStock(uid, Stock{Code: "D", Name: "D", Currency: "EUR"})
+	prices(a, map[string]float64{"2024-01-01": 100, "2024-01-10": 200})
+	prices(c, map[string]float64{"2024-01-01": 10, "2024-02-28": 11})
+	prices(d, map[string]float64{"2024-01-01": 100, "2024-02-01": 50, "2024-02-28": 55})
+	addUpdateAction(uid, &Action{Stock: d, Date: parseDate("2024-02-01"), Type: ActionSplit,
+		RatioOld: 1, RatioNew: 2})
+	buy(a, "2024-01-05", 10)
+	buy(b, "2024-02-01", 10)
+	buy(c, "2024-01-05", 5)
+	buy(c, "2024-02-01", -8)
+	buy(d, "2024-01-01", 10)
+
+	got := []string{}
+	for _, is := range getQualityIssues(uid, parseDate("2024-03-01"), QualityOptions{7, 50}) {
+		got = append(got, is.Check+": "+is.Stock.Code+", "+is.Message)
+	}
+	slices.Sort(got)
+	want := []string{
+		CheckMissingRate + ": B, No exchange rates for USD",
+		CheckNegativeUnits + ": C, -3 units in Main account",
+		CheckPriceJump + ": A, +100% from 100.000 on 2024-01-01 to 200.000",
+		CheckStalePrice + ": A, Latest price is 51 days old",
+		CheckStalePrice + ": B, No prices",
+		CheckUnpriced + ": B, 10 units, before first price",
+	}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("Quality issues:\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Nothing stale with a longer limit
+	for _, is := range getQualityIssues(uid, parseDate("2024-03-01"), QualityOptions{60, 50}) {
+		if is.Check == CheckStalePrice && is.Stock.Code == "A" {
+			t.Errorf("Stale price: %+v", is)
+		}
+	}
+}
+
+// Test importing rates: added or updated for each currency, rates that
+// can't be saved reported, and currencies not set up skipped
+func TestImportRates(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	addTestRate(uid, "USD", "2024-03-01", 0.9)
+	addTestRate(uid, "GBP", "2024-01-01", 1.1)
+	rates := []FxRates{
+		{parseDate("2024-03-01"), "EUR", map[string]float64{"USD": 1.08, "GBP": 0.85, "JPY": 160}},
+		{parseDate("2024-03-04"), "EUR", map[string]float64{"USD": 1.085, "GBP": 0.856}},
+	}
+
+	// Saving fails for GBP on the second date
+	db := dbConnect()
+	_, err := db.Exec(`create trigger fail_gbp before insert on currency_rate
+		when new.currency_id = (select id from currency where code = 'GBP') and date(new.rdate) = '2024-03-04'
+		begin select raise(abort, 'disk full'); end`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, skipped := importRates(uid, rates)
+	if len(results) != 2 || len(skipped) != 1 || skipped[0] != "JPY" {
+		t.Fatalf("Import: %+v, skipped %v", results, skipped)
+	}
+	for _, ri := range results {
+		switch ri.Currency.Code {
+		case "USD":
+			if ri.Added != 1 || ri.Updated != 1 || ri.Failed != 0 || formatDate(ri.To) != "2024-03-04" {
+				t.Errorf("USD imported: %+v", ri)
+			}
+		case "GBP":
+			if ri.Added != 1 || ri.Failed != 1 || !strings.Contains(ri.Error, "disk full") ||
+				formatDate(ri.To) != "2024-03-01" {
+				t.Errorf("GBP imported: %+v", ri)
+			}
+		}
+	}
+	if r, _ := newRates(uid).On("USD", parseDate("2024-03-01")); math.Abs(r-1/1.08) > 1e-9 {
+		t.Errorf("USD rate replaced: %f", r)
+	}
+	if n := len(getRates(uid, getCurrencyCode(uid, "GBP").Id)); n != 2 {
+		t.Errorf("GBP rates saved: %d", n)
+	}
+}
+
+// Test changes in value over a period: start plus purchases, less sales,
+// plus price change and the effect of exchange rates add up to the end,
+// for each holding and the total
+func TestPeriodChanges(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	f := addTestStock(uid, Stock{Code: "F", Name: "F", Currency: "USD"})
+	h := addTestStock(uid, Stock{Code: "H", Name: "H", Currency: "EUR"})
+
+	// Dollar at 1, then 0.9, then 0.8 euros; F up from 100 to 120 dollars
+	addTestRate(uid, "USD", "2023-12-29", 1)
+	addTestRate(uid, "USD", "2024-06-03", 0.9)
+	addTestRate(uid, "USD", "2024-12-02", 0.8)
+	for _, p := range []Price{{Stock: f, Date: parseDate("2023-12-29"), Price: 100, PriceX: 100},
+		{Stock: f, Date: parseDate("2024-06-03"), Price: 99, PriceX: 110},
+		{Stock: f, Date: parseDate("2024-12-31"), Price: 96, PriceX: 120},
+		{Stock: h, Date: parseDate("2023-12-29"), Price: 50, PriceX: 50},
+		{Stock: h, Date: parseDate("2024-12-31"), Price: 60, PriceX: 60}} {
+		addUpdatePrice(uid, &p)
+	}
+
+	// 10 of each held at the start, 5 of F bought and 3 sold in the period
+	for _, tr := range []Transaction{{Stock: f, Date: parseDate("2023-06-01"), Q: 10, Amount: 900},
+		{Stock: h, Date: parseDate("2023-06-01"), Q: 10, Amount: 450},
+		{Stock: f, Date: parseDate("2024-06-03"), Q: 5, Amount: 495},
+		{Stock: f, Date: parseDate("2024-09-02"), Q: -3, Amount: 300}} {
+		addUpdateTransaction(uid, &tr)
+	}
+	addUpdateDividend(uid, &Dividend{Stock: f, Date: parseDate("2024-07-01"), Amount: 10})
+
+	changes := getPeriodChanges(uid, parseDate("2024-01-01"), parseDate("2024-12-31"), PricePolicy{PriceLast, 7})
+	if len(changes) != 3 || changes[0].Stock.Code != "F" || changes[1].Stock.Code != "H" {
+		t.Fatalf("Period changes: %+v", changes)
+	}
+	for _, pc := range changes {
+		if sum := pc.Start + pc.Purchases - pc.Sales + pc.PriceChange + pc.FxEffect; math.Abs(sum-pc.End) > 1e-9 {
+			t.Errorf("Changes for %q add up to %f, not %f: %+v", pc.Stock.Code, sum, pc.End, pc)
+		}
+	}
+
+	// F: 12 worth 96 = 1152 at the end. At the start rate, the end value
+	// would be 1440 (-288), the purchase 550 (+55), and the sale 333.33
+	// (-33.33).
+	pc := changes[0]
+	if pc.Start != 1000 || pc.End != 1152 || pc.Purchases != 495 || pc.Sales != 300 || pc.Dividends != 10 {
+		t.Errorf("Values and flows for F: %+v", pc)
+	}
+	if fx := -288 + 55 - 100.0/3; math.Abs(pc.FxEffect-fx) > 1e-9 {
+		t.Errorf("Exchange rate effect for F: %f, want %f", pc.FxEffect, fx)
+	}
+	if pc := changes[1]; pc.FxEffect != 0 || pc.PriceChange != 100 {
+		t.Errorf("Changes for H: %+v", pc)
+	}
+	total := changes[2]
+	if math.Abs(total.FxEffect-changes[0].FxEffect) > 1e-9 || total.End != 1752 || total.Start != 1500 {
+		t.Errorf("Total changes: %+v", total)
+	}
+}
+
+// Test valuing holdings with a price policy: interpolated across a split
+// from split-adjusted prices, and left out under strict if too old
+func TestValueHistory(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	sid := addTestStock(uid, Stock{Code: "S", Name: "S", Currency: "EUR"})
+	addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate("2024-01-01"), Price: 100, PriceX: 100})
+	addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate("2024-03-01"), Price: 60, PriceX: 60})
+	addUpdateAction(uid, &Action{Stock: sid, Date: parseDate("2024-02-01"), Type: ActionSplit,
+		RatioOld: 1, RatioNew: 2})
+	addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate("2024-01-01"), Q: 10, Amount: 1000})
+	addUpdateTransaction(uid, &Transaction{Stock: sid, Date: parseDate("2024-01-16"), Q: 5, Amount: 500})
+
+	// Halfway from 50 to 60 after adjusting, 105 before the split
+	price := stockValue(uid, sid, parseDate("2024-01-31"), PricePolicy{PriceInterpolate, 7})
+	if math.Abs(price.Price-(50+10*30.0/60)*2) > 1e-9 || !price.Interpolated || formatDate(price.Date) != "2024-01-01" {
+		t.Errorf("Interpolated across split: %+v", price)
+	}
+
+	// Last price, with its date
+	dates := []time.Time{parseDate("2024-01-01"), parseDate("2024-03-01")}
+	pts, _ := getValueHistory(uid, dates, PricePolicy{PriceLast, 7}, newRates(uid))
+	if len(pts) != 3 || pts[1].Value != 1500 || formatDate(pts[1].PriceDate) != "2024-01-01" ||
+		pts[1].Missing != 0 || pts[2].Value != 1800 {
+		t.Errorf("Value history: %+v", pts)
+	}
+
+	// Strict leaves out the purchase date, adding its flow to the next
+	pts, _ = getValueHistory(uid, dates, PricePolicy{PriceStrict, 7}, newRates(uid))
+	if len(pts) != 3 || pts[1].Missing != 1 || pts[1].Value != 0 {
+		t.Fatalf("Strict value history: %+v", pts)
+	}
+	pts, missing := pricedPoints(pts, PricePolicy{PriceStrict, 7})
+	if missing != 1 || len(pts) != 2 || pts[0].Flow != 1000 || pts[1].Flow != 500 || pts[1].Value != 1800 {
+		t.Errorf("Priced points: %+v, %d left out", pts, missing)
+	}
+
+	// What if: money held until the benchmark has a recent price
+	bench := TimeSeries{{parseDate("2024-01-01"), 10}, {parseDate("2024-03-01"), 12}}
+	pts = []ValuePoint{{Date: parseDate("2024-01-01"), Value: 100, Flow: 100},
+		{Date: parseDate("2024-02-01"), Value: 200, Flow: 100}, {Date: parseDate("2024-03-01"), Value: 200}}
+	if vv := whatIfValues(pts, bench, PricePolicy{PriceStrict, 7}); vv[1] != 200 || math.Abs(vv[2]-(10+100.0/12)*12) > 1e-9 {
+		t.Errorf("What if values, strict: %v", vv)
+	}
+}
+
+// Test that inferred rates are only used where no rate is stored, if the
+// currency is set to use them, and that the rates say when they are
+func TestInferredRates(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	addTestRate(uid, "USD", "2024-01-01", 0.9)
+	sid := addTestStock(uid, Stock{Code: "S", Name: "S", Currency: "USD"})
+	addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate("2024-01-01"), Price: 91, PriceX: 100})
+	addUpdatePrice(uid, &Price{Stock: sid, Date: parseDate("2024-02-01"), Price: 88, PriceX: 100})
+	d := parseDate("2024-02-15")
+
+	// Not used unless asked for
+	rates := newRates(uid)
+	if r, ok := rates.On("USD", d); !ok || r != 0.9 {
+		t.Errorf("Rate without inferred rates: %f, %v", r, ok)
+	}
+	if inferred, _ := rates.Inferred("USD", d); inferred {
+		t.Error("Stored rate reported as inferred")
+	}
+
+	// Used on dates with no stored rate
+	cur := getCurrencyCode(uid, "USD")
+	cur.Infer = true
+	addUpdateCurrency(uid, cur)
+	rates = newRates(uid)
+	if r, _ := rates.On("USD", d); math.Abs(r-0.88) > 1e-9 {
+		t.Errorf("Rate with inferred rates: %f", r)
+	}
+	if inferred, on := rates.Inferred("USD", d); !inferred || formatDate(on) != "2024-02-01" {
+		t.Errorf("Inferred rate not reported: %v, %s", inferred, formatDate(on))
+	}
+	if r, _ := rates.On("USD", parseDate("2024-01-15")); r != 0.9 {
+		t.Errorf("Stored rate replaced by inferred rate: %f", r)
+	}
+	if inferred, _ := rates.Inferred("USD", parseDate("2024-01-15")); inferred {
+		t.Error("Stored rate reported as inferred, with inferred rates")
+	}
+}
+
+// Test income per stock and per tag, with a stock with two tags split
+// equally between them, so the groups add up to the total
+func TestIncome(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	a := addTestStock(uid, Stock{Code: "A", Name: "A", Tags: "core, dividend"})
+	b := addTestStock(uid, Stock{Code: "B", Name: "B", Tags: "core"})
+	addUpdateDividend(uid, &Dividend{Stock: a, Date: parseDate("2024-03-01"), Amount: 30})
+	addUpdateDividend(uid, &Dividend{Stock: b, Date: parseDate("2024-06-01"), Amount: 10})
+
+	// Per stock
+	years := getIncome(uid, "")
+	if len(years) != 1 || len(years[0].Stocks) != 2 || years[0].Stocks[0].Net != 30 || years[0].Total.Net != 40 {
+		t.Fatalf("Income per stock: %+v", years)
+	}
+
+	// Per tag, adding up to the total
+	years = getIncome(uid, "tag")
+	want := map[string]float64{"core": 25, "dividend": 15}
+	var sum float64
+	for _, inc := range years[0].Stocks {
+		if inc.Net != want[inc.Group] {
+			t.Errorf("Income for %s: %f, want %f", inc.Group, inc.Net, want[inc.Group])
+		}
+		sum += inc.Net
+	}
+	if len(years[0].Stocks) != 2 || sum != years[0].Total.Net {
+		t.Errorf("Income per tag: %+v", years[0])
+	}
+}
+
+// Price provider with fixed quotes and errors, remembering what it was
+// asked for
+type testProvider struct {
+	quotes []Quote
+	err    error
+	codes  []string
+	from   time.Time
+}
+
+func (p *testProvider) Quotes(codes []string, from, to time.Time) ([]Quote, error) {
+	p.codes, p.from = codes, from
+	return p.quotes, p.err
+}
+
+// Test updating prices of stocks held and benchmarks from a provider:
+// only prices after the latest stored one are saved, foreign prices are
+// converted, and errors are reported for each code
+func TestUpdatePrices(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	addTestRate(uid, "USD", "2024-01-01", 0.9)
+	ids := map[string]int{}
+	for _, s := range []Stock{{Code: "A"}, {Code: "U", Currency: "USD"}, {Code: "G", Currency: "GBP"},
+		{Code: "X"}, {Code: "N"}, {Code: "B", Benchmark: true}} {
+		s.Name = s.Code
+		ids[s.Code] = addTestStock(uid, s)
+		if s.Code != "N" && s.Code != "B" {
+			addUpdateTransaction(uid, &Transaction{Stock: ids[s.Code], Date: parseDate("2024-01-02"),
+				Q: 10, Amount: 1000})
+		}
+	}
+	addUpdatePrice(uid, &Price{Stock: ids["A"], Date: parseDate("2024-03-04"), Price: 10})
+
+	// Quotes on and before A's latest price are left out, and one error
+	// for two codes is split between them
+	q := func(code, ds string, p float64) Quote { return Quote{code, parseDate(ds), p} }
+	p := &testProvider{
+		quotes: []Quote{q("A", "2024-03-03", 9), q("A", "2024-03-04", 9), q("A", "2024-03-05", 11),
+			q("A", "2024-03-06", 12), q("U", "2024-03-05", 100), q("G", "2024-03-05", 50)},
+		err: errors.Join(&QuoteError{"X", errors.New("not found")}, &QuoteError{"B", errors.New("timeout")}),
+	}
+	results := updatePrices(uid, p, parseDate("2024-03-06"))
+	if len(p.codes) != 5 || slices.Contains(p.codes, "N") || formatDate(p.from) != "2024-02-28" {
+		t.Errorf("Asked for %v from %s", p.codes, formatDate(p.from))
+	}
+	want := []PriceUpdate{
+		{Stock: Stock{Code: "A"}, Prices: 2, Latest: parseDate("2024-03-06")},
+		{Stock: Stock{Code: "B"}, Error: "timeout"},
+		{Stock: Stock{Code: "G"}, Error: "no exchange rate for GBP"},
+		{Stock: Stock{Code: "U"}, Prices: 1, Latest: parseDate("2024-03-05")},
+		{Stock: Stock{Code: "X"}, Error: "not found"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("Price updates: %+v", results)
+	}
+	for i, r := range results {
+		w := want[i]
+		if r.Stock.Code != w.Stock.Code || r.Prices != w.Prices || !r.Latest.Equal(w.Latest) || r.Error != w.Error {
+			t.Errorf("Price update for %s: %+v", w.Stock.Code, r)
+		}
+	}
+	if pp := getPrices(uid, ids["A"]); len(pp) != 3 || pp[len(pp)-1].Price != 12 {
+		t.Errorf("Prices of A: %+v", pp)
+	}
+	if pp := getPrices(uid, ids["U"]); len(pp) != 1 || math.Abs(pp[0].Price-90) > 1e-9 || pp[0].PriceX != 100 {
+		t.Errorf("Prices of U: %+v", pp)
+	}
+
+	// Results are remembered
+	priceUpdates.Lock()
+	n := len(priceUpdates.results[uid])
+	priceUpdates.Unlock()
+	if n != len(want) {
+		t.Errorf("Remembered %d results", n)
+	}
+
+	// Next update at the hour today, or tomorrow if past it
+	for _, tt := range [][2]string{{"2024-03-06 10:00", "2024-03-06 18:00"},
+		{"2024-03-06 18:00", "2024-03-07 18:00"}, {"2024-03-06 23:00", "2024-03-07 18:00"}} {
+		now, _ := time.Parse("2006-01-02 15:04", tt[0])
+		if next := nextPriceUpdate(now).Format("2006-01-02 15:04"); next != tt[1] {
+			t.Errorf("Next update after %s: %s, want %s", tt[0], next, tt[1])
+		}
+	}
+}
+
+// Test forecasting dividends from the last year's payments, adjusted for
+// a split since, rolled forward to the next 12 months
+func TestDividendForecast(t *testing.T) {
+	testDB(t)
+	uid := addTestUser("test")
+	ids := map[string]int{}
+	for _, code := range []string{"Q", "Y", "Z"} {
+		ids[code] = addTestStock(uid, Stock{Code: code, Name: code})
+	}
+	buy := func(code string, q float64) {
+		addUpdateTransaction(uid, &Transaction{Stock: ids[code], Date: parseDate("2023-01-02"), Q: q,
+			Amount: q * 10})
+	}
+	div := func(code, ds string, amount float64) {
+		addUpdateDividend(uid, &Dividend{Stock: ids[code], Date: parseDate(ds), Amount: amount})
+	}
+
+	// Q pays 1 per unit quarterly on 100 units, then splits 2 for 1
+	buy("Q", 100)
+	for _, ds := range []string{"2023-03-15", "2023-06-15", "2023-09-15", "2023-12-15", "2024-03-15"} {
+		div("Q", ds, 100)
+	}
+	addUpdateAction(uid, &Action{Stock: ids["Q"], Date: parseDate("2024-05-01"), Type: ActionSplit,
+		RatioOld: 1, RatioNew: 2})
+
+	// Y paid once more than a year ago, so is expected a year after that,
+	// and Z not for more than 15 months, so is not expected
+	buy("Y", 50)
+	div("Y", "2023-04-10", 25)
+	buy("Z", 10)
+	div("Z", "2023-02-01", 5)
+
+	// Q's last 4 payments a year later, at 0.5 per unit on 200 units
+	from := parseDate("2024-06-01")
+	ff := getDividendForecast(uid, from)
+	if len(ff) != 2 || ff[0].Stock.Code != "Q" || ff[1].Stock.Code != "Y" {
+		t.Fatalf("Forecast: %+v", ff)
+	}
+	q := ff[0]
+	want := []string{"2024-06-15", "2024-09-15", "2024-12-15", "2025-03-15"}
+	if q.PerYear != 4 || q.Units != 200 || len(q.Payments) != len(want) || q.Total != 400 {
+		t.Fatalf("Forecast for Q: %+v", q)
+	}
+	for i, p := range q.Payments {
+		if formatDate(p.Date) != want[i] || p.PerUnit != 0.5 || p.Amount != 100 {
+			t.Errorf("Payment from Q: %+v", p)
+		}
+	}
+	for i, m := range q.Months {
+		if (m == 100) != (i%3 == 0) || (m != 0 && m != 100) {
+			t.Errorf("Month %d of Q: %f", i, m)
+		}
+	}
+
+	// Y rolled forward a year to after the date
+	y := ff[1]
+	if y.PerYear != 1 || len(y.Payments) != 1 || formatDate(y.Payments[0].Date) != "2025-04-10" ||
+		y.Months[10] != 25 || y.Total != 25 {
+		t.Errorf("Forecast for Y: %+v", y)
+	}
 }
@@ -0,0 +1,206 @@
+// Performance: return of the portfolio and each holding over time,
+// compared with a benchmark, i.e., a stock or index marked as one
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Return of the portfolio and the benchmark over a period up to today
+type PeriodReturn struct {
+	Name       string
+	From       time.Time
+	Return     float64 // portfolio time-weighted return, percent
+	Benchmark  float64 // benchmark price return, percent
+	Difference float64 // percentage points
+	BenchStart PriceAt // benchmark prices used
+	BenchEnd   PriceAt
+	OK         bool // false if the portfolio or benchmark has no value at either end
+}
+
+// A holding compared with buying the benchmark instead
+type HoldingComparison struct {
+	Stock     Stock
+	Since     time.Time // first purchase
+	Return    float64   // percentage return since purchase, see Holding
+	Benchmark float64   // benchmark price return since first purchase, percent
+	Value     float64   // current value plus dividends received
+	WhatIf    float64   // value had each purchase and sale been of the benchmark
+}
+
+// Periods to compare, as years, months and days before today, or the
+// start of the year
+var periods = []struct {
+	Name   string
+	Y, M   int
+	ToDate bool
+}{
+	{"1 month", 0, 1, false},
+	{"3 months", 0, 3, false},
+	{"6 months", 0, 6, false},
+	{"Year to date", 0, 0, true},
+	{"1 year", 1, 0, false},
+	{"3 years", 3, 0, false},
+	{"5 years", 5, 0, false},
+}
+
+// Show page comparing performance of the portfolio and its holdings with
+// the benchmark in the query string (default the first one), valued using
+// the price policy in the query string (see reportPricePolicy)
+func showPerformance(c *gin.Context) {
+
+	// Get benchmarks, and the one selected
+	uid := portfolioOwner(c)
+	benchmarks := getBenchmarks(uid)
+	var bench *Stock
+	sid := parseIntOr(c.Query("sid"), 0)
+	for i, s := range benchmarks {
+		if s.Id == sid || (sid == 0 && i == 0) {
+			bench = &benchmarks[i]
+		}
+	}
+	policy := reportPricePolicy(c.Query)
+	data := gin.H{"benchmarks": benchmarks, "bench": bench, "home": homeCurrency,
+		"policy": policy, "methods": priceMethods, "current": "Performance"}
+
+	// Get value history from the first transaction to today, at month ends
+	// and the start of each period, leaving out dates with missing prices
+	// if strict
+	rates := newRates(uid)
+	cash := getAllCash(uid, today(), rates)
+	if bench == nil || len(cash) == 0 {
+		showPage(c, "performance.html", data)
+		return
+	}
+	to := today()
+	first := cash[0].Date
+	starts, names := []time.Time{}, []string{}
+	for _, per := range periods {
+		from := to.AddDate(-per.Y, -per.M, 0)
+		if per.ToDate {
+			from = time.Date(to.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+		}
+		if !from.Before(first) {
+			starts, names = append(starts, from), append(names, per.Name)
+		}
+	}
+	pts, tracked := getValueHistory(uid, uniqueDates(append(monthEnds(first, to), starts...)), policy, rates)
+	pts, missing := pricedPoints(pts, policy)
+	data["missing"] = missing
+	if len(pts) == 0 {
+		showPage(c, "performance.html", data)
+		return
+	}
+
+	// Return index of portfolio and benchmark (adjusted for splits), values,
+	// and what-if values. The benchmark index stays level where it has no
+	// price.
+	bp := adjustedSeries(uid, bench.Id)
+	idx := returnIndex(pts)
+	whatIf := whatIfValues(pts, bp, policy)
+	dates, values, benchIdx := []string{}, []float64{}, []float64{}
+	for _, p := range pts {
+		dates = append(dates, formatDate(p.Date))
+		values = append(values, p.Value)
+		if r, ok := priceReturn(bp, pts[0].Date, p.Date, policy); ok || len(benchIdx) == 0 {
+			benchIdx = append(benchIdx, r+100)
+		} else {
+			benchIdx = append(benchIdx, benchIdx[len(benchIdx)-1])
+		}
+	}
+
+	// Returns over each period, and since the start
+	its := TimeSeries{}
+	for i, p := range pts {
+		its = append(its, TimeSeriesPoint{p.Date, idx[i]})
+	}
+	rr := []PeriodReturn{}
+	for i, from := range starts {
+		rr = append(rr, periodReturn(names[i], from, to, its, bp, policy))
+	}
+	rr = append(rr, periodReturn("Since start", pts[0].Date, to, its, bp, policy))
+
+	// Compare each holding
+	data["periods"] = rr
+	data["holdings"] = compareHoldings(uid, bp, to, policy)
+	data["tracked"] = tracked
+	data["value"] = values[len(values)-1]
+	data["priceDate"] = pts[len(pts)-1].PriceDate
+	data["whatIf"] = whatIf[len(whatIf)-1]
+	data["dates"], data["values"], data["whatIfs"] = dates, values, whatIf
+	data["index"], data["benchIndex"] = idx, benchIdx
+	showPage(c, "performance.html", data)
+}
+
+// List of stocks marked as benchmarks
+func getBenchmarks(uid int) []Stock {
+	benchmarks := []Stock{}
+	for _, s := range getStocks(uid) {
+		if s.Benchmark {
+			benchmarks = append(benchmarks, s)
+		}
+	}
+	return benchmarks
+}
+
+// Return of the portfolio (from its return index) and the benchmark (from
+// its prices) over a period, using a price policy
+func periodReturn(name string, from, to time.Time, idx, bench TimeSeries, policy PricePolicy) PeriodReturn {
+	r := PeriodReturn{Name: name, From: from}
+	i0, i1 := priceOn(idx, from, policy), priceOn(idx, to, policy)
+	r.BenchStart, r.BenchEnd = priceOn(bench, from, policy), priceOn(bench, to, policy)
+	if !i0.OK || !i1.OK || i0.Price == 0 {
+		return r
+	}
+	r.Return = (i1.Price/i0.Price - 1) * 100
+	r.Benchmark, r.OK = priceReturn(bench, from, to, policy)
+	r.Difference = r.Return - r.Benchmark
+	return r
+}
+
+// Percentage change in price from one date to another using a price
+// policy, false if either price is missing
+func priceReturn(ts TimeSeries, from, to time.Time, policy PricePolicy) (float64, bool) {
+	p0, p1 := priceOn(ts, from, policy), priceOn(ts, to, policy)
+	if !p0.OK || !p1.OK || p0.Price == 0 {
+		return 0, false
+	}
+	return (p1.Price/p0.Price - 1) * 100, true
+}
+
+// Compare each stock bought with buying the benchmark instead: the same
+// amounts paid for purchases and received from sales, at the benchmark's
+// prices on the same dates. Dividends are added to the holding's value,
+// as benchmark prices usually do not include them. Holdings and the
+// benchmark are valued using a price policy.
+func compareHoldings(uid int, bench TimeSeries, to time.Time, policy PricePolicy) []HoldingComparison {
+	hc := []HoldingComparison{}
+	for _, h := range getPortfolioWith(uid, to, false, policy) {
+
+		// Purchases and sales as flows of money
+		tt := getTransactions(uid, h.Stock.Id)
+		if len(tt) == 0 {
+			continue
+		}
+		pts := []ValuePoint{}
+		for _, t := range tt {
+			flow := math.Abs(t.Amount)
+			if t.Q < 0 {
+				flow = -flow
+			}
+			pts = append(pts, ValuePoint{Date: t.Date, Flow: flow})
+		}
+		pts = append(pts, ValuePoint{Date: to})
+
+		// Compare with benchmark
+		whatIf := whatIfValues(pts, bench, policy)
+		ret, _ := priceReturn(bench, tt[0].Date, to, policy)
+		hc = append(hc, HoldingComparison{Stock: h.Stock, Since: tt[0].Date, Return: h.Return,
+			Benchmark: ret, Value: h.CurValue + h.Dividends, WhatIf: whatIf[len(whatIf)-1]})
+	}
+	return hc
+}
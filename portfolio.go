@@ -3,8 +3,7 @@
 package main
 
 import (
-	//"fmt"
-	"net/http"
+	"html/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,124 +12,179 @@ import (
 // Show table of holdings with current value and return since purchase
 func showPortfolio(c *gin.Context) {
 
-	// Get portfolio holdings for today
-	today := time.Now()
-	holdings := getPortfolio(today, true)
+	// Get portfolio holdings on the date asked for, default today
+	uid := portfolioOwner(c)
+	asOf := getAsOf(c)
+	holdings := getPortfolioWith(uid, asOf.Date, true, asOf.Policy)
 
-	// Get cash value today
+	// Get cash in each currency on the date, and its total value in home
+	// currency
+	balances := cashBalances(uid, asOf.Date, newRates(uid))
 	var cash float64
-	for _, c := range getAllCash(today) {
-		cash += c.Amount
+	for _, b := range balances {
+		cash += b.Value
 	}
 
 	// Show page
-	c.HTML(http.StatusOK, "portfolio.html",
-		gin.H{"d": today, "holdings": holdings, "cash": cash,
-			"menu": menu, "current": "Portfolio"})
+	showPage(c, "portfolio.html",
+		gin.H{"d": asOf.Date, "asof": asOf, "holdings": holdings, "balances": balances,
+			"cash": cash, "home": homeCurrency, "policy": asOf.Policy, "methods": priceMethods,
+			"current": "Portfolio"})
+}
+
+// Date a page is shown as of, from the "date" query parameter, with links
+// to the same page on the day before and after, and today, and the price
+// policy to value stocks with, from "policy" and "days"
+type AsOf struct {
+	Date       time.Time
+	Policy     PricePolicy
+	Today      bool              // date is today
+	Prev, Next template.URL      // links to the day before and after
+	Now        template.URL      // link to today
+	Hidden     map[string]string // other query parameters, to keep in the date form
+}
+
+// Get the date to show a page as of, today if none or invalid
+func getAsOf(c *gin.Context) AsOf {
+
+	// Parse the date, today if none or not before today
+	now := today()
+	a := AsOf{Date: now, Today: true, Policy: reportPricePolicy(c.Query),
+		Hidden: map[string]string{}}
+	if ds := c.Query("date"); ds != "" {
+		if d := parseDate(ds); validDate(d) && d.Before(now) && !sameDate(d, now) {
+			a.Date, a.Today = d, false
+		}
+	}
+
+	// Links keep the other query parameters
+	q := c.Request.URL.Query()
+	for k := range q {
+		if k != "date" && k != "policy" && k != "days" {
+			a.Hidden[k] = q.Get(k)
+		}
+	}
+	link := func(d time.Time) template.URL {
+		q.Del("date")
+		if !sameDate(d, now) {
+			q.Set("date", formatDate(d))
+		}
+		if len(q) == 0 {
+			return template.URL(c.Request.URL.Path)
+		}
+		return template.URL(c.Request.URL.Path + "?" + q.Encode())
+	}
+	day := time.Date(a.Date.Year(), a.Date.Month(), a.Date.Day(), 0, 0, 0, 0, time.UTC)
+	a.Prev = link(day.AddDate(0, 0, -1))
+	a.Next = link(day.AddDate(0, 0, 1))
+	a.Now = link(now)
+	return a
 }
 
 // Portfolio holding a particular date
 type Holding struct {
-	Stock     Stock   // the asset held
-	Units     float64 // quantity held
-	UnitCost  float64 // avg price paid per unit
-	CurPrice  float64 // current price in local currency
-	TotCost   float64 // price paid cost in home currency
-	CurValue  float64 // current value, in home currency
-	Dividends float64 // total dividends received from this stock
-	Return    float64 // percentage return since purchase
+	Stock     Stock              // the asset held
+	Units     float64            // quantity held
+	Accounts  map[string]float64 // quantity held in each account
+	UnitCost  float64            // avg price paid per unit
+	CurPrice  float64            // current price in local currency
+	PriceAt   PriceAt            // price used for the value, and its date
+	TotCost   float64            // price paid cost in home currency
+	CurValue  float64            // current value, in home currency
+	Dividends float64            // total dividends received from this stock
+	Realized  float64            // gains realized from sales and corporate actions
+	Return    float64            // percentage return since purchase
 }
 
-// Get holdings on a particular date, optionally only those held on that date
-func getPortfolio(d time.Time, heldNow bool) []Holding {
+// Get a user's holdings on a particular date, optionally only those held
+// on that date, valued using the global price policy
+func getPortfolio(uid int, d time.Time, heldNow bool) []Holding {
+	return getPortfolioWith(uid, d, heldNow, pricePolicy)
+}
+
+// Get a user's holdings on a particular date, optionally only those held
+// on that date, valued using a price policy
+func getPortfolioWith(uid int, d time.Time, heldNow bool, policy PricePolicy) []Holding {
+
+	// Get positions on the date from transactions and corporate actions
+	positions := getPositions(uid, d)
 
 	// Get all stocks, including those never or no longer held, and
-	// go through transactions to determine holdings for each stock,
-	// and total cost of the holdings
+	// determine holdings and total cost of the holdings for each stock
 	holdings := []Holding{}
-	for _, s := range getStocks() {
-
-		// Accumulate holdings and average cost, up to a certain date
-		var q, cost float64
-		for _, t := range getTransactions(s.Id) {
-			// Consider purchases before date, or sales after date
-			if later(t.Date, d) {
-				continue
-			} else if t.Q > 0 { // purchase
-				q += t.Q
-				cost += t.Amount - t.Fees
-			} else if t.Q < 0 { // sale
-				q += t.Q              // add negative to reduce balance
-				avgCost := cost / q   // average cost paid so far
-				cost -= avgCost * t.Q // ??? correct?
-			}
+	for _, s := range getStocks(uid) {
+
+		// Units held and cost, up to a certain date
+		var q, cost, realized float64
+		var accts map[string]float64
+		if p, ok := positions[s.Id]; ok {
+			q = p.Units()
+			cost = p.Cost()
+			realized = p.Realized
+			accts = p.Accounts()
 		}
 
-		// Accumulate dividends
+		// Accumulate dividends up to the date
 		var totDividends float64
-		for _, d := range getDividends(s.Id) {
-			totDividends += d.Amount
+		for _, div := range getDividends(uid, s.Id) {
+			if !later(div.Date, d) {
+				totDividends += div.Amount
+			}
 		}
 
 		// If any of this stock currently held, calculate current value and return
 		// and add it to list
 		if q != 0 || !heldNow { // should never be negative, but just in case ...
-			unitCost := cost / q            // TODO: risk of /0?
-			curPrice := stockValue(s.Id, d) // current price
+			var unitCost, pcntUp float64
+			if q != 0 {
+				unitCost = cost / q
+			}
+			price := stockValue(uid, s.Id, d, policy) // current price
+			curPrice := price.Price
 			curValue := q * curPrice
-			gain := (curPrice-unitCost)*q + totDividends
-			pcntUp := gain / cost * 100.0
-			h := Holding{Stock: s, Units: q, UnitCost: unitCost, CurPrice: curPrice,
-				CurValue: curValue, Dividends: totDividends, Return: pcntUp}
+			gain := curValue - cost + realized + totDividends
+			if cost > 0 {
+				pcntUp = gain / cost * 100.0
+			}
+			h := Holding{Stock: s, Units: q, Accounts: accts, UnitCost: unitCost, CurPrice: curPrice,
+				TotCost: cost, CurValue: curValue, Dividends: totDividends,
+				Realized: realized, Return: pcntUp, PriceAt: price}
 			holdings = append(holdings, h)
 		}
 	}
 	return holdings
 }
 
-// Value of a stock on a date, just uses the last price before
-// or on the date
-func stockValue(sid int, d time.Time) float64 {
+// Value of one of a user's stocks on a date, using a price policy, with
+// the date of the price used
+func stockValue(uid, sid int, d time.Time, policy PricePolicy) PriceAt {
 
 	// Get the stock
-	stock := getStock(sid)
+	stock := getStock(uid, sid)
 	if stock == nil {
 		panic("stockValue: stock not found")
-		return 0
 	}
 
 	// Get the (approximate) price of the stock on given date
-	ts := TimeSeries{}
-	for _, p := range getPrices(sid) {
-		ts = append(ts, TimeSeriesPoint{p.Date, p.Price})
-	}
-	price := latestPriceAt(ts, d)
-
-	// If not in home currency, get exchange rate on that date
-	/*exchangeRate := 1.0 // will be 1 if already in home currency
-	if stock.Currency != homeCurrency {
-		ts := TimeSeries{}
-		cur := getCurrencyCode(stock.Currency)
-		if cur == nil {
-			panic(fmt.Sprintf("stockValue: currency \"%s\" not found", stock.Currency))
-		}
-		for _, x := range getRates(cur.Id) {
-			ts = append(ts, TimeSeriesPoint{x.Date, x.Rate})
-		}
-		exchangeRate = latestPriceAt(ts, d)
-	}*/
+	return unadjustedPriceOn(adjustedSeries(uid, sid), getActions(uid, sid), sid, d, policy)
+}
 
-	// Return value of the stock
-	return price //* exchangeRate
+// Price of a stock on a date using a policy, found from its split-adjusted
+// prices so interpolation works across a split, then converted back to the
+// units held on the date (see splitFactor)
+func unadjustedPriceOn(prices TimeSeries, actions []Action, sid int, d time.Time,
+	policy PricePolicy) PriceAt {
+	price := priceOn(prices, d, policy)
+	price.Price *= splitFactor(actions, sid, d)
+	return price
 }
 
-// Units held of a stock on a certain date
-func unitsHeld(sid int, d time.Time) float64 {
-	var q float64
-	for _, t := range getTransactions(sid) {
-		if !later(t.Date, d) {
-			q += t.Q
-		}
+// Units held of one of a user's stocks on a certain date, after any
+// corporate actions
+func unitsHeld(uid, sid int, d time.Time) float64 {
+	p, ok := getPositions(uid, d)[sid]
+	if !ok {
+		return 0
 	}
-	return q
+	return p.Units()
 }
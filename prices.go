@@ -13,6 +13,7 @@ func editPrice(c *gin.Context) {
 
 	// Get Stock ID from query string if provided (only required for adding new prices)
 	// If there is no price ID, expect a stock ID as query parameter
+	uid := portfolioOwner(c)
 	var sid int
 	sid_, ok := c.GetQuery("sid")
 	if ok {
@@ -36,10 +37,10 @@ func editPrice(c *gin.Context) {
 			return
 		}
 		newPrice := 0.0 // TODO: default price sould be most recent one
-		p = Price{Id: 0, Date: lastTransDate, Stock: sid, Price: newPrice, PriceX: 0.0}
+		p = Price{Id: 0, Date: lastTransDate(uid), Stock: sid, Price: newPrice, PriceX: 0.0}
 		p.Comments = "From statement"
 	} else { // get existing price
-		pp := getPrice(pid)
+		pp := getPrice(uid, pid)
 		if pp == nil {
 			c.String(http.StatusNotFound, "Price not found")
 			return
@@ -49,19 +50,23 @@ func editPrice(c *gin.Context) {
 	}
 
 	// Get the stock, used for heading on form
-	stock := getStock(sid)
+	stock := getStock(uid, sid)
+	if stock == nil {
+		c.String(http.StatusNotFound, "Stock not found")
+		return
+	}
 
 	// Show the form to edit price
-	c.HTML(http.StatusOK, "edit_price.html",
+	showPage(c, "edit_price.html",
 		gin.H{"p": p, "ds": formatDate(p.Date), "stock": stock,
-			"home": homeCurrency,
-			"menu": menu, "current": "Stocks"})
+			"home": homeCurrency, "current": "Stocks"})
 }
 
 // Create or update a price
 func updatePrice(c *gin.Context) {
 
 	// Get stock and price ID (latter will be 0 to add a price)
+	uid := portfolioOwner(c)
 	sid_, ok := c.GetPostForm("sid")
 	if !ok {
 		c.String(http.StatusOK, "savePrice: Missing stock ID")
@@ -79,10 +84,16 @@ func updatePrice(c *gin.Context) {
 		return
 	}
 
+	// Make sure the stock belongs to this user
+	if getStock(uid, sid) == nil {
+		c.String(http.StatusNotFound, "savePrice: stock not found")
+		return
+	}
+
 	// Get the price or create "blank" one
 	p := &Price{Stock: sid}
 	if pid > 0 {
-		p = getPrice(pid)
+		p = getPrice(uid, pid)
 		if p == nil {
 			c.String(http.StatusOK, "savePrice: price not found")
 			return
@@ -98,7 +109,7 @@ func updatePrice(c *gin.Context) {
 	price, _ := c.GetPostForm("price")
 	price = strings.TrimSpace(price)
 	if len(price) > 0 && price[len(price)-1] == '!' {
-		n := unitsHeld(sid, p.Date) // don't worry, date checked below
+		n := unitsHeld(uid, sid, p.Date) // don't worry, date checked below
 		if n > 0 {
 			tot := parseFloat(price[:len(price)-1])
 			p.Price = tot / n
@@ -132,10 +143,10 @@ func updatePrice(c *gin.Context) {
 	}
 
 	// Create or update price
-	addUpdatePrice(p)
+	addUpdatePrice(uid, p)
 
 	// Remember the last transaction date for next entry
-	lastTransDate = p.Date
+	setLastTransDate(uid, p.Date)
 
 	// Go back to the stock page
 	c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", sid))
@@ -0,0 +1,367 @@
+// Price provider: gets market prices from a web service, and updates the
+// prices of stocks held (and benchmarks) every day
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Price of a stock on a date, in the stock's currency
+type Quote struct {
+	Code  string
+	Date  time.Time
+	Price float64
+}
+
+// A source of market prices
+type PriceProvider interface {
+
+	// Get prices for each of a list of codes between two dates
+	// (inclusive). Returns the quotes it could get, and a QuoteError for
+	// each code it could not (joined, see errors.Join).
+	Quotes(codes []string, from, to time.Time) ([]Quote, error)
+}
+
+// Failure to get quotes for a code
+type QuoteError struct {
+	Code string
+	Err  error
+}
+
+func (e *QuoteError) Error() string {
+	return e.Code + ": " + e.Err.Error()
+}
+
+func (e *QuoteError) Unwrap() error {
+	return e.Err
+}
+
+// Provider that gets prices from a web service, with one request per code.
+// The URL is a template, where {code}, {from} and {to} are replaced by the
+// code and dates (yyyy-mm-dd). The response is either JSON, a list of
+// objects with a date and a price (or close), or CSV with a header line
+// and columns for date and price (or close).
+type HTTPProvider struct {
+	URL    string
+	Format string // "json" or "csv"
+	Client *http.Client
+}
+
+// Get prices for each code between two dates
+func (p *HTTPProvider) Quotes(codes []string, from, to time.Time) ([]Quote, error) {
+	qq := []Quote{}
+	errs := []error{}
+	for _, code := range codes {
+		q, err := p.quotes(code, from, to)
+		if err != nil {
+			errs = append(errs, &QuoteError{code, err})
+			continue
+		}
+		qq = append(qq, q...)
+	}
+	return qq, errors.Join(errs...)
+}
+
+// Get prices for one code between two dates
+func (p *HTTPProvider) quotes(code string, from, to time.Time) ([]Quote, error) {
+
+	// Request prices
+	u := strings.NewReplacer("{code}", url.QueryEscape(code), "{from}", formatDate(from),
+		"{to}", formatDate(to)).Replace(p.URL)
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	// Parse response, and keep prices between the dates
+	var qq []Quote
+	if p.Format == "csv" {
+		qq, err = parseCSVQuotes(code, resp.Body)
+	} else {
+		qq, err = parseJSONQuotes(code, resp.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := []Quote{}
+	for _, q := range qq {
+		if !q.Date.Before(from) && !later(q.Date, to) {
+			out = append(out, q)
+		}
+	}
+	return out, nil
+}
+
+// Parse quotes from JSON: a list of objects with a date and a price or
+// close (case insensitive), as a number or string
+func parseJSONQuotes(code string, r io.Reader) ([]Quote, error) {
+	var rows []map[string]any
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, err
+	}
+	qq := []Quote{}
+	for _, row := range rows {
+		fields := map[string]string{}
+		for k, v := range row {
+			fields[strings.ToLower(k)] = fmt.Sprint(v)
+		}
+		q, err := makeQuote(code, fields)
+		if err != nil {
+			return nil, err
+		}
+		qq = append(qq, q)
+	}
+	return qq, nil
+}
+
+// Parse quotes from CSV with a header line, with columns for date and
+// price or close (case insensitive)
+func parseCSVQuotes(code string, r io.Reader) ([]Quote, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no header line")
+	}
+	qq := []Quote{}
+	for _, row := range rows[1:] {
+		fields := map[string]string{}
+		for i, h := range rows[0] {
+			if i < len(row) {
+				fields[strings.ToLower(strings.TrimSpace(h))] = row[i]
+			}
+		}
+		q, err := makeQuote(code, fields)
+		if err != nil {
+			return nil, err
+		}
+		qq = append(qq, q)
+	}
+	return qq, nil
+}
+
+// Make a quote from fields with a date, and a price or close
+func makeQuote(code string, fields map[string]string) (Quote, error) {
+	price, ok := fields["price"]
+	if !ok {
+		price = fields["close"]
+	}
+	d := parseDate(strings.TrimSpace(fields["date"]))
+	p, err := strconv.ParseFloat(strings.TrimSpace(price), 64)
+	if !validDate(d) || err != nil || p <= 0 {
+		return Quote{}, fmt.Errorf("invalid date or price: %q, %q", fields["date"], price)
+	}
+	return Quote{Code: code, Date: d, Price: p}, nil
+}
+
+//----------------------------------------------------------------//
+//                        SCHEDULED UPDATES                       //
+//----------------------------------------------------------------//
+
+// Provider used to update prices, nil if not configured
+var priceProvider PriceProvider
+
+// Hour of the day to update prices
+var priceUpdateHour = 18
+
+// How far back to get prices for a stock with none recent
+const priceUpdateDays = 7
+
+// Result of updating the prices of one stock
+type PriceUpdate struct {
+	Stock  Stock
+	Prices int       // number of prices saved
+	Latest time.Time // date of latest price saved
+	Error  string    // why prices could not be got or saved, if not
+}
+
+// Results of the last update of each user's prices
+var priceUpdates = struct {
+	sync.Mutex
+	when    map[int]time.Time
+	results map[int][]PriceUpdate
+}{when: map[int]time.Time{}, results: map[int][]PriceUpdate{}}
+
+// Configure the price provider from environment variables: PRICE_URL is
+// the URL template (see HTTPProvider), PRICE_FORMAT is json (default) or
+// csv, and PRICE_HOUR the hour of the day to update (default 18). If there
+// is a URL, starts updating prices every day.
+func startPriceUpdates() {
+	u := os.Getenv("PRICE_URL")
+	if u == "" {
+		return
+	}
+	priceProvider = &HTTPProvider{URL: u, Format: os.Getenv("PRICE_FORMAT")}
+	if h := parseIntOr(os.Getenv("PRICE_HOUR"), priceUpdateHour); h >= 0 && h < 24 {
+		priceUpdateHour = h
+	}
+	go func() {
+		for {
+			time.Sleep(time.Until(nextPriceUpdate(time.Now())))
+			for _, u := range getAllUsers() {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							fmt.Println("Price update failed:", r)
+						}
+					}()
+					updatePrices(u.Id, priceProvider, time.Now())
+				}()
+			}
+		}
+	}()
+}
+
+// Time of the next update after a time
+func nextPriceUpdate(t time.Time) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), priceUpdateHour, 0, 0, 0, t.Location())
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Update the prices of the stocks a user holds, and benchmarks, from the
+// day after each one's latest price (but no more than a week ago) to a
+// date, and remember the results. A price in a foreign currency needs an
+// exchange rate to convert it to home currency.
+func updatePrices(uid int, p PriceProvider, to time.Time) []PriceUpdate {
+
+	// Stocks to update, and the earliest date to get prices from
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	positions := getPositions(uid, to)
+	stocks := []Stock{}
+	codes := []string{}
+	from := to
+	latest := map[int]time.Time{}
+	for _, s := range getStocks(uid) {
+		if pos, ok := positions[s.Id]; (!ok || pos.Units() <= 0) && !s.Benchmark {
+			continue
+		}
+		d := to.AddDate(0, 0, -priceUpdateDays)
+		if pp := getPrices(uid, s.Id); len(pp) > 0 && pp[len(pp)-1].Date.After(d) {
+			d = pp[len(pp)-1].Date.AddDate(0, 0, 1)
+			latest[s.Id] = pp[len(pp)-1].Date
+		}
+		if d.Before(from) {
+			from = d
+		}
+		stocks = append(stocks, s)
+		codes = append(codes, s.Code)
+	}
+
+	// Get quotes, and failures for each code
+	quotes := []Quote{}
+	failed := map[string]string{}
+	if len(codes) > 0 {
+		var err error
+		quotes, err = p.Quotes(codes, from, to)
+		for _, e := range unjoin(err) {
+			var qe *QuoteError
+			if errors.As(e, &qe) {
+				failed[qe.Code] = qe.Err.Error()
+			} else {
+				for _, c := range codes {
+					failed[c] = e.Error()
+				}
+			}
+		}
+	}
+
+	// Save the quotes for each stock after its latest price
+	results := []PriceUpdate{}
+	rates := newRates(uid)
+	for _, s := range stocks {
+		r := PriceUpdate{Stock: s, Error: failed[s.Code]}
+		for _, q := range quotes {
+			if q.Code != s.Code || !q.Date.After(latest[s.Id]) {
+				continue
+			}
+			price := &Price{Stock: s.Id, Date: q.Date, Price: q.Price, PriceX: q.Price,
+				Comments: "From price provider"}
+			if s.Currency != "" && s.Currency != homeCurrency {
+				rate, ok := rates.On(s.Currency, q.Date)
+				if !ok || rate <= 0 {
+					r.Error = "no exchange rate for " + s.Currency
+					continue
+				}
+				price.Price = q.Price * rate
+			}
+			setPriceOnDate(uid, price)
+			r.Prices++
+			if q.Date.After(r.Latest) {
+				r.Latest = q.Date
+			}
+		}
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Stock.Code < results[j].Stock.Code
+	})
+
+	// Remember results
+	priceUpdates.Lock()
+	defer priceUpdates.Unlock()
+	priceUpdates.when[uid] = time.Now()
+	priceUpdates.results[uid] = results
+	return results
+}
+
+// Split an error into the errors joined in it (see errors.Join)
+func unjoin(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		return j.Unwrap()
+	}
+	return []error{err}
+}
+
+// Show page with results of the last price update
+func showPriceUpdates(c *gin.Context) {
+	uid := portfolioOwner(c)
+	priceUpdates.Lock()
+	t, results := priceUpdates.when[uid], priceUpdates.results[uid]
+	priceUpdates.Unlock()
+	data := gin.H{"configured": priceProvider != nil, "time": t, "results": results,
+		"current": "Stocks"}
+	if priceProvider != nil {
+		data["next"] = nextPriceUpdate(time.Now())
+	}
+	showPage(c, "price_updates.html", data)
+}
+
+// Update prices now, and show the results
+func doUpdatePrices(c *gin.Context) {
+	if priceProvider == nil {
+		c.String(http.StatusOK, "No price provider configured")
+		return
+	}
+	updatePrices(portfolioOwner(c), priceProvider, time.Now())
+	c.Redirect(http.StatusFound, "/price_updates")
+}
@@ -0,0 +1,167 @@
+// Data quality: checks for stale or suspicious prices, missing exchange
+// rates, and transactions that don't add up, which would otherwise give
+// wrong values without any warning
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Names of the checks, in the order shown
+const (
+	CheckStalePrice    = "Stale prices"
+	CheckPriceJump     = "Price jumps"
+	CheckMissingRate   = "Missing exchange rates"
+	CheckNegativeUnits = "Negative units"
+	CheckUnpriced      = "Transactions before first price"
+)
+
+var qualityChecks = []string{CheckStalePrice, CheckPriceJump, CheckMissingRate,
+	CheckNegativeUnits, CheckUnpriced}
+
+// A problem found by one of the checks
+type QualityIssue struct {
+	Check   string    // one of qualityChecks
+	Stock   Stock     // stock the problem is with, zero if none
+	Date    time.Time // date of the problem, zero if none
+	Message string
+}
+
+// Thresholds for the checks, from the query string
+type QualityOptions struct {
+	StaleDays int     // a price or rate older than this is stale
+	Jump      float64 // percent change from one price to the next that is suspicious
+}
+
+// Show page with the problems found by each check, with thresholds in the
+// query string: "days" for stale prices (default 7), and "jump" for price
+// changes (default 50%)
+func showQuality(c *gin.Context) {
+	uid := portfolioOwner(c)
+	opts := QualityOptions{
+		StaleDays: parseIntOr(c.Query("days"), 7),
+		Jump:      parseFloatOr(c.Query("jump"), 50),
+	}
+	if opts.StaleDays < 0 {
+		opts.StaleDays = 7
+	}
+	if opts.Jump <= 0 {
+		opts.Jump = 50
+	}
+	issues := map[string][]QualityIssue{}
+	for _, is := range getQualityIssues(uid, today(), opts) {
+		issues[is.Check] = append(issues[is.Check], is)
+	}
+	showPage(c, "quality.html",
+		gin.H{"checks": qualityChecks, "issues": issues, "opts": opts, "current": "Stocks"})
+}
+
+// Check a user's data on a date for problems: stocks held whose latest
+// price (or exchange rate) is older than a number of days, changes from
+// one split-adjusted price to the next that are too large, foreign stocks
+// held or traded with no exchange rate, negative units in any account, and
+// transactions before a stock's first price
+func getQualityIssues(uid int, d time.Time, opts QualityOptions) []QualityIssue {
+	issues := []QualityIssue{}
+	stale := d.AddDate(0, 0, -opts.StaleDays)
+	positions := getPositions(uid, d)
+	traded := map[int][]Transaction{}
+	for _, t := range getTransactions(uid, 0) {
+		traded[t.Stock] = append(traded[t.Stock], t)
+	}
+
+	// Check each stock's prices and exchange rates
+	rateChecked := map[string]bool{}
+	for _, s := range getStocks(uid) {
+		held := false
+		if p, ok := positions[s.Id]; ok && p.Units() > 1e-9 {
+			held = true
+		}
+		prices := getAdjustedPrices(uid, s.Id)
+
+		// Latest price of a stock held is too old, or there is none
+		if held && len(prices) == 0 {
+			issues = append(issues, QualityIssue{Check: CheckStalePrice, Stock: s,
+				Message: "No prices"})
+		} else if held && prices[len(prices)-1].Date.Before(stale) {
+			last := prices[len(prices)-1].Date
+			issues = append(issues, QualityIssue{Check: CheckStalePrice, Stock: s, Date: last,
+				Message: fmt.Sprintf("Latest price is %d days old", daysBetween(last, d))})
+		}
+
+		// Large change from one price to the next, after adjusting for
+		// splits
+		for i := 1; i < len(prices); i++ {
+			p0, p1 := prices[i-1].Price, prices[i].Price
+			if p0 <= 0 || p1 <= 0 {
+				continue
+			}
+			if change := (p1/p0 - 1) * 100; math.Abs(change) > opts.Jump {
+				issues = append(issues, QualityIssue{Check: CheckPriceJump, Stock: s,
+					Date: prices[i].Date,
+					Message: fmt.Sprintf("%+.0f%% from %.3f on %s to %.3f", change, p0,
+						formatDate(prices[i-1].Date), p1)})
+			}
+		}
+
+		// Exchange rate of a foreign stock held or traded is missing or
+		// too old (once for each currency)
+		cur := s.Currency
+		if cur != "" && cur != homeCurrency && (held || len(traded[s.Id]) > 0) && !rateChecked[cur] {
+			rateChecked[cur] = true
+			ts, _ := rateSeries(uid, cur)
+			if len(ts) == 0 {
+				issues = append(issues, QualityIssue{Check: CheckMissingRate, Stock: s,
+					Message: "No exchange rates for " + cur})
+			} else if last := ts[len(ts)-1].d; held && last.Before(stale) {
+				issues = append(issues, QualityIssue{Check: CheckMissingRate, Stock: s, Date: last,
+					Message: fmt.Sprintf("Latest %s rate is %d days old", cur, daysBetween(last, d))})
+			}
+		}
+
+		// Transactions before the first price, which can't be valued
+		for _, t := range traded[s.Id] {
+			if len(prices) == 0 || (t.Date.Before(prices[0].Date) && !sameDate(t.Date, prices[0].Date)) {
+				issues = append(issues, QualityIssue{Check: CheckUnpriced, Stock: s, Date: t.Date,
+					Message: fmt.Sprintf("%g units, before first price", t.Q)})
+			}
+		}
+	}
+
+	// Replay all events, and find the first time units in any account go
+	// negative
+	stocks := map[int]Stock{}
+	for _, s := range getStocks(uid) {
+		stocks[s.Id] = s
+	}
+	negative := map[string]bool{}
+	all := map[int]*Position{}
+	for _, e := range getPositionEvents(uid) {
+		if later(e.date, d) {
+			break
+		}
+		e.apply(positionFor(all))
+		for sid, p := range all {
+			for acct, q := range p.Accounts() {
+				key := fmt.Sprint(sid, "/", acct)
+				if q < -1e-9 && !negative[key] {
+					negative[key] = true
+					issues = append(issues, QualityIssue{Check: CheckNegativeUnits, Stock: stocks[sid],
+						Date:    e.date,
+						Message: fmt.Sprintf("%g units in %s account", q, accountName(acct))})
+				}
+			}
+		}
+	}
+	return issues
+}
+
+// Number of whole days from one date to another
+func daysBetween(from, to time.Time) int {
+	return int(to.Sub(from).Hours() / 24)
+}
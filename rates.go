@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,6 +16,7 @@ func editRate(c *gin.Context) {
 	// Get Currency ID from query string if provided (only required
 	// for adding new prices)
 	// If there is no rate ID, expect a currency ID as query parameter
+	uid := portfolioOwner(c)
 	var cid int
 	cid_, ok := c.GetQuery("cid")
 	if ok {
@@ -36,10 +39,14 @@ func editRate(c *gin.Context) {
 			c.String(http.StatusNotFound, "Cannot add rate without currency ID")
 			return
 		}
+		if getCurrency(uid, cid) == nil {
+			c.String(http.StatusNotFound, "Currency not found")
+			return
+		}
 		newRate := 0.0 // TODO: default rate sould be most recent one
 		r = Rate{Currency: cid, Date: time.Now(), Rate: newRate}
 	} else { // get existing rate
-		rp := getRate(rid)
+		rp := getRate(uid, rid)
 		if rp == nil {
 			c.String(http.StatusNotFound, "Rate not found")
 			return
@@ -49,14 +56,15 @@ func editRate(c *gin.Context) {
 	}
 
 	// Show the form to edit rate
-	c.HTML(http.StatusOK, "edit_rate.html",
-		gin.H{"r": r, "ds": formatDate(r.Date), "menu": menu, "current": "Currencies"})
+	showPage(c, "edit_rate.html",
+		gin.H{"r": r, "ds": formatDate(r.Date), "current": "Currencies"})
 }
 
 // Create or update a rate
 func updateRate(c *gin.Context) {
 
 	// Get currency and rate ID (latter will be 0 to add a rate)
+	uid := portfolioOwner(c)
 	cid_, ok := c.GetPostForm("cid")
 	if !ok {
 		c.String(http.StatusOK, "saveRate: Missing currency ID")
@@ -74,10 +82,16 @@ func updateRate(c *gin.Context) {
 		return
 	}
 
+	// Make sure the currency belongs to this user
+	if getCurrency(uid, cid) == nil {
+		c.String(http.StatusNotFound, "saveRate: currency not found")
+		return
+	}
+
 	// Get the rate or create "blank" one
 	r := &Rate{Currency: cid}
 	if rid > 0 {
-		r = getRate(rid)
+		r = getRate(uid, rid)
 		if r == nil {
 			c.String(http.StatusOK, "saveRate: rate not found")
 			return
@@ -101,8 +115,201 @@ func updateRate(c *gin.Context) {
 	}
 
 	// Create or update rate
-	addUpdateRate(r)
+	addUpdateRate(uid, r)
 
 	// Go back to the currency page
 	c.Redirect(http.StatusFound, fmt.Sprintf("/currency/%d", cid))
 }
+
+// Exchange rates of a user's currencies as time series (see rateSeries),
+// each read when first needed, so a report that converts many amounts
+// reads each currency's rates once
+type Rates struct {
+	uid      int
+	series   map[string]TimeSeries
+	inferred map[string]map[string]bool // dates of inferred rates in each series
+}
+
+// Rates of a user's currencies, none read yet
+func newRates(uid int) *Rates {
+	return &Rates{uid: uid, series: map[string]TimeSeries{}, inferred: map[string]map[string]bool{}}
+}
+
+// Rates of a currency (by code) as a time series, empty if none
+func (r *Rates) Series(code string) TimeSeries {
+	ts, ok := r.series[code]
+	if !ok {
+		ts, r.inferred[code] = rateSeries(r.uid, code)
+		r.series[code] = ts
+	}
+	return ts
+}
+
+// Exchange rate of a currency (by code) on a date, i.e., the multiplier to
+// convert to home currency, using the last rate before or on the date.
+// Returns false if there are no rates for the currency.
+func (r *Rates) On(code string, d time.Time) (float64, bool) {
+
+	// Home currency is always 1
+	if code == "" || code == homeCurrency {
+		return 1, true
+	}
+
+	// Find the rates
+	ts := r.Series(code)
+	if len(ts) == 0 {
+		return 0, false
+	}
+	return latestPriceAt(ts, d), true
+}
+
+// Whether the rate of a currency on a date (see On) is inferred from
+// prices, and the date of that rate
+func (r *Rates) Inferred(code string, d time.Time) (bool, time.Time) {
+	ts := r.Series(code)
+	if len(ts) == 0 {
+		return false, time.Time{}
+	}
+	pt := ts[max(ts.after(d)-1, 0)]
+	return r.inferred[code][formatDate(pt.d)], pt.d
+}
+
+// Rates of a currency (by code) as a time series, in date order: the
+// user's stored rates, and if the currency is set to use them, rates
+// inferred from prices (see getInferredRates) on dates with no stored
+// rate. Also returns the dates of the inferred rates used.
+func rateSeries(uid int, code string) (TimeSeries, map[string]bool) {
+
+	// Stored rates, if the currency is found
+	ts := TimeSeries{}
+	inferred := map[string]bool{}
+	cur := getCurrencyCode(uid, code)
+	if cur == nil {
+		return ts, inferred
+	}
+	stored := map[string]bool{}
+	for _, r := range getRates(uid, cur.Id) {
+		ts = append(ts, TimeSeriesPoint{r.Date, r.Rate})
+		stored[formatDate(r.Date)] = true
+	}
+
+	// Inferred rates where there is no stored rate
+	if cur.Infer {
+		for _, r := range getInferredRates(uid, code) {
+			if ds := formatDate(r.Date); !stored[ds] {
+				ts = append(ts, TimeSeriesPoint{r.Date, r.Rate})
+				inferred[ds] = true
+			}
+		}
+	}
+
+	// Time series needs ascending dates
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].d.Before(ts[j].d)
+	})
+	return ts, inferred
+}
+
+// Relative difference between inferred and stored rates that counts as a
+// disagreement
+const rateTolerance = 0.02
+
+// A rate inferred from the prices of stocks in a currency on one date
+type InferredRate struct {
+	Date   time.Time
+	Rate   float64 // mean of price in home currency over price in the stock's currency
+	Prices int     // number of prices it is inferred from
+}
+
+// Exchange rates of a currency (by code) implied by the prices of a user's
+// stocks in that currency that have both a price in home currency and a
+// price in the stock's currency, in date order
+func getInferredRates(uid int, code string) []InferredRate {
+
+	// Home currency has no rate to infer
+	if code == "" || code == homeCurrency {
+		return nil
+	}
+
+	// Sum ratios of prices on each date
+	byDate := map[string]*InferredRate{}
+	for _, s := range getStocks(uid) {
+		if s.Currency != code {
+			continue
+		}
+		for _, p := range getPrices(uid, s.Id) {
+			if p.Price <= 0 || p.PriceX <= 0 {
+				continue
+			}
+			ds := formatDate(p.Date)
+			r, ok := byDate[ds]
+			if !ok {
+				r = &InferredRate{Date: parseDate(ds)}
+				byDate[ds] = r
+			}
+			r.Rate += p.Price / p.PriceX
+			r.Prices++
+		}
+	}
+
+	// Mean on each date, in date order
+	rr := []InferredRate{}
+	for _, r := range byDate {
+		r.Rate /= float64(r.Prices)
+		rr = append(rr, *r)
+	}
+	sort.Slice(rr, func(i, j int) bool {
+		return rr[i].Date.Before(rr[j].Date)
+	})
+	return rr
+}
+
+// Stored and inferred rates of a currency on one date, for comparison
+type RateComparison struct {
+	Date     time.Time
+	Stored   *Rate         // stored rate on the date, nil if none
+	Inferred *InferredRate // inferred rate on the date, nil if none
+	Diff     float64       // inferred relative to latest stored rate, percent
+	Disagree bool          // difference is more than rateTolerance
+	Used     bool          // inferred rate is used to convert values
+}
+
+// Compare a currency's stored rates with rates inferred from prices, on
+// each date with either, latest first. An inferred rate is compared with
+// the latest stored rate on or before its date.
+func compareRates(stored []Rate, inferred []InferredRate) []RateComparison {
+
+	// Rows for stored rates, and inferred rates on the same dates
+	byDate := map[string]*RateComparison{}
+	for i := range stored {
+		byDate[formatDate(stored[i].Date)] = &RateComparison{Date: stored[i].Date, Stored: &stored[i]}
+	}
+	for i := range inferred {
+		ds := formatDate(inferred[i].Date)
+		if byDate[ds] == nil {
+			byDate[ds] = &RateComparison{Date: inferred[i].Date}
+		}
+		byDate[ds].Inferred = &inferred[i]
+	}
+	cc := []RateComparison{}
+	for _, rc := range byDate {
+		cc = append(cc, *rc)
+	}
+	sort.Slice(cc, func(i, j int) bool {
+		return cc[i].Date.After(cc[j].Date)
+	})
+
+	// Compare each inferred rate with the latest stored rate, working
+	// back from the earliest date
+	var latest *Rate
+	for i := len(cc) - 1; i >= 0; i-- {
+		if cc[i].Stored != nil {
+			latest = cc[i].Stored
+		}
+		if cc[i].Inferred != nil && latest != nil && latest.Rate > 0 {
+			cc[i].Diff = (cc[i].Inferred.Rate/latest.Rate - 1) * 100
+			cc[i].Disagree = math.Abs(cc[i].Diff) > rateTolerance*100
+		}
+	}
+	return cc
+}
@@ -0,0 +1,325 @@
+// Rebalancing: target weights per stock or classification, drift from
+// the targets, and trades proposed to return to them
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Name of the group for cash, which may also have a target
+const cashGroup = "Cash"
+
+// Assumptions for proposed trades, amounts in home currency
+type RebalanceOptions struct {
+	AddCash  float64 // cash to invest (or withdraw, if negative)
+	MinTrade float64 // smallest trade worth making
+	Fee      float64 // fixed fee per trade
+	FeePcnt  float64 // fee as a percentage of the trade amount
+}
+
+// Current weight of a group, its target, and the drift between them
+type Drift struct {
+	Group     string
+	Value     float64 // current value, in home currency
+	Percent   float64 // current weight
+	Target    float64 // target weight
+	Band      float64 // tolerance either side of target
+	Drift     float64 // current less target weight, percentage points
+	HasTarget bool
+	OutOfBand bool // drift is outside the tolerance band
+}
+
+// A trade proposed to return to the targets
+type Trade struct {
+	Stock  Stock
+	Group  string
+	Q      float64 // units, negative to sell
+	Price  float64 // latest price
+	Amount float64 // total paid including fees, or proceeds less fees
+	Fee    float64
+}
+
+// Show page with targets, drift, and proposed trades for a grouping,
+// with options in the query string
+func showRebalance(c *gin.Context) {
+
+	// Get grouping and options
+	uid := portfolioOwner(c)
+	by := c.DefaultQuery("by", "stock")
+	opts := rebalanceOptions(c.Query)
+
+	// Get drift and proposed trades
+	holdings := getPortfolio(uid, time.Now(), false)
+	cash := cashValue(uid, time.Now())
+	targets := getTargets(uid, by)
+	drift, trades, cashAfter := rebalance(holdings, cash, targets, by, opts)
+
+	// Total of target weights, which should be 100
+	var totWeight float64
+	for _, t := range targets {
+		totWeight += t.Weight
+	}
+
+	// Show page
+	gg := append([]Grouping{{"stock", "Stock"}}, groupings...)
+	showPage(c, "rebalance.html",
+		gin.H{"by": by, "groupings": gg, "opts": opts, "drift": drift, "rows": targetRows(drift),
+			"trades": trades, "cash": cash, "cashAfter": cashAfter, "totWeight": totWeight,
+			"drafts": getDraftTransactions(uid), "names": stockNames(uid),
+			"home": homeCurrency, "current": "Rebalance"})
+}
+
+// Save the targets for a grouping from the form, which has lists of
+// groups, weights and bands; a blank weight removes the target
+func saveTargets(c *gin.Context) {
+
+	// Get grouping
+	uid := portfolioOwner(c)
+	by := c.PostForm("by")
+	if by != "stock" && !slices.ContainsFunc(groupings, func(g Grouping) bool { return g.Key == by }) {
+		c.String(http.StatusOK, "saveTargets: invalid grouping")
+		return
+	}
+
+	// Get targets from form
+	groups := c.PostFormArray("group")
+	weights := c.PostFormArray("weight")
+	bands := c.PostFormArray("band")
+	if len(weights) != len(groups) || len(bands) != len(groups) {
+		c.String(http.StatusOK, "saveTargets: missing inputs")
+		return
+	}
+	tt := []Target{}
+	for i, g := range groups {
+		g = strings.TrimSpace(g)
+		if g == "" || strings.TrimSpace(weights[i]) == "" {
+			continue
+		}
+		t := Target{By: by, Group: g, Weight: parseFloat(weights[i]),
+			Band: parseFloatOr(bands[i], 0)}
+		if t.Weight < 0 || t.Weight > 100 || t.Band < 0 {
+			c.String(http.StatusOK, "Invalid inputs: weights must be 0 to 100, bands positive")
+			return
+		}
+		tt = append(tt, t)
+	}
+
+	// Save and go back to rebalancing page
+	setTargets(uid, by, tt)
+	c.Redirect(http.StatusFound, "/Rebalance?by="+url.QueryEscape(by))
+}
+
+// Record the proposed trades as draft transactions dated today, which can
+// be edited and confirmed once done
+func saveRebalanceDrafts(c *gin.Context) {
+
+	// Work out the trades again, from the same inputs as the page
+	uid := portfolioOwner(c)
+	by := c.PostForm("by")
+	opts := rebalanceOptions(c.PostForm)
+	holdings := getPortfolio(uid, time.Now(), false)
+	_, trades, _ := rebalance(holdings, cashValue(uid, time.Now()), getTargets(uid, by), by, opts)
+
+	// Add each one as a draft
+	for _, tr := range trades {
+		t := &Transaction{Stock: tr.Stock.Id, Date: today(), Q: tr.Q, Amount: tr.Amount,
+			Fees: tr.Fee, Draft: true, Comments: "Rebalancing to " + tr.Group + " target"}
+		addUpdateTransaction(uid, t)
+	}
+
+	// Go back to rebalancing page
+	c.Redirect(http.StatusFound, "/Rebalance?by="+url.QueryEscape(by))
+}
+
+// Delete all draft transactions
+func doDeleteDrafts(c *gin.Context) {
+	deleteDraftTransactions(portfolioOwner(c))
+	c.Redirect(http.StatusFound, "/Rebalance")
+}
+
+// Get rebalancing options from query string or form
+func rebalanceOptions(get func(string) string) RebalanceOptions {
+	return RebalanceOptions{
+		AddCash:  parseFloatOr(get("add_cash"), 0),
+		MinTrade: parseFloatOr(get("min_trade"), 0),
+		Fee:      parseFloatOr(get("fee"), 0),
+		FeePcnt:  parseFloatOr(get("fee_pcnt"), 0),
+	}
+}
+
+// Total value of a user's cash on a date, in home currency
+func cashValue(uid int, d time.Time) float64 {
+	var cash float64
+	for _, b := range cashBalances(uid, d, newRates(uid)) {
+		cash += b.Value
+	}
+	return cash
+}
+
+// Codes of all of a user's stocks, by ID
+func stockNames(uid int) map[int]string {
+	names := map[int]string{}
+	for _, s := range getStocks(uid) {
+		names[s.Id] = s.Code
+	}
+	return names
+}
+
+// Work out the drift of each group from its target, and the trades to
+// return groups outside their tolerance band to target, using the latest
+// prices. Groups without a target are left as they are. The trade for a
+// group is split between the stocks in it in proportion to their value
+// (or equally, if none are held), rounded down to whole units, and left
+// out if below the minimum trade size. Purchases are scaled down to fit
+// the cash, plus the proceeds of sales. Returns the drift of each group,
+// largest first, the trades, and the cash left after the trades.
+func rebalance(holdings []Holding, cash float64, targets []Target, by string,
+	opts RebalanceOptions) ([]Drift, []Trade, float64) {
+
+	// Current value of each group, and the stocks in each
+	values := map[string]float64{cashGroup: cash + opts.AddCash}
+	members := map[string][]Holding{}
+	for _, h := range holdings {
+		for g, share := range groupShares(&h.Stock, by) {
+			values[g] += h.CurValue * share
+			members[g] = append(members[g], h)
+		}
+	}
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+
+	// Drift of each group with value or a target
+	byGroup := map[string]*Drift{}
+	for g, v := range values {
+		if v != 0 {
+			byGroup[g] = &Drift{Group: g, Value: v}
+		}
+	}
+	for _, t := range targets {
+		d, ok := byGroup[t.Group]
+		if !ok {
+			d = &Drift{Group: t.Group}
+			byGroup[t.Group] = d
+		}
+		d.Target, d.Band, d.HasTarget = t.Weight, t.Band, true
+	}
+	drift := []Drift{}
+	for _, d := range byGroup {
+		if total != 0 {
+			d.Percent = d.Value / total * 100
+		}
+		if d.HasTarget {
+			d.Drift = d.Percent - d.Target
+			d.OutOfBand = math.Abs(d.Drift) > d.Band+1e-9
+		}
+		drift = append(drift, *d)
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		if math.Abs(drift[i].Drift) != math.Abs(drift[j].Drift) {
+			return math.Abs(drift[i].Drift) > math.Abs(drift[j].Drift)
+		}
+		return drift[i].Group < drift[j].Group
+	})
+
+	// Change in value of each stock in each group out of band (cash is
+	// what is left over), split between the stocks in the group that have
+	// a price
+	type change struct {
+		h      Holding
+		group  string
+		amount float64
+	}
+	changes := []change{}
+	var buys float64
+	for _, d := range drift {
+		if !d.OutOfBand || d.Group == cashGroup {
+			continue
+		}
+		hh := []Holding{}
+		for _, h := range members[d.Group] {
+			if h.CurPrice > 0 {
+				hh = append(hh, h)
+			}
+		}
+		for _, h := range hh {
+			share := 1 / float64(len(hh))
+			if d.Value > 0 {
+				share = h.CurValue * groupShares(&h.Stock, by)[d.Group] / d.Value
+			}
+			amount := (d.Target*total/100 - d.Value) * share
+			changes = append(changes, change{h, d.Group, amount})
+			if amount > 0 {
+				buys += amount
+			}
+		}
+	}
+
+	// Sales first, as they pay for purchases
+	trades := []Trade{}
+	cashAfter := cash + opts.AddCash
+	for _, ch := range changes {
+		if ch.amount < 0 {
+			if t := tradeFor(ch.h, ch.group, ch.amount, opts); t != nil {
+				trades = append(trades, *t)
+				cashAfter += t.Amount
+			}
+		}
+	}
+
+	// Then purchases, scaled down if there is not enough cash for them
+	scale := 1.0
+	if buys > cashAfter {
+		scale = math.Max(cashAfter, 0) / buys
+	}
+	for _, ch := range changes {
+		if ch.amount > 0 {
+			if t := tradeFor(ch.h, ch.group, ch.amount*scale, opts); t != nil {
+				trades = append(trades, *t)
+				cashAfter -= t.Amount
+			}
+		}
+	}
+	return drift, trades, cashAfter
+}
+
+// Trade to change the value of a holding by an amount (in home currency),
+// in whole units after fees, or nil if too small
+func tradeFor(h Holding, group string, amount float64, opts RebalanceOptions) *Trade {
+	t := Trade{Stock: h.Stock, Group: group, Price: h.CurPrice}
+	if amount > 0 { // buy what the amount pays for, after fees
+		t.Q = math.Floor((amount - opts.Fee) / (1 + opts.FeePcnt/100) / h.CurPrice)
+	} else { // sell, but no more than is held
+		t.Q = -math.Min(math.Floor(-amount/h.CurPrice), math.Floor(h.Units))
+	}
+	value := math.Abs(t.Q) * h.CurPrice
+	if t.Q == 0 || value < opts.MinTrade {
+		return nil
+	}
+	t.Fee = opts.Fee + value*opts.FeePcnt/100
+	t.Amount = value + t.Fee
+	if t.Q < 0 {
+		t.Amount = value - t.Fee
+	}
+	return &t
+}
+
+// Rows of the form to edit targets: each group with a value or target,
+// in order of name, with a few blank rows to add new ones
+func targetRows(drift []Drift) []Drift {
+	rows := slices.Clone(drift)
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Group < rows[j].Group
+	})
+	return append(rows, Drift{}, Drift{}, Drift{})
+}
@@ -0,0 +1,293 @@
+// Risk: volatility, drawdown, risk-adjusted return and beta of the
+// portfolio and each holding, from daily or weekly returns
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Risk metrics of a holding or the whole portfolio over a window
+type Risk struct {
+	Stock       Stock     // zero for the whole portfolio
+	From        time.Time // start of the window, or first price if later
+	Return      float64   // annualized mean return, percent
+	Volatility  float64   // annualized standard deviation of returns, percent
+	MaxDrawdown float64   // largest fall from a peak, percent (negative)
+	Peak        time.Time // date of the peak before the largest fall
+	Trough      time.Time // date of the bottom of the largest fall
+	Sharpe      float64   // excess return over volatility
+	Sortino     float64   // excess return over downside volatility
+	Beta        float64   // sensitivity to the benchmark, 0 if none
+	Returns     int       // number of returns, 0 if not enough prices
+}
+
+// Options for working out risk, from the query string
+type RiskOptions struct {
+	Weekly   bool    // weekly returns, otherwise daily (weekdays)
+	Years    int     // length of window, 0 for all
+	RiskFree float64 // annual risk-free rate, percent
+	Bench    int     // ID of benchmark stock for beta, 0 for none
+	Policy   PricePolicy
+}
+
+// Show page with risk metrics of the portfolio and each holding, with
+// options in the query string
+func showRisk(c *gin.Context) {
+
+	// Get options, default benchmark is the first one
+	uid := portfolioOwner(c)
+	benchmarks := getBenchmarks(uid)
+	opts := riskOptions(c.Query, benchmarks)
+
+	// Risk of the portfolio, then each holding
+	to := today()
+	bench := adjustedSeries(uid, opts.Bench)
+	risks := []Risk{portfolioRisk(uid, to, bench, opts)}
+	for _, h := range getPortfolio(uid, to, true) {
+		risks = append(risks, stockRisk(uid, h.Stock, to, bench, opts))
+	}
+
+	// Show page
+	showPage(c, "risk.html",
+		gin.H{"risks": risks, "opts": opts, "benchmarks": benchmarks, "policy": opts.Policy,
+			"methods": priceMethods, "current": "Risk"})
+}
+
+// Get risk options from query string, defaults are weekly returns over 3
+// years, no risk-free rate, the first benchmark, and the global price
+// policy
+func riskOptions(get func(string) string, benchmarks []Stock) RiskOptions {
+	opts := RiskOptions{
+		Weekly:   get("freq") != "daily",
+		Years:    parseIntOr(get("years"), 3),
+		RiskFree: parseFloatOr(get("rf"), 0),
+		Bench:    parseIntOr(get("bench"), -1),
+		Policy:   reportPricePolicy(get),
+	}
+	if opts.Bench < 0 {
+		opts.Bench = 0
+		if len(benchmarks) > 0 {
+			opts.Bench = benchmarks[0].Id
+		}
+	}
+	return opts
+}
+
+// Risk of the whole portfolio, from its time-weighted return index (see
+// returnIndex), so money added or taken out does not count as a return
+func portfolioRisk(uid int, to time.Time, bench TimeSeries, opts RiskOptions) Risk {
+
+	// Start at the first transaction, or the start of the window
+	rates := newRates(uid)
+	cash := getAllCash(uid, to, rates)
+	if len(cash) == 0 {
+		return Risk{}
+	}
+	dates := sampleDates(windowStart(cash[0].Date, to, opts), to, opts.Weekly)
+
+	// Return index on each date, 0 on dates left out for missing prices
+	pts, _ := getValueHistory(uid, dates, opts.Policy, rates)
+	pts, _ = pricedPoints(pts, opts.Policy)
+	idx := returnIndex(pts)
+	its := TimeSeries{}
+	for i, p := range pts {
+		its = append(its, TimeSeriesPoint{p.Date, idx[i]})
+	}
+	onDate := PricePolicy{Method: PriceStrict, Days: 0}
+	return riskMetrics(dates, valuesOn(its, dates, onDate), valuesOn(bench, dates, opts.Policy), opts)
+}
+
+// Risk of one of a user's stocks, from its split-adjusted prices and the
+// benchmark's on the dates either has a price (filled forward), or the
+// last of those in each week for weekly returns
+func stockRisk(uid int, s Stock, to time.Time, bench TimeSeries, opts RiskOptions) Risk {
+	ts := adjustedSeries(uid, s.Id)
+	if len(ts) == 0 {
+		return Risk{Stock: s}
+	}
+	from := windowStart(ts[0].d, to, opts)
+	series := []TimeSeries{ts.Between(from, to)}
+	if b := bench.Between(from, to); len(b) > 0 {
+		series = append(series, b)
+	}
+	_, aligned := alignSeries(series)
+	if aligned == nil {
+		return Risk{Stock: s}
+	}
+	if opts.Weekly {
+		for i := range aligned {
+			aligned[i] = aligned[i].Resample(Weekly, ResampleLast)
+		}
+	}
+
+	// Dates and values for the metrics, and benchmark values if any
+	dates, values := []time.Time{}, []float64{}
+	var bv []float64
+	for i, pt := range aligned[0] {
+		dates = append(dates, pt.d)
+		values = append(values, pt.p)
+		if len(aligned) > 1 {
+			bv = append(bv, aligned[1][i].p)
+		}
+	}
+	r := riskMetrics(dates, values, bv, opts)
+	r.Stock = s
+	return r
+}
+
+// Split-adjusted prices of one of a user's stocks as a time series, empty
+// if no stock ID
+func adjustedSeries(uid, sid int) TimeSeries {
+	ts := TimeSeries{}
+	if sid == 0 {
+		return ts
+	}
+	for _, p := range getAdjustedPrices(uid, sid) {
+		ts = append(ts, TimeSeriesPoint{p.Date, p.Price})
+	}
+	return ts
+}
+
+// Start of the window for risk, but no earlier than the first date with
+// data
+func windowStart(first, to time.Time, opts RiskOptions) time.Time {
+	if opts.Years > 0 {
+		if from := to.AddDate(-opts.Years, 0, 0); from.After(first) {
+			return from
+		}
+	}
+	return first
+}
+
+// Dates to sample returns from one date to another: every 7 days back from
+// the last date, or every weekday
+func sampleDates(from, to time.Time, weekly bool) []time.Time {
+	dd := []time.Time{}
+	if weekly {
+		for d := to; !d.Before(from); d = d.AddDate(0, 0, -7) {
+			dd = append([]time.Time{d}, dd...)
+		}
+		return dd
+	}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if d.Weekday() != time.Saturday && d.Weekday() != time.Sunday {
+			dd = append(dd, d)
+		}
+	}
+	return dd
+}
+
+// Values in a time series on each of a list of dates using a price policy,
+// 0 before the first date in the series or if there is no value (e.g., none
+// recent enough for strict), nil if the series is empty
+func valuesOn(ts TimeSeries, dates []time.Time, policy PricePolicy) []float64 {
+	if len(ts) == 0 {
+		return nil
+	}
+	vv := []float64{}
+	for _, d := range dates {
+		if price := priceOn(ts, d, policy); price.OK && (!d.Before(ts[0].d) || sameDate(d, ts[0].d)) {
+			vv = append(vv, price.Price)
+		} else {
+			vv = append(vv, 0)
+		}
+	}
+	return vv
+}
+
+// Work out risk metrics from values on a list of dates, and benchmark
+// values on the same dates for beta (nil for none). Returns are from one
+// date to the next, leaving out any where a value is not positive (e.g.,
+// no price), and such values are not a fall from the peak.
+func riskMetrics(dates []time.Time, values, bench []float64, opts RiskOptions) Risk {
+	r := Risk{}
+	if len(dates) > 0 {
+		r.From = dates[0]
+	}
+	perYear := 260.0
+	if opts.Weekly {
+		perYear = 52
+	}
+
+	// Largest fall from a peak
+	peak := 0
+	for i, v := range values {
+		if v > values[peak] {
+			peak = i
+		}
+		if values[peak] > 0 && v > 0 {
+			if dd := (v/values[peak] - 1) * 100; dd < r.MaxDrawdown {
+				r.MaxDrawdown, r.Peak, r.Trough = dd, dates[peak], dates[i]
+			}
+		}
+	}
+
+	// Returns from one date to the next, and benchmark returns
+	rr, br := []float64{}, []float64{}
+	for i := 1; i < len(values); i++ {
+		if values[i-1] <= 0 || values[i] <= 0 {
+			continue
+		}
+		if bench != nil && (bench[i-1] <= 0 || bench[i] <= 0) {
+			continue
+		}
+		rr = append(rr, values[i]/values[i-1]-1)
+		if bench != nil {
+			br = append(br, bench[i]/bench[i-1]-1)
+		}
+	}
+	r.Returns = len(rr)
+	if len(rr) < 2 {
+		return r
+	}
+
+	// Annualized mean return and volatility, and downside volatility below
+	// the risk-free rate
+	rf := opts.RiskFree / 100 / perYear
+	mean := meanOf(rr)
+	var sumSq, downSq float64
+	for _, x := range rr {
+		sumSq += (x - mean) * (x - mean)
+		if x < rf {
+			downSq += (x - rf) * (x - rf)
+		}
+	}
+	sd := math.Sqrt(sumSq / float64(len(rr)-1))
+	down := math.Sqrt(downSq / float64(len(rr)))
+	r.Return = mean * perYear * 100
+	r.Volatility = sd * math.Sqrt(perYear) * 100
+	excess := (mean - rf) * perYear
+	if sd > 0 {
+		r.Sharpe = excess / (sd * math.Sqrt(perYear))
+	}
+	if down > 0 {
+		r.Sortino = excess / (down * math.Sqrt(perYear))
+	}
+
+	// Beta: covariance with the benchmark over its variance
+	if len(br) > 0 {
+		bmean := meanOf(br)
+		var cov, bvar float64
+		for i := range rr {
+			cov += (rr[i] - mean) * (br[i] - bmean)
+			bvar += (br[i] - bmean) * (br[i] - bmean)
+		}
+		if bvar > 0 {
+			r.Beta = cov / bvar
+		}
+	}
+	return r
+}
+
+// Mean of a list of numbers
+func meanOf(xx []float64) float64 {
+	var sum float64
+	for _, x := range xx {
+		sum += x
+	}
+	return sum / float64(len(xx))
+}
@@ -1,23 +1,56 @@
 -- schema.sql
 --
 -- Database schema for the portfolio system.
--- To create a new database:
+-- The program creates a new database, or updates an old one, from this
+-- file when it starts (see migrateDB). To create one by hand:
 -- sqlite3 data.db
 -- .read schema.sql
 -- Ctrl-D to exit
+--
+-- To add a user: ./portfolio adduser <name>
+-- Every other table has an owner_id, the user it belongs to.
+
+-- A user, who owns a portfolio
+CREATE TABLE user (
+    id integer primary key,
+    name text unique,
+    pwhash text); -- salt$hash, see hashPassword()
+create index user_name on user(name);
+
+-- A login session for a user
+CREATE TABLE session (
+    token text primary key,
+    user_id integer,
+    created text); -- RFC3339 timestamp
+
+-- A portfolio shared read-only with another user
+CREATE TABLE share (
+    owner_id integer, -- user who owns the portfolio
+    user_id integer); -- user it is shared with
+create index share_owner_id on share(owner_id);
+create index share_user_id on share(user_id);
 
 -- A stock or fund
 CREATE TABLE stock (
     id integer primary key, 
+    owner_id integer,
     code text, 
     name text, 
-    currency text);
+    currency text,
+    asset_class text default '', -- Equity, Bond, Fund, ETF, etc.
+    sector text default '',
+    region text default '', -- region or country
+    isin text default '',
+    tags text default '', -- comma separated
+    benchmark integer default 0); -- 1 if used to compare performance
 create index stock_id on stock(id);
 create index stock_code on stock(code);
+create index stock_owner_id on stock(owner_id);
 
 -- A daily price for a stock
 CREATE TABLE price (
     id integer primary key, 
+    owner_id integer,
     stock_id integer,
     pdate date,
     price float, -- in local currency (e.g., EUR)
@@ -29,14 +62,18 @@ create index price_stock_id on price(stock_id);
 -- A currency
 CREATE TABLE currency (
     id integer primary key, 
+    owner_id integer,
     code text, 
-    name text);
+    name text,
+    infer integer default 0); -- 1 to use rates inferred from prices where none is stored
 create index currency_id on currency(id);
 create index currency_code on currency(code);
+create index currency_owner_id on currency(owner_id);
 
 -- A daily rate for a currency, i.e., multiplier to get value in home currency
 CREATE TABLE currency_rate (
     id integer primary key, 
+    owner_id integer,
     currency_id integer,
     rdate date,
     rate float);
@@ -45,33 +82,98 @@ create index rate_id on currency_rate(id);
 -- A buy/sell transaction
 CREATE TABLE trans (
     id integer primary key, 
+    owner_id integer,
     stock_id integer,
     tdate date,
     q float,
     amount float,
     fees float,
+    amountx float default 0, -- amount in stock's currency, if known
+    currency text default '', -- currency of cash paid/received, blank for home
+    account text default '', -- account bought/sold in, blank for main account
+    draft integer default 0, -- proposed but not done yet, e.g., rebalancing
     comments text);
 create index trans_id on trans(id);
 create index trans_stock_id on trans(stock_id);
 
--- A dividend received for a stock, assumed to be an aggregate
--- amount (rather than per share), and in local currency (even if
--- the stock is in a foreign currency)
+-- A corporate action: split (forward or reverse), spin-off, merger
+-- or code change, applied to holdings in lots.go
+CREATE TABLE corporate_action (
+    id integer primary key,
+    owner_id integer,
+    stock_id integer,
+    adate date,
+    atype text, -- Split, Spin-off, Merger, Code change
+    ratio_old float, -- old units exchanged ...
+    ratio_new float, -- ... for new units, e.g., 1 for 4 in a split
+    new_stock_id integer, -- stock received in spin-off or merger, or 0
+    cost_fraction float, -- fraction of cost basis going to new stock
+    cash float, -- total cash received, in lieu of fractions or in merger
+    old_code text, -- codes before and after a code change
+    new_code text,
+    comments text);
+create index action_id on corporate_action(id);
+create index action_stock_id on corporate_action(stock_id);
+
+-- Target weight for a stock or group of stocks, for rebalancing
+CREATE TABLE target (
+    id integer primary key,
+    owner_id integer,
+    grouping text, -- stock, class, sector, region, currency or tag
+    grp text, -- stock code, group name, or Cash
+    weight float, -- target percentage
+    band float default 0); -- tolerance, percentage points either side
+create index target_owner_id on target(owner_id);
+
+-- An in-kind transfer of units of a stock between accounts, which moves
+-- lots with their original dates and cost, without buying or selling
+CREATE TABLE transfer (
+    id integer primary key,
+    owner_id integer,
+    stock_id integer,
+    tdate date,
+    q float, -- units moved
+    from_account text default '', -- blank for main account
+    to_account text default '',
+    comments text);
+create index transfer_id on transfer(id);
+create index transfer_stock_id on transfer(stock_id);
+
+-- A dividend received for a stock. Per share, gross, withholding and
+-- net amounts are in the stock's currency; amount is the net amount
+-- in local currency (even if the stock is in a foreign currency)
 CREATE TABLE dividend (
     id integer primary key, 
+    owner_id integer,
     stock_id integer,
     tdate date,
+    per_share float default 0,
+    gross float default 0, -- before withholding tax
+    withholding float default 0, -- foreign tax withheld
+    net float default 0, -- gross less withholding
+    fx_rate float default 1, -- multiplier to get local currency
     amount float,
+    trans_id integer default 0, -- transaction if reinvested (DRIP)
+    currency text default '', -- currency net amount paid in, blank for home
     comments text);
 create index div_id on dividend(id);
 create index div_stock_id on dividend(stock_id);
 
--- A cash transaction (does not include buy/sell as these are implicit)
+-- A cash transaction (does not include buy/sell as these are implicit).
+-- An FX conversion sells -amount of currency, and buys amount2 of currency2.
+-- A transfer moves -amount from account to account2.
 CREATE TABLE cash (
     id integer primary key, 
+    owner_id integer,
     tdate date,
-    ttype text, -- deposit, withdraw, dividend
+    ttype text, -- deposit, withdrawal, interest, fee, tax, transfer, etc.
+    account text default '', -- blank for main account
+    currency text default '', -- blank for home currency
     amount float,
+    currency2 text default '',
+    amount2 float default 0,
+    account2 text default '',
     comments text);
 create index cash_id on cash(id);
+create index cash_owner_id on cash(owner_id);
 
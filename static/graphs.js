@@ -1,7 +1,11 @@
 // Line graphs using D3
 
-// Draw a time series graph, with date on X axis and any number of series on Y
-function lineGraph(div, dates, series, labels, colours) {
+// Draw a time series graph, with date on X axis and any number of series on Y.
+// Values may be null for gaps in a series. Optional dashes gives a dash pattern
+// for each series (e.g., "4,3"), or null for a solid line. Optional markers are
+// points to mark, each with a Date, Price, Buy (true for an up triangle, false
+// for down) and Units.
+function lineGraph(div, dates, series, labels, colours, dashes, markers) {
 
     // Empty the canvas
     let cvs = d3.select(div);
@@ -19,6 +23,11 @@ function lineGraph(div, dates, series, labels, colours) {
         if ( max > yMax ) 
             yMax = max;
     }
+    markers = markers || [];
+    for ( let i = 0; i < markers.length; i++ ) {
+        if ( markers[i].Price > yMax )
+            yMax = markers[i].Price;
+    }
     
     // Append the svg object to the body of the page
     var svg = cvs
@@ -52,12 +61,27 @@ function lineGraph(div, dates, series, labels, colours) {
                 .attr("fill", "none")
                 .attr("stroke", colours[i])
                 .attr("stroke-width", 2)
+                .attr("stroke-dasharray", dashes ? dashes[i] : null)
                 .attr("d", d3.line()
+                    .defined(function(d) { return d != null })
                     .x(function(d, i) { return x(pd(dates[i])) })
                     .y(function(d) { return y(d) })
                 );
     }
 
+    // Draw markers, green up for buys, red down for sales, with a tooltip
+    for ( let i = 0; i < markers.length; i++ ) {
+        let m = markers[i];
+        svg.append("path")
+                .attr("d", d3.symbol().type(d3.symbolTriangle).size(50))
+                .attr("transform", "translate(" + x(pd(m.Date)) + "," + y(m.Price) + ")" +
+                    (m.Buy ? "" : " rotate(180)"))
+                .attr("fill", m.Buy ? "#3a3" : "#c33")
+            .append("title")
+                .text((m.Buy ? "Bought " : "Sold ") + m.Units + " on " + m.Date +
+                    " at " + m.Price.toFixed(3));
+    }
+
     // Draw legend
     let xl = margin.left + width - 150,
         yl = margin.top + 10;
@@ -65,15 +89,54 @@ function lineGraph(div, dates, series, labels, colours) {
         svg.append("line")
                 .attr("x1", xl).attr("x2", xl+20)
                 .attr("y1", yl).attr("y2", yl)
-                .attr("stroke", colours[i]);
+                .attr("stroke", colours[i])
+                .attr("stroke-dasharray", dashes ? dashes[i] : null);
         svg.append("text").text(labels[i])
                 .attr("x", xl+30).attr("y", yl+5);
         yl += 15;
     }
 }
 
+// Small line graph of values with no axes, e.g., a price trajectory, with
+// the Y range from the lowest to the highest value
+function sparklineGraph(div, values, colour) {
+
+    // Empty the canvas
+    let cvs = d3.select(div);
+    cvs.html(null);
+    let width = cvs.node().getBoundingClientRect().width,
+        height = cvs.node().getBoundingClientRect().height;
+    let svg = cvs.append("svg")
+            .attr("width", width)
+            .attr("height", height);
+
+    // Scales, with a little room for the line at the top and bottom
+    let x = d3.scaleLinear()
+        .domain([0, Math.max(values.length - 1, 1)])
+        .range([2, width - 2]);
+    let y = d3.scaleLinear()
+        .domain(d3.extent(values))
+        .range([height - 2, 2]);
+
+    // Draw the line, and a dot at the end
+    svg.append("path")
+            .datum(values)
+            .attr("fill", "none")
+            .attr("stroke", colour)
+            .attr("stroke-width", 1.5)
+            .attr("d", d3.line()
+                .x(function(d, i) { return x(i) })
+                .y(function(d) { return y(d) })
+            );
+    svg.append("circle")
+            .attr("cx", x(values.length - 1))
+            .attr("cy", y(values[values.length - 1]))
+            .attr("r", 2)
+            .attr("fill", colour);
+}
+
 // Waterfall bar graph: last number is full height, the other ones are positioned
-// vertically to stack.
+// vertically to stack, going up if positive and down if negative.
 function waterfallGraph(div, labels, values, colours) {
 
      // Empty the canvas
@@ -92,19 +155,22 @@ function waterfallGraph(div, labels, values, colours) {
                 .append("g")
                     .attr("transform", "translate(" + margin.left + "," + margin.top + ")");
 
-     // Get the height of the stacked bars, or the last bar (take the max)
-     let yMax = 0;
-     for ( let i = 0; i < values.length - 1; ++i ) {
-        yMax += values[i];
+     // Start and end of each bar: the stacked ones start where the
+     // previous one ended, the last one starts at zero
+     let starts = [], ends = [], total = 0;
+     for ( let i = 0; i < values.length; ++i ) {
+        let start = (i == values.length - 1) ? 0 : total;
+        starts.push(start);
+        ends.push(start + values[i]);
+        total = start + values[i];
      }
-     if ( values[values.length-1] > yMax ) {
-        yMax = values[values.length-1];
-     }
- 
-     // Add Y axis
+     let yMin = Math.min(0, d3.min(starts), d3.min(ends)),
+         yMax = Math.max(0, d3.max(starts), d3.max(ends));
+
+    // Add Y axis
     let y = d3.scaleLinear()
-        .domain([0, yMax])
-        .range([0, height]);
+        .domain([yMin, yMax])
+        .range([height, 0]);
     svg.append("g")
         .call(d3.axisLeft(y));
 
@@ -112,29 +178,23 @@ function waterfallGraph(div, labels, values, colours) {
     svg.append("line")
         .attr("x1", 0)
         .attr("x2", width)
-        .attr("y1", height)
-        .attr("y2", height)
+        .attr("y1", y(0))
+        .attr("y2", y(0))
         .attr("stroke", "black");
 
     // Draw each block
-    let x = margin.left, // x position of the first bar
-        dx = (width - margin.left - margin.right) / values.length, // width of each bar
-        bot = height; // bottom of the first bar
+    let x = 0, // x position of the first bar
+        dx = (width - margin.right) / values.length; // width of each bar
     for ( let i = 0; i < values.length; ++i ) {
 
-        // Last bar starts at bottom again
-        if ( i == values.length - 1 ) {
-            bot = height;
-        }
-
         // Draw block
-        let h = y(values[i]),
-            top = bot - h;
+        let top = y(Math.max(starts[i], ends[i])),
+            bot = y(Math.min(starts[i], ends[i]));
         svg.append("rect")
             .attr("x", x+10)
             .attr("y", top)
             .attr("width", dx-20)
-            .attr("height", h)
+            .attr("height", Math.max(bot - top, 1))
             .style("fill", colours[i]);
 
         // Horizontal line connecting this block with the previous
@@ -142,31 +202,195 @@ function waterfallGraph(div, labels, values, colours) {
             svg.append("line")
             .attr("x1", x - 8)
             .attr("x2", x + 8)
-            .attr("y1", bot)
-            .attr("y2", bot)
+            .attr("y1", y(ends[i-1]))
+            .attr("y2", y(ends[i-1]))
             .attr("stroke", "gray");
         }
 
         // Draw data value at top of block
-        svg.append("text").text(values[i])
+        svg.append("text").text(d3.format(",.0f")(values[i]))
             .attr("x", x + dx/2)
             .attr("y", top - 2)
             .style("font-size", 12)
             .attr("text-anchor", "middle");
 
-        // Draw label below block, centred
+        // Draw label below the graph, centred
         svg.append("text").text(labels[i])
             .attr("x", x + dx/2)
             .attr("y", height+15)
             .style("font-size", 12)
             .attr("text-anchor", "middle");
-        
-        // For a stacked waterfall, make the bottom of the next block
-        // alight with the top of this one
-        bot = top;
 
         // X position of the next block
         x += dx;
      }
 
 }
+
+// Default colours for categorical graphs (pie, treemap), repeated if there
+// are more labels than colours
+function categoryColours(n) {
+    let colours = [];
+    for ( let i = 0; i < n; ++i ) {
+        colours.push(d3.schemeTableau10[i % 10]);
+    }
+    return colours;
+}
+
+// Pie graph of values (all positive) with a label for each slice. Colours
+// are optional.
+function pieGraph(div, labels, values, colours) {
+
+    // Empty the canvas
+    let cvs = d3.select(div);
+    cvs.html(null);
+    colours = colours || categoryColours(values.length);
+
+    // Size: a circle filling the height, with room on the right for a legend
+    let width = cvs.node().getBoundingClientRect().width,
+        height = cvs.node().getBoundingClientRect().height,
+        radius = height / 2 - 10;
+
+    // Append the svg object, centred on the pie
+    let svg = cvs.append("svg")
+                    .attr("width", width)
+                    .attr("height", height)
+                .append("g")
+                    .attr("transform", "translate(" + (radius + 10) + "," + height / 2 + ")");
+
+    // Draw the slices, leaving out any that are not positive
+    let idx = d3.range(values.length).filter(function(i) { return values[i] > 0 });
+    let arcs = d3.pie().sort(null).value(function(i) { return values[i] })(idx);
+    let arc = d3.arc().innerRadius(0).outerRadius(radius);
+    svg.selectAll("path")
+        .data(arcs)
+        .enter()
+        .append("path")
+            .attr("d", arc)
+            .attr("fill", function(a) { return colours[a.data] })
+            .attr("stroke", "white")
+        .append("title")
+            .text(function(a) { return labels[a.data] + ": " + values[a.data].toFixed(2) });
+
+    // Draw legend
+    let total = d3.sum(idx, function(i) { return values[i] }),
+        xl = radius + 30,
+        yl = -radius + 10;
+    for ( let i of idx ) {
+        svg.append("rect")
+            .attr("x", xl).attr("y", yl - 9)
+            .attr("width", 12).attr("height", 12)
+            .style("fill", colours[i]);
+        svg.append("text")
+            .text(labels[i] + " (" + (values[i] / total * 100).toFixed(1) + "%)")
+            .attr("x", xl + 18).attr("y", yl + 2)
+            .style("font-size", 12);
+        yl += 18;
+    }
+}
+
+// Treemap of values (all positive): rectangles with areas proportional to
+// each value, labelled where there is room. Colours are optional.
+function treemapGraph(div, labels, values, colours) {
+
+    // Empty the canvas
+    let cvs = d3.select(div);
+    cvs.html(null);
+    colours = colours || categoryColours(values.length);
+
+    // Size
+    let width = cvs.node().getBoundingClientRect().width,
+        height = cvs.node().getBoundingClientRect().height;
+
+    // Append the svg object
+    let svg = cvs.append("svg")
+        .attr("width", width)
+        .attr("height", height);
+
+    // Lay out the rectangles, leaving out any values that are not positive
+    let children = [];
+    for ( let i = 0; i < values.length; ++i ) {
+        if ( values[i] > 0 )
+            children.push({ i: i, value: values[i] });
+    }
+    let root = d3.hierarchy({ children: children })
+        .sum(function(d) { return d.value })
+        .sort(function(a, b) { return b.value - a.value });
+    d3.treemap().size([width, height]).padding(2)(root);
+
+    // Draw each rectangle, with its label and percentage if it fits
+    let total = root.value;
+    for ( let leaf of root.leaves() ) {
+        let i = leaf.data.i,
+            w = leaf.x1 - leaf.x0,
+            h = leaf.y1 - leaf.y0;
+        svg.append("rect")
+            .attr("x", leaf.x0).attr("y", leaf.y0)
+            .attr("width", w).attr("height", h)
+            .style("fill", colours[i])
+            .append("title")
+                .text(labels[i] + ": " + values[i].toFixed(2));
+        if ( w > 60 && h > 30 ) {
+            svg.append("text").text(labels[i])
+                .attr("x", leaf.x0 + 4).attr("y", leaf.y0 + 14)
+                .style("font-size", 12).style("fill", "white");
+            svg.append("text").text((values[i] / total * 100).toFixed(1) + "%")
+                .attr("x", leaf.x0 + 4).attr("y", leaf.y0 + 28)
+                .style("font-size", 12).style("fill", "white");
+        }
+    }
+}
+
+// Heatmap of a square matrix of correlations (-1 to 1), with the same labels
+// on both axes. Null values (e.g., not enough data) are shown grey.
+function heatmapGraph(div, labels, matrix) {
+
+    // Empty the canvas
+    let cvs = d3.select(div);
+    cvs.html(null);
+
+    // Size: square cells filling the width, with room for labels
+    let margin = { top: 60, left: 80 },
+        n = labels.length,
+        width = cvs.node().getBoundingClientRect().width,
+        size = Math.min(60, (width - margin.left) / n);
+
+    // Append the svg object
+    let svg = cvs.append("svg")
+        .attr("width", width)
+        .attr("height", margin.top + n * size + 10);
+
+    // Red for positive correlation, blue for negative
+    let colour = d3.scaleSequential(d3.interpolateRdBu).domain([1, -1]);
+
+    // Labels across the top and down the side
+    for ( let i = 0; i < n; ++i ) {
+        svg.append("text").text(labels[i])
+            .attr("transform", "translate(" + (margin.left + i * size + size / 2) + "," + (margin.top - 6) + ") rotate(-45)")
+            .style("font-size", 12);
+        svg.append("text").text(labels[i])
+            .attr("x", margin.left - 6).attr("y", margin.top + i * size + size / 2 + 4)
+            .attr("text-anchor", "end")
+            .style("font-size", 12);
+    }
+
+    // Each cell, with its value if there is room
+    for ( let i = 0; i < n; ++i ) {
+        for ( let j = 0; j < n; ++j ) {
+            let v = matrix[i][j];
+            svg.append("rect")
+                .attr("x", margin.left + j * size).attr("y", margin.top + i * size)
+                .attr("width", size - 1).attr("height", size - 1)
+                .style("fill", v == null ? "#ddd" : colour(v))
+                .append("title")
+                    .text(labels[i] + " / " + labels[j] + ": " + (v == null ? "not enough data" : v.toFixed(2)));
+            if ( v != null && size >= 30 ) {
+                svg.append("text").text(v.toFixed(2))
+                    .attr("x", margin.left + j * size + size / 2).attr("y", margin.top + i * size + size / 2 + 4)
+                    .attr("text-anchor", "middle")
+                    .style("font-size", 11)
+                    .style("fill", Math.abs(v) > 0.6 ? "white" : "black");
+            }
+        }
+    }
+}
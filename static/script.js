@@ -25,12 +25,14 @@ function openTab(evt, tabName) {
   	evt.currentTarget.className += " is-active";
 }
 
-// Fetch prices and draw graph
-async function get_prices(sid) {
+// Fetch prices and draw graph: split-adjusted prices as a solid line, so
+// there is no cliff at a split, and raw prices before each split dotted,
+// with optional markers for buys and sells (see lineGraph)
+async function get_prices(sid, markers) {
 	
 	try {
     		// Get data
-      	const response = await fetch("/get_prices/" + sid);
+      	const response = await fetch("/get_prices/" + sid + "?view=both");
       	if (!response.ok) {
         		throw new Error(`Response status: ${response.status}`);
       	}
@@ -39,18 +41,29 @@ async function get_prices(sid) {
       	const data = await response.json();
 		
       
-      	// Convert to lists of dates and values
-      	var dates = [], prices = [];
+      	// Convert to lists of dates and values, raw prices only before splits
+      	var dates = [], adjusted = [], raw = [], splits = false;
       	for ( var i = 0; i < data.length; ++i ) {
         		let d = data[i].Date;
         		if ( d.length > 10 )   // Convert "2018-10-01T00:00:00Z" to just date
           		d = d.substr(0, 10);
         		dates.push(d);
-        		prices.push(data[i].Price);
+        		adjusted.push(data[i].Adjusted);
+        		if ( data[i].Factor != 1 ) {
+          		raw.push(data[i].Price);
+          		splits = true;
+        		} else {
+          		raw.push(null);
+        		}
       	}
       
       	// Show graph
-      	lineGraph("#graph", dates, [prices], [], ["#008"]);
+      	if ( splits ) {
+        		lineGraph("#graph", dates, [adjusted, raw], ["Split-adjusted", "Before split"],
+          		["#008", "#888"], [null, "4,3"], markers);
+      	} else {
+        		lineGraph("#graph", dates, [adjusted], [], ["#008"], null, markers);
+      	}
       
     } catch (error) {
       	console.error(error.message);
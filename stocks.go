@@ -4,9 +4,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"slices"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,48 +16,126 @@ import (
 //                             STOCKS                              //
 //-----------------------------------------------------------------//
 
-// Show list of all stocks
+// Show list of all stocks, optionally filtered by classifications in
+// the query string, e.g., "?class=Bond&region=Europe"
 func showStocks(c *gin.Context) {
 
-	// Get a list of all stocks, including not held
-	today := time.Now()
-	holdings := getPortfolio(today, false)
+	// Get filter from query string
+	filter := map[string]string{}
+	for _, gr := range groupings {
+		filter[gr.Key] = c.Query(gr.Key)
+	}
+
+	// Get a list of all stocks, including not held, that match the
+	// filter, as of the date asked for
+	uid := portfolioOwner(c)
+	asOf := getAsOf(c)
+	holdings := []Holding{}
+	for _, h := range getPortfolioWith(uid, asOf.Date, false, asOf.Policy) {
+		if stockMatches(&h.Stock, filter) {
+			holdings = append(holdings, h)
+		}
+	}
+
+	// Cards for stocks held, if asked for
+	view := c.Query("view")
+	cards := []HoldingCard{}
+	if view == "cards" {
+		rates := newRates(uid)
+		for _, h := range holdings {
+			if h.Units > 0 {
+				cards = append(cards, getHoldingCard(uid, h, asOf.Date, rates))
+			}
+		}
+	}
 
 	// Show page
-	c.HTML(http.StatusOK, "stocks.html",
-		gin.H{"holdings": holdings, "menu": menu, "current": "Stocks"})
+	showPage(c, "stocks.html",
+		gin.H{"holdings": holdings, "cards": cards, "view": view, "groupings": groupings,
+			"filter": filter, "options": groupOptions(getStocks(uid)), "asof": asOf,
+			"policy": asOf.Policy, "methods": priceMethods, "home": homeCurrency, "current": "Stocks"})
 }
 
 // Page to show one stock
 func showStock(c *gin.Context) {
 
 	// Parse the ID and get the stock
+	uid := portfolioOwner(c)
 	sid := parseInt(c.Param("id"))
-	s := getStock(sid)
+	s := getStock(uid, sid)
 	if s == nil {
-		c.String(http.StatusOK, fmt.Sprintf("Stock %d not found", sid))
+		c.String(http.StatusNotFound, fmt.Sprintf("Stock %d not found", sid))
 		return
 	}
 
-	// Get all transactions, dividends and prices for this stock
-	prices := getPrices(sid)
-	transactions := getTransactions(sid)
-	dividends := getDividends(sid)
+	// Get all transactions, dividends, corporate actions, transfers and
+	// prices for this stock, and split-adjusted prices if there were any
+	// splits
+	prices := getPrices(uid, sid)
+	transactions := getTransactions(uid, sid)
+	dividends := getDividends(uid, sid)
+	actions := getActions(uid, sid)
+	transfers := getTransfers(uid, sid)
+	var adjusted []Price
+	for _, a := range actions {
+		if a.Type == ActionSplit && a.Stock == sid {
+			adjusted = getAdjustedPrices(uid, sid)
+			break
+		}
+	}
+
+	// Names of other stocks, for spin-offs and mergers
+	names := map[int]string{}
+	for _, s := range getStocks(uid) {
+		names[s.Id] = s.Code
+	}
+
+	// Count up the number of units held, and the lots in each account
+	var units float64
+	lots := []Lot{}
+	if p, ok := getPositions(uid, today())[sid]; ok {
+		units = p.Units()
+		lots = p.Lots
+	}
+
+	// History with running position, and buys and sells to mark on the
+	// graph at split-adjusted prices
+	ledger := getStockLedger(uid, sid, reportPricePolicy(c.Query))
+	markers := []TradeMarker{}
+	for _, e := range ledger {
+		if (e.Type == "Buy" || e.Type == "Sell") && e.Units != 0 {
+			price := math.Abs(e.Amount/e.Units) / splitFactor(actions, sid, e.Date)
+			markers = append(markers, TradeMarker{Date: formatDate(e.Date), Price: price,
+				Buy: e.Type == "Buy", Units: math.Abs(e.Units)})
+		}
+	}
 
-	// Count up the number of units held
-	units := unitsHeld(sid, today())
+	// Risk with default options (see the Risk page to change them)
+	opts := riskOptions(c.Query, getBenchmarks(uid))
+	risk := stockRisk(uid, *s, today(), adjustedSeries(uid, opts.Bench), opts)
 
 	// Show page
-	c.HTML(http.StatusOK, "stock.html",
+	showPage(c, "stock.html",
 		gin.H{"s": s, "transactions": transactions, "units": units,
-			"prices": prices, "dividends": dividends, "home": homeCurrency,
-			"menu": menu, "current": "Stocks"})
+			"prices": prices, "adjusted": adjusted, "dividends": dividends,
+			"actions": actions, "transfers": transfers, "lots": lots, "names": names,
+			"ledger": ledger, "markers": markers, "risk": risk, "opts": opts,
+			"home": homeCurrency, "current": "Stocks"})
+}
+
+// A buy or sell to mark on the price graph
+type TradeMarker struct {
+	Date  string  // yyyy-mm-dd
+	Price float64 // split-adjusted price per unit
+	Buy   bool    // otherwise a sale
+	Units float64
 }
 
 // Show form to edit a stock (including a new one)
 func editStock(c *gin.Context) {
 
 	// Get stock ID (will be 0 to add an stock)
+	uid := portfolioOwner(c)
 	sid := parseInt(c.Param("id"))
 	if sid < 0 {
 		c.String(http.StatusOK, "Invalid stock ID")
@@ -66,7 +145,7 @@ func editStock(c *gin.Context) {
 	// Get the stock or create "blank" stock
 	s := &Stock{}
 	if sid > 0 {
-		s = getStock(sid)
+		s = getStock(uid, sid)
 		if s == nil {
 			c.String(http.StatusOK, "Stock not found")
 			return
@@ -74,15 +153,15 @@ func editStock(c *gin.Context) {
 	}
 
 	// Show the form to edit stock
-	c.HTML(http.StatusOK, "edit_stock.html",
-		gin.H{"s": s, "currencies": currencies,
-			"menu": menu, "current": "Stocks"})
+	showPage(c, "edit_stock.html",
+		gin.H{"s": s, "currencies": currencies, "classes": assetClasses, "current": "Stocks"})
 }
 
 // Process form to update or add an stock
 func saveStock(c *gin.Context) {
 
 	// Get stock ID (will be 0 to add a stock)
+	uid := portfolioOwner(c)
 	sid_, ok := c.GetPostForm("id")
 	if !ok {
 		c.String(http.StatusOK, "saveStock: Missing stock ID")
@@ -97,7 +176,7 @@ func saveStock(c *gin.Context) {
 	// Get the stock or create "blank" stock
 	s := &Stock{}
 	if sid > 0 {
-		s = getStock(sid)
+		s = getStock(uid, sid)
 		if s == nil {
 			c.String(http.StatusOK, "saveStock: stock not found")
 			return
@@ -108,6 +187,12 @@ func saveStock(c *gin.Context) {
 	s.Code, _ = c.GetPostForm("code")
 	s.Name, _ = c.GetPostForm("name")
 	s.Currency, _ = c.GetPostForm("currency")
+	s.AssetClass = strings.TrimSpace(c.PostForm("asset_class"))
+	s.Sector = strings.TrimSpace(c.PostForm("sector"))
+	s.Region = strings.TrimSpace(c.PostForm("region"))
+	s.ISIN = strings.ToUpper(strings.TrimSpace(c.PostForm("isin")))
+	s.Tags = strings.Join((&Stock{Tags: c.PostForm("tags")}).TagList(), ", ")
+	_, s.Benchmark = c.GetPostForm("benchmark")
 
 	// Some validation
 	s.Code = strings.TrimSpace(s.Code)
@@ -117,9 +202,17 @@ func saveStock(c *gin.Context) {
 		c.String(http.StatusOK, "Invalid inputs: cannot be blank")
 		return
 	}
+	if s.AssetClass != "" && !slices.Contains(assetClasses, s.AssetClass) {
+		c.String(http.StatusOK, "Invalid inputs: unknown asset class")
+		return
+	}
+	if s.ISIN != "" && !validISIN(s.ISIN) {
+		c.String(http.StatusOK, "Invalid inputs: ISIN must be 2 letters, 9 letters or digits, and a check digit")
+		return
+	}
 
 	// Create or update person database
-	addUpdateStock(s)
+	addUpdateStock(uid, s)
 
 	// Go back to stocks page or list
 	if sid == 0 {
@@ -129,124 +222,81 @@ func saveStock(c *gin.Context) {
 	}
 }
 
-// Form to split stock
-func splitStock(c *gin.Context) {
+// Delete stock: show form to ask for confirmation first, which
+// posts to doDeleteStock()
+func delStock(c *gin.Context) {
 
 	// Get the stock (URL positional param)
+	uid := portfolioOwner(c)
 	sid := parseInt(c.Param("id"))
-	s := getStock(sid)
+	s := getStock(uid, sid)
 	if sid <= 0 || s == nil {
 		c.String(http.StatusOK, "Stock not found")
 		return
 	}
 
-	// Get current quantity and price
-	d := today()
-	units := unitsHeld(sid, d)
-	price := stockValue(sid, d)
-
-	// Show the form to split stock
-	c.HTML(http.StatusOK, "split_stock.html",
-		gin.H{"s": s, "q": units, "p": price, "d": d,
-			"menu": menu, "current": "Stocks"})
+	// Ask for confirmation
+	showPage(c, "del_stock.html", gin.H{"s": s, "current": "Stocks"})
 }
 
-// Execute stock split: creates a transaction to adjust the
-// quantity at zero price, and creates an adjusted price based
-// on current price
-func doSplit(c *gin.Context) {
-
-	// Get stock ID
-	sid_, ok := c.GetPostForm("id")
-	if !ok {
-		c.String(http.StatusNotFound, "doSplit: Missing stock ID")
-		return
-	}
-
-	// Get the stock
-	sid := parseInt(sid_)
-	s := getStock(sid)
-	if s == nil {
-		c.String(http.StatusNotFound, "doSplit: stock not found")
-		return
-	}
-
-	// Get quantity and date from form inputs
-	newQ_, _ := c.GetPostForm("q")
-	date_, _ := c.GetPostForm("date")
-	newQ := parseFloat(newQ_)
-	date := parseDate(date_)
-	if newQ < 1 || !validDate(date) {
-		c.String(http.StatusNotFound, "doSplit: invalid inputs")
-		return
-	}
-
-	// Get current quantity on date, calculate adjustment
-	curQ := unitsHeld(sid, date)
-	adj := newQ - curQ
-	if curQ == 0 || adj == 0.0 {
-		c.String(http.StatusNotFound, "doSplit: no change in units")
-		return
-	}
-
-	// Create transaction to adjust quantity, amount and fees are zero
-	// TODO: add comments to transaction
-	cmt := fmt.Sprintf("%s: %.3f split to %.3f => delta %.3f\n",
-		formatDate(date), curQ, newQ, adj)
-	t := Transaction{Stock: sid, Date: date, Q: adj, Comments: cmt}
-	addUpdateTransaction(&t)
-
-	// Create split-adjusted price
-	curP := stockValue(sid, date)
-	tVal := curP * curQ
-	newP := tVal / newQ
-	cmt = fmt.Sprintf("%.3f split on %s to %.3f : price %.3f => %.3f",
-		curQ, formatDate(date), newQ, curP, newP)
-	p := Price{Stock: sid, Date: date, Price: newP, Comments: cmt}
-	addUpdatePrice(&p)
-
-	// Go back to stocks page
-	c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", sid))
-}
-
-// Delete stock: ask for confirmation first
-func delStock(c *gin.Context) {
+// Delete stock, after confirmation
+func doDeleteStock(c *gin.Context) {
 
 	// Get the stock (URL positional param)
+	uid := portfolioOwner(c)
 	sid := parseInt(c.Param("id"))
-	s := getStock(sid)
+	s := getStock(uid, sid)
 	if sid <= 0 || s == nil {
-		c.String(http.StatusOK, "Stock not found")
+		c.String(http.StatusNotFound, "Stock not found")
 		return
 	}
 
-	// Ask for confirmation, or go ahead and delete if confirmed
-	confirm, _ := c.GetQuery("confirm")
-	if confirm == "" { // no confirmation, show form
-		c.HTML(http.StatusOK, "del_stock.html",
-			gin.H{"s": s, "menu": menu, "current": "Stocks"})
-	} else if confirm == "yes" { // confirmed, delete stock
-		deleteStock(sid)
-		c.Redirect(http.StatusFound, "/Stocks")
-	} else { // confirmation denied, back to stock page
-		c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", sid))
-	}
+	// Delete stock and go back to list of stocks
+	deleteStock(uid, sid)
+	c.Redirect(http.StatusFound, "/Stocks")
 }
 
-// Get list of prices for a stock, for graph on the stock page
+// Get list of prices for a stock, for graph on the stock page. The
+// "view" query parameter selects raw prices as recorded (the default),
+// split-adjusted prices, or "both", which gives each raw price with its
+// adjusted price and the split factor between them.
 func getPricesJSON(c *gin.Context) {
 
 	// Get stock
+	uid := portfolioOwner(c)
 	sid := parseInt(c.Param("sid"))
-	s := getStock(sid)
+	s := getStock(uid, sid)
 	if s == nil {
 		c.String(http.StatusNotFound, "Stock not found")
 		return
 	}
 
-	// Get prices and return as JSON
-	prices := getPrices(sid)
-	c.IndentedJSON(http.StatusOK, prices)
+	// Get prices in the view requested and return as JSON
+	switch c.DefaultQuery("view", "raw") {
+	case "raw":
+		c.IndentedJSON(http.StatusOK, getPrices(uid, sid))
+	case "adjusted":
+		c.IndentedJSON(http.StatusOK, getAdjustedPrices(uid, sid))
+	case "both":
+		actions := getActions(uid, sid)
+		prices := []PriceView{}
+		for _, p := range getPrices(uid, sid) {
+			f := splitFactor(actions, sid, p.Date)
+			prices = append(prices, PriceView{Price: p, Adjusted: p.Price / f,
+				AdjustedX: p.PriceX / f, Factor: f})
+		}
+		c.IndentedJSON(http.StatusOK, prices)
+	default:
+		c.String(http.StatusBadRequest, "View must be raw, adjusted or both")
+	}
+}
+
+// A raw price with its split-adjusted equivalent, for the price graph
+type PriceView struct {
+	Price
+	Adjusted  float64 // split-adjusted price in local currency
+	AdjustedX float64 // split-adjusted price in the stock's currency
+	Factor    float64 // raw price divided by adjusted, 1 after the last split
 }
 
 //-----------------------------------------------------------------//
@@ -256,10 +306,10 @@ func getPricesJSON(c *gin.Context) {
 // Edit/create a transaction for a stock. Edits the transaction if an ID
 // is provided. If zero, adds a transaction for the stock ID expected in
 // the query string.
-// Show form to edit a stock (including a new one)
 func editTransaction(c *gin.Context) {
 
 	// Get transaction ID (will be 0 to add)
+	uid := portfolioOwner(c)
 	tid := parseInt(c.Param("tid"))
 	if tid < 0 {
 		c.String(http.StatusNotFound, "Invalid transaction ID")
@@ -278,9 +328,9 @@ func editTransaction(c *gin.Context) {
 			c.String(http.StatusNotFound, "Missing stock ID, required for adding transaction")
 			return
 		}
-		t = &Transaction{Stock: sid, Date: lastTransDate}
+		t = &Transaction{Stock: sid, Date: lastTransDate(uid)}
 	} else {
-		t = getTransaction(tid)
+		t = getTransaction(uid, tid)
 		if t == nil {
 			c.String(http.StatusNotFound, fmt.Sprintf("Transaction %d not found", tid))
 			return
@@ -289,21 +339,23 @@ func editTransaction(c *gin.Context) {
 	}
 
 	// Get the stock as well
-	s := getStock(sid)
+	s := getStock(uid, sid)
 	if s == nil {
 		c.String(http.StatusNotFound, "Stock not found")
 		return
 	}
 
 	// Show the form to edit transaction
-	c.HTML(http.StatusOK, "edit_transaction.html",
-		gin.H{"t": t, "s": s, "menu": menu, "current": "Stocks"})
+	showPage(c, "edit_transaction.html",
+		gin.H{"t": t, "s": s, "home": homeCurrency, "accounts": getAccounts(uid),
+			"current": "Stocks"})
 }
 
 // Process form to update or add a transaction
 func saveTransaction(c *gin.Context) {
 
 	// Get transaction and stock ID (tid will be 0 to add)
+	uid := portfolioOwner(c)
 	tid_, ok1 := c.GetPostForm("tid")
 	sid_, ok2 := c.GetPostForm("sid")
 	tid := parseInt(tid_)
@@ -313,10 +365,17 @@ func saveTransaction(c *gin.Context) {
 		return
 	}
 
+	// Make sure the stock belongs to this user
+	s := getStock(uid, sid)
+	if s == nil {
+		c.String(http.StatusNotFound, "saveTransaction: stock not found")
+		return
+	}
+
 	// Get the transaction or create a "blank" one
 	t := &Transaction{Id: tid, Stock: sid}
 	if tid > 0 {
-		t = getTransaction(tid)
+		t = getTransaction(uid, tid)
 		if t == nil {
 			c.String(http.StatusNotFound, "saveTransaction: not found")
 			return
@@ -332,19 +391,28 @@ func saveTransaction(c *gin.Context) {
 	t.Amount = parseFloat(amount)
 	fees, _ := c.GetPostForm("fees")
 	t.Fees = parseFloat(fees)
+	t.AmountX = parseFloatOr(c.PostForm("amountx"), 0)
+	t.Currency = settlementCurrency(c.PostForm("currency"), s)
+	t.Account = strings.TrimSpace(c.PostForm("account"))
+	_, t.Draft = c.GetPostForm("draft")
 	t.Comments, _ = c.GetPostForm("comments")
 
-	// Convert and validate fields, not that zero amount is allowed because of stock splits
-	if t.Date.Year() < 2000 || t.Q <= 0 || t.Amount < 0 || t.Fees < 0 {
+	// Convert and validate fields, note that zero amount is allowed (e.g., for
+	// shares received as a gift), and negative units are a sale
+	if t.Date.Year() < 2000 || t.Q == 0 || t.Amount < 0 || t.Fees < 0 || t.AmountX < 0 {
 		c.String(http.StatusOK, "Invalid inputs")
 		return
 	}
+	if t.Currency != "" && t.AmountX == 0 && t.Amount != 0 {
+		c.String(http.StatusOK, "Invalid inputs: amount in "+s.Currency+" required if paid in "+s.Currency)
+		return
+	}
 
 	// Create or update person database
-	addUpdateTransaction(t)
+	addUpdateTransaction(uid, t)
 
 	// Remember the last transaction date for next entry
-	lastTransDate = t.Date
+	setLastTransDate(uid, t.Date)
 
 	// Go back to stock page
 	c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", sid))
@@ -360,6 +428,7 @@ func saveTransaction(c *gin.Context) {
 func editDividend(c *gin.Context) {
 
 	// Get dividend ID (will be 0 to add)
+	uid := portfolioOwner(c)
 	did := parseInt(c.Param("did"))
 	if did < 0 {
 		c.String(http.StatusNotFound, "Invalid dividend ID")
@@ -378,10 +447,10 @@ func editDividend(c *gin.Context) {
 			c.String(http.StatusNotFound, "Missing stock ID, required for adding dividend")
 			return
 		}
-		d = &Dividend{Stock: sid, Date: lastTransDate} // TODO: why not just reuse blank dividend?
+		d = &Dividend{Stock: sid, Date: lastTransDate(uid)} // TODO: why not just reuse blank dividend?
 		d.Comments = "From statement"
 	} else {
-		d = getDividend(did)
+		d = getDividend(uid, did)
 		if d == nil {
 			c.String(http.StatusNotFound, fmt.Sprintf("Dividend %d not found", did))
 			return
@@ -390,21 +459,32 @@ func editDividend(c *gin.Context) {
 	}
 
 	// Get the stock as well
-	s := getStock(sid)
+	s := getStock(uid, sid)
 	if s == nil {
 		c.String(http.StatusNotFound, "Stock not found")
 		return
 	}
 
+	// Units held on the dividend date, and units bought if reinvested
+	units := unitsHeld(uid, sid, d.Date)
+	var dripQ float64
+	if d.Trans > 0 {
+		if t := getTransaction(uid, d.Trans); t != nil {
+			dripQ = t.Q
+		}
+	}
+
 	// Show the form to edit dividend
-	c.HTML(http.StatusOK, "edit_dividend.html",
-		gin.H{"d": d, "s": s, "menu": menu, "current": "Stocks"})
+	showPage(c, "edit_dividend.html",
+		gin.H{"d": d, "s": s, "units": units, "dripQ": dripQ,
+			"home": homeCurrency, "current": "Stocks"})
 }
 
 // Process form to update or add a transaction
 func saveDividend(c *gin.Context) {
 
 	// Get dividend and stock ID (did will be 0 to add)
+	uid := portfolioOwner(c)
 	did_, ok1 := c.GetPostForm("did")
 	sid_, ok2 := c.GetPostForm("sid")
 	did := parseInt(did_)
@@ -414,35 +494,144 @@ func saveDividend(c *gin.Context) {
 		return
 	}
 
+	// Make sure the stock belongs to this user
+	s := getStock(uid, sid)
+	if s == nil {
+		c.String(http.StatusNotFound, "saveDividend: stock not found")
+		return
+	}
+
 	// Get the dividend or create a "blank" one
 	d := &Dividend{Id: did, Stock: sid}
 	if did > 0 {
-		d = getDividend(did)
+		d = getDividend(uid, did)
 		if d == nil {
 			c.String(http.StatusNotFound, "saveDividend: not found")
 			return
 		}
 	}
 
-	// Update the dividend with the form inputs
+	// Update the dividend with the form inputs, blank numbers are zero
 	ds, _ := c.GetPostForm("date")
-	amount, _ := c.GetPostForm("amount")
+	d.Date = parseDate(ds)
+	d.PerShare = parseFloatOr(c.PostForm("per_share"), 0)
+	d.Gross = parseFloatOr(c.PostForm("gross"), 0)
+	d.Withholding = parseFloatOr(c.PostForm("withholding"), 0)
+	d.Net = parseFloatOr(c.PostForm("net"), 0)
+	d.FxRate = parseFloatOr(c.PostForm("fx_rate"), 0)
+	d.Amount = parseFloatOr(c.PostForm("amount"), 0)
+	d.Currency = settlementCurrency(c.PostForm("currency"), s)
 	d.Comments, _ = c.GetPostForm("comments")
 
-	// Convert and validate fields
-	d.Date = parseDate(ds)
-	d.Amount = parseFloat(amount)
-	if !validDate(d.Date) || d.Amount <= 0 {
+	// Fill in amounts that can be derived from the others
+	completeDividend(d, unitsHeld(uid, sid, d.Date), s.Currency == homeCurrency)
+
+	// Validate fields
+	if !validDate(d.Date) || d.Amount <= 0 || d.PerShare < 0 || d.Gross < 0 ||
+		d.Withholding < 0 || d.Net < 0 || d.FxRate <= 0 || d.Withholding > d.Gross {
 		c.String(http.StatusOK, "Invalid inputs")
 		return
 	}
+	if d.Currency != "" && d.Net <= 0 {
+		c.String(http.StatusOK, "Invalid inputs: net amount required if paid in "+s.Currency)
+		return
+	}
+
+	// If reinvested, create or update the transaction that buys the units,
+	// otherwise remove any such transaction
+	if _, reinvest := c.GetPostForm("reinvest"); reinvest {
+		q := parseFloat(c.PostForm("drip_q"))
+		if q <= 0 {
+			c.String(http.StatusOK, "Invalid inputs: units bought must be positive")
+			return
+		}
+		t := &Transaction{Stock: sid}
+		if d.Trans > 0 {
+			if t = getTransaction(uid, d.Trans); t == nil {
+				t = &Transaction{Stock: sid}
+			}
+		}
+		t.Date, t.Q, t.Amount, t.Fees = d.Date, q, d.Amount, 0
+		t.Currency, t.AmountX = d.Currency, 0
+		if d.Currency != "" {
+			t.AmountX = d.Net
+		}
+		t.Comments = "Dividend reinvested"
+		addUpdateTransaction(uid, t)
+		d.Trans = t.Id
+	} else if d.Trans > 0 {
+		deleteTransaction(uid, d.Trans)
+		d.Trans = 0
+	}
 
 	// Create or update person database
-	addUpdateDividend(d)
+	addUpdateDividend(uid, d)
 
 	// Remember the last transaction date for next entry
-	lastTransDate = d.Date
+	setLastTransDate(uid, d.Date)
 
 	// Go back to stock page
 	c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", sid))
 }
+
+// Fill in the amounts of a dividend that can be derived from those entered,
+// given units held on the date and whether the stock is in home currency.
+// Amounts entered are left unchanged.
+func completeDividend(d *Dividend, units float64, home bool) {
+
+	// Gross from per share or net, and per share from gross
+	if d.Gross == 0 && d.PerShare > 0 {
+		d.Gross = d.PerShare * units
+	} else if d.Gross == 0 && d.Net > 0 {
+		d.Gross = d.Net + d.Withholding
+	}
+	if d.PerShare == 0 && d.Gross > 0 && units > 0 {
+		d.PerShare = d.Gross / units
+	}
+
+	// Net from gross less withholding
+	if d.Net == 0 && d.Gross > 0 {
+		d.Net = d.Gross - d.Withholding
+	}
+
+	// Exchange rate is 1 in home currency, otherwise implied by amounts
+	// in both currencies if not given
+	if home {
+		d.FxRate = 1
+	} else if d.FxRate == 0 && d.Amount > 0 && d.Net > 0 {
+		d.FxRate = d.Amount / d.Net
+	} else if d.FxRate == 0 && d.Net == 0 {
+		d.FxRate = 1 // only home currency amount given
+	}
+
+	// Amount in home currency from net
+	if d.Amount == 0 && d.Net > 0 {
+		d.Amount = d.Net * d.FxRate
+	}
+}
+
+// Currency that cash for a stock's transaction or dividend was paid or
+// received in, from a form input: blank for home currency, otherwise
+// only the stock's own currency is allowed
+func settlementCurrency(cur string, s *Stock) string {
+	if cur == s.Currency && cur != homeCurrency {
+		return cur
+	}
+	return ""
+}
+
+// Check the format of an ISIN: country code, 9 letters or digits, and a
+// check digit (not verified)
+func validISIN(isin string) bool {
+	if len(isin) != 12 {
+		return false
+	}
+	for i, ch := range isin {
+		letter := ch >= 'A' && ch <= 'Z'
+		digit := ch >= '0' && ch <= '9'
+		if (i < 2 && !letter) || (i == 11 && !digit) || (!letter && !digit) {
+			return false
+		}
+	}
+	return true
+}
@@ -3,7 +3,10 @@
 package main
 
 import (
-	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -26,13 +29,11 @@ func parseDate(ds string) time.Time {
 	// If there is a space, ditch everything after the space
 	if len(ds) > 10 && (ds[10] == ' ' || ds[10] == 'T') {
 		ds = ds[:10]
-		//fmt.Println("ds shorted to", ds)
 	}
 
 	// Parse time and return it
 	t, err := time.Parse("2006-01-02", ds)
 	if err != nil {
-		fmt.Println("Invalid date: ", ds)
 		return InvalidDate
 	}
 	return t
@@ -63,15 +64,8 @@ func latestPriceAt(ts TimeSeries, on time.Time) float64 {
 		return 0
 	}
 
-	// Search for last price before requested date
-	p := ts[0].p
-	for i := 1; i < len(ts); i++ {
-		if ts[i].d.After(on) {
-			return p
-		}
-		p = ts[i].p
-	}
-	return p
+	// Last price on or before requested date, or the first
+	return ts[max(ts.after(on)-1, 0)].p
 }
 
 // Get price on a certain date, using first date if before, last date if after,
@@ -84,39 +78,106 @@ func priceOnInterpolate(ts TimeSeries, on time.Time) float64 {
 		return 0
 	}
 
-	// Return first price if on or before first date
-	if earlier(on, ts[0].d) || sameDate(on, ts[0].d) {
+	// Return first price if before first date, last price if on or after
+	// last date, and price on the date if there is one
+	i := ts.after(on)
+	if i == 0 {
 		return ts[0].p
 	}
+	if i == len(ts) || sameDate(ts[i-1].d, on) {
+		return ts[i-1].p
+	}
+
+	// Otherwise interpolate between the prices before and after
+	d0 := ts[i-1].d                // date before
+	p0 := ts[i-1].p                // price before
+	d1 := ts[i].d                  // date after
+	p1 := ts[i].p                  // price after
+	interval := d1.Sub(d0).Hours() // interval between time series dates
+	delta := on.Sub(d0).Hours()    // interval between earlier date and target
+	return p0 + (p1-p0)*(delta/interval)
+}
+
+// Ways to find the price on a date from a time series
+const (
+	PriceLast        = "last"        // latest price on or before the date
+	PriceInterpolate = "interpolate" // linear interpolation between prices
+	PriceStrict      = "strict"      // latest price, but only if recent
+)
+
+var priceMethods = []string{PriceLast, PriceInterpolate, PriceStrict}
+
+// How to find prices on dates that have none: the method, and for strict,
+// how many days old a price may be
+type PricePolicy struct {
+	Method string
+	Days   int
+}
+
+// Policy used unless a report asks for another (see setPricePolicy)
+var pricePolicy = PricePolicy{Method: PriceLast, Days: 7}
+
+// A price looked up on a date, with the date of the price used
+type PriceAt struct {
+	Price        float64
+	Date         time.Time // date of the price, or of the earlier one if interpolated
+	Interpolated bool      // between the price on Date and the next one
+	OK           bool      // false if no prices, or none recent enough for strict
+}
+
+// Get price on a date using a policy. Before the first price, uses the
+// first price, except for strict, which only uses a price on or before the
+// date that is no more than the number of days old. If there is no price
+// to use, the price is 0 and not OK, with the date of the nearest price.
+func priceOn(ts TimeSeries, on time.Time, policy PricePolicy) PriceAt {
 
-	// Return last price if on or after last date
-	if later(on, ts[len(ts)-1].d) || sameDate(on, ts[len(ts)-1].d) {
-		return ts[len(ts)-1].p
+	// No price if series is empty
+	if len(ts) == 0 {
+		return PriceAt{}
 	}
 
-	// Otherwise search for first date that is on or after requested date
-	for i := 1; i < len(ts); i++ {
+	// Find the last price on or before the date, or the first one
+	i := max(ts.after(on)-1, 0)
+	pa := PriceAt{Price: ts[i].p, Date: ts[i].d, OK: true}
+	switch policy.Method {
 
-		// Exact date, return price
-		if sameDate(ts[i].d, on) {
-			return ts[i].p
+	// Strict: must be on or before the date, and recent enough
+	case PriceStrict:
+		if (later(ts[i].d, on) && !sameDate(ts[i].d, on)) || daysBetween(ts[i].d, on) > policy.Days {
+			return PriceAt{Date: ts[i].d}
 		}
 
-		// Price is after requested date, interpolate
-		if later(ts[i].d, on) {
-			d0 := ts[i-1].d                // date before
-			p0 := ts[i-1].p                // price before
-			d1 := ts[i].d                  // date after
-			p1 := ts[i].p                  //price after
-			interval := d1.Sub(d0).Hours() // interval between time series dates
-			delta := on.Sub(d0).Hours()    // interval between earlier date and target
-			return p0 + (p1-p0)*(delta/interval)
+	// Interpolate: between this price and the next, unless on a price
+	// date or outside the series
+	case PriceInterpolate:
+		if !sameDate(ts[i].d, on) && ts[i].d.Before(on) && i+1 < len(ts) {
+			pa.Price = priceOnInterpolate(ts, on)
+			pa.Interpolated = true
 		}
 	}
+	return pa
+}
 
-	// Should never happen
-	fmt.Println("Unable to interpolate date")
-	return 0
+// Price policy from a report's query string, "policy" for the method and
+// "days" for strict, default the global policy
+func reportPricePolicy(get func(string) string) PricePolicy {
+	policy := pricePolicy
+	if m := get("policy"); slices.Contains(priceMethods, m) {
+		policy.Method = m
+	}
+	if days := parseIntOr(get("days"), policy.Days); days >= 0 {
+		policy.Days = days
+	}
+	return policy
+}
+
+// Set the global price policy from environment variables: PRICE_POLICY is
+// last (default), interpolate or strict, and PRICE_DAYS the number of days
+// old a price may be for strict (default 7)
+func setPricePolicy() {
+	pricePolicy = reportPricePolicy(func(name string) string {
+		return os.Getenv("PRICE_" + strings.ToUpper(name))
+	})
 }
 
 // Determine if two dates are the same, ignoring time
@@ -145,3 +206,191 @@ func earlier(d1, d2 time.Time) bool {
 func later(d1, d2 time.Time) bool {
 	return d1.After(d2) //!sameDate(d1, d2) && !earlier(d1, d2)
 }
+
+//----------------------------------------------------------------//
+//                      TIME SERIES OPERATIONS                    //
+//----------------------------------------------------------------//
+
+// All of these assume the series is sorted by date, and dates are compared
+// ignoring time of day. Lookups are by binary search.
+
+// Ways to resample a time series
+const (
+	Weekly  = "week"  // Monday to Sunday
+	Monthly = "month" // calendar month
+
+	ResampleLast    = "last"    // last value in each period
+	ResampleAverage = "average" // mean of the values in each period
+)
+
+// First, highest, lowest and last values of a time series in a period,
+// dated by the last point in the period
+type OHLC struct {
+	Date                   time.Time
+	Open, High, Low, Close float64
+}
+
+// Index of the first point after a date, i.e., the number of points on or
+// before it
+func (ts TimeSeries) after(on time.Time) int {
+	return sort.Search(len(ts), func(i int) bool {
+		return ts[i].d.After(on) && !sameDate(ts[i].d, on)
+	})
+}
+
+// Index of the first point on or after a date
+func (ts TimeSeries) from(on time.Time) int {
+	return sort.Search(len(ts), func(i int) bool {
+		return !ts[i].d.Before(on) || sameDate(ts[i].d, on)
+	})
+}
+
+// Insert a point in date order, replacing the value of any point on the
+// same date
+func (ts *TimeSeries) Insert(d time.Time, p float64) {
+	i := ts.after(d)
+	if i > 0 && sameDate((*ts)[i-1].d, d) {
+		(*ts)[i-1].p = p
+		return
+	}
+	*ts = slices.Insert(*ts, i, TimeSeriesPoint{d, p})
+}
+
+// Last point on or before a date, false if none
+func (ts TimeSeries) At(on time.Time) (TimeSeriesPoint, bool) {
+	i := ts.after(on)
+	if i == 0 {
+		return TimeSeriesPoint{}, false
+	}
+	return ts[i-1], true
+}
+
+// Points between two dates, inclusive. Shares the underlying array.
+func (ts TimeSeries) Between(from, to time.Time) TimeSeries {
+	i, j := ts.from(from), ts.after(to)
+	if j < i {
+		return ts[i:i]
+	}
+	return ts[i:j]
+}
+
+// Index ranges of the points in each week or month, in order
+func (ts TimeSeries) periods(period string) [][2]int {
+	key := func(d time.Time) int {
+		if period == Weekly {
+			y, w := d.ISOWeek()
+			return y*100 + w
+		}
+		return d.Year()*100 + int(d.Month())
+	}
+	pp := [][2]int{}
+	for i := 0; i < len(ts); {
+		j := i + 1
+		for j < len(ts) && key(ts[j].d) == key(ts[i].d) {
+			j++
+		}
+		pp = append(pp, [2]int{i, j})
+		i = j
+	}
+	return pp
+}
+
+// Resample to one point for each week or month with any points, dated by
+// the last point in the period, with the last or average value
+func (ts TimeSeries) Resample(period, how string) TimeSeries {
+	out := TimeSeries{}
+	for _, r := range ts.periods(period) {
+		pt := ts[r[1]-1]
+		if how == ResampleAverage {
+			var sum float64
+			for _, x := range ts[r[0]:r[1]] {
+				sum += x.p
+			}
+			pt.p = sum / float64(r[1]-r[0])
+		}
+		out = append(out, pt)
+	}
+	return out
+}
+
+// Resample to the first, highest, lowest and last values in each week or
+// month with any points
+func (ts TimeSeries) ResampleOHLC(period string) []OHLC {
+	out := []OHLC{}
+	for _, r := range ts.periods(period) {
+		o := OHLC{Date: ts[r[1]-1].d, Open: ts[r[0]].p, High: ts[r[0]].p, Low: ts[r[0]].p,
+			Close: ts[r[1]-1].p}
+		for _, x := range ts[r[0]:r[1]] {
+			o.High = max(o.High, x.p)
+			o.Low = min(o.Low, x.p)
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+// Values on each of a list of dates (in order), from the last point on or
+// before each one. Dates before the first point are left out.
+func (ts TimeSeries) FillForward(dates []time.Time) TimeSeries {
+	out := TimeSeries{}
+	i := 0
+	for _, d := range dates {
+		for i < len(ts) && (!ts[i].d.After(d) || sameDate(ts[i].d, d)) {
+			i++
+		}
+		if i > 0 {
+			out = append(out, TimeSeriesPoint{d, ts[i-1].p})
+		}
+	}
+	return out
+}
+
+// Align several series on a common calendar: every date in any of them
+// from the first date all of them have a value, with each series filled
+// forward to those dates. Nil if any series is empty.
+func alignSeries(series []TimeSeries) ([]time.Time, []TimeSeries) {
+	var start time.Time
+	for _, ts := range series {
+		if len(ts) == 0 {
+			return nil, nil
+		}
+		if ts[0].d.After(start) {
+			start = ts[0].d
+		}
+	}
+	dates := []time.Time{}
+	for _, ts := range series {
+		for _, pt := range ts[ts.from(start):] {
+			dates = append(dates, pt.d)
+		}
+	}
+	dates = uniqueDates(dates)
+	aligned := []TimeSeries{}
+	for _, ts := range series {
+		aligned = append(aligned, ts.FillForward(dates))
+	}
+	return dates, aligned
+}
+
+// Returns from each point to the next, as fractions dated by the later
+// point, leaving out any where the earlier value is not positive
+func (ts TimeSeries) Returns() TimeSeries {
+	out := TimeSeries{}
+	for i := 1; i < len(ts); i++ {
+		if ts[i-1].p > 0 {
+			out = append(out, TimeSeriesPoint{ts[i].d, ts[i].p/ts[i-1].p - 1})
+		}
+	}
+	return out
+}
+
+// Return from one date to another, as a fraction, from the last values on
+// or before each date. False if there is no positive value at the start.
+func (ts TimeSeries) Return(from, to time.Time) (float64, bool) {
+	p0, ok0 := ts.At(from)
+	p1, ok1 := ts.At(to)
+	if !ok0 || !ok1 || p0.p <= 0 {
+		return 0, false
+	}
+	return p1.p/p0.p - 1, true
+}
@@ -0,0 +1,271 @@
+// Unit tests and benchmarks for time series
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Series from pairs of dates and values
+func series(dates []string, values []float64) TimeSeries {
+	ts := TimeSeries{}
+	for i, ds := range dates {
+		ts = append(ts, TimeSeriesPoint{parseDate(ds), values[i]})
+	}
+	return ts
+}
+
+// Daily series of n points from a date, a random walk from 100
+func dailySeries(n int) TimeSeries {
+	rnd := rand.New(rand.NewSource(1))
+	ts := make(TimeSeries, 0, n)
+	d, p := time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC), 100.0
+	for i := 0; i < n; i++ {
+		ts = append(ts, TimeSeriesPoint{d.AddDate(0, 0, i), p})
+		p *= 1 + (rnd.Float64()-0.5)/50
+	}
+	return ts
+}
+
+// Latest price by scanning the series, to compare with the binary search
+func latestPriceScan(ts TimeSeries, on time.Time) float64 {
+	p := ts[0].p
+	for _, pt := range ts {
+		if pt.d.After(on) && !sameDate(pt.d, on) {
+			break
+		}
+		p = pt.p
+	}
+	return p
+}
+
+// Test lookups by binary search, and interpolation
+func TestTimeSeriesLookup(t *testing.T) {
+
+	// Binary search gives the same prices as a scan, including before the
+	// first date, on each date, between dates and after the last
+	ts := dailySeries(200)
+	ts = append(ts[:50:50], ts[60:]...) // leave a gap
+	first := ts[0].d
+	for i := -5; i < 220; i++ {
+		for _, h := range []int{0, 12} {
+			on := first.AddDate(0, 0, i).Add(time.Duration(h) * time.Hour)
+			if p, want := latestPriceAt(ts, on), latestPriceScan(ts, on); p != want {
+				t.Errorf("Latest price on %s: %f, want %f", on, p, want)
+			}
+		}
+	}
+
+	// At is false before the first point
+	if _, ok := ts.At(first.AddDate(0, 0, -1)); ok {
+		t.Error("Point before first date")
+	}
+	if pt, ok := ts.At(first.AddDate(0, 0, 55)); !ok || !sameDate(pt.d, first.AddDate(0, 0, 49)) {
+		t.Errorf("Point in gap: %v", pt)
+	}
+
+	// Interpolation in the gap
+	on := first.AddDate(0, 0, 55)
+	p0, p1 := ts[49].p, ts[50].p
+	if p := priceOnInterpolate(ts, on); math.Abs(p-(p0+(p1-p0)*6/11)) > 1e-9 {
+		t.Errorf("Interpolated price: %f", p)
+	}
+}
+
+// Test inserting points in date order
+func TestTimeSeriesInsert(t *testing.T) {
+
+	// Insert out of order, and replace a value on the same date
+	ts := TimeSeries{}
+	for _, x := range []struct {
+		ds string
+		p  float64
+	}{{"2024-03-01", 3}, {"2024-01-01", 1}, {"2024-02-01", 2}, {"2024-04-01", 4}, {"2024-02-01", 20}} {
+		ts.Insert(parseDate(x.ds), x.p)
+	}
+	want := series([]string{"2024-01-01", "2024-02-01", "2024-03-01", "2024-04-01"},
+		[]float64{1, 20, 3, 4})
+	if len(ts) != len(want) {
+		t.Fatalf("Inserted: %v", ts)
+	}
+	for i := range ts {
+		if ts[i] != want[i] {
+			t.Errorf("Inserted: %v", ts)
+			break
+		}
+	}
+}
+
+// Test points between two dates
+func TestTimeSeriesBetween(t *testing.T) {
+	ts := series([]string{"2024-01-01", "2024-01-05", "2024-01-10", "2024-01-15"},
+		[]float64{1, 2, 3, 4})
+	tests := []struct {
+		from, to string
+		want     []float64
+	}{
+		{"2024-01-01", "2024-01-15", []float64{1, 2, 3, 4}},
+		{"2024-01-02", "2024-01-10", []float64{2, 3}},
+		{"2023-01-01", "2024-01-04", []float64{1}},
+		{"2024-01-16", "2025-01-01", []float64{}},
+		{"2024-01-11", "2024-01-09", []float64{}},
+	}
+	for _, tt := range tests {
+		got := ts.Between(parseDate(tt.from), parseDate(tt.to))
+		ok := len(got) == len(tt.want)
+		for i := 0; ok && i < len(got); i++ {
+			ok = got[i].p == tt.want[i]
+		}
+		if !ok {
+			t.Errorf("Between %s and %s: %v", tt.from, tt.to, got)
+		}
+	}
+}
+
+// Test resampling to weeks and months
+func TestTimeSeriesResample(t *testing.T) {
+
+	// Two weeks (Monday 2024-01-01 to Sunday 2024-01-14) and part of a
+	// third, and February
+	ts := series([]string{"2024-01-01", "2024-01-03", "2024-01-07", "2024-01-08", "2024-01-12",
+		"2024-01-15", "2024-02-01", "2024-02-29"}, []float64{10, 14, 12, 11, 13, 9, 20, 22})
+
+	// Weekly, last and average
+	last := ts.Resample(Weekly, ResampleLast)
+	avg := ts.Resample(Weekly, ResampleAverage)
+	if len(last) != 5 || last[0].p != 12 || formatDate(last[0].d) != "2024-01-07" ||
+		last[1].p != 13 || last[2].p != 9 {
+		t.Errorf("Weekly last: %v", last)
+	}
+	if len(avg) != 5 || avg[0].p != 12 || avg[1].p != 12 || avg[4].p != 22 {
+		t.Errorf("Weekly average: %v", avg)
+	}
+
+	// Monthly
+	monthly := ts.Resample(Monthly, ResampleLast)
+	if len(monthly) != 2 || monthly[0].p != 9 || formatDate(monthly[1].d) != "2024-02-29" {
+		t.Errorf("Monthly last: %v", monthly)
+	}
+
+	// Monthly OHLC
+	ohlc := ts.ResampleOHLC(Monthly)
+	want := []OHLC{{parseDate("2024-01-15"), 10, 14, 9, 9}, {parseDate("2024-02-29"), 20, 22, 20, 22}}
+	if len(ohlc) != 2 || ohlc[0] != want[0] || ohlc[1] != want[1] {
+		t.Errorf("Monthly OHLC: %v", ohlc)
+	}
+
+	// Weeks that span a year end
+	ts = series([]string{"2024-12-30", "2025-01-02", "2025-01-06"}, []float64{1, 2, 3})
+	if last := ts.Resample(Weekly, ResampleLast); len(last) != 2 || last[0].p != 2 {
+		t.Errorf("Weekly across year end: %v", last)
+	}
+}
+
+// Test filling forward, and aligning series on common dates
+func TestTimeSeriesAlign(t *testing.T) {
+
+	// Forward fill, leaving out dates before the first point
+	a := series([]string{"2024-01-02", "2024-01-04", "2024-01-05"}, []float64{1, 2, 3})
+	b := series([]string{"2024-01-01", "2024-01-03", "2024-01-05"}, []float64{10, 20, 30})
+	dd := []time.Time{parseDate("2024-01-01"), parseDate("2024-01-03"), parseDate("2024-01-06")}
+	if f := a.FillForward(dd); len(f) != 2 || f[0].p != 1 || f[1].p != 3 || !sameDate(f[0].d, dd[1]) {
+		t.Errorf("Fill forward: %v", f)
+	}
+
+	// Common calendar from the first date both have a value
+	dates, aligned := alignSeries([]TimeSeries{a, b})
+	want := []string{"2024-01-02", "2024-01-03", "2024-01-04", "2024-01-05"}
+	wantA := []float64{1, 1, 2, 3}
+	wantB := []float64{10, 20, 20, 30}
+	if len(dates) != len(want) || len(aligned) != 2 {
+		t.Fatalf("Aligned dates: %v", dates)
+	}
+	for i, d := range dates {
+		if formatDate(d) != want[i] || aligned[0][i].p != wantA[i] || aligned[1][i].p != wantB[i] {
+			t.Errorf("Aligned on %s: %v, %v", want[i], aligned[0][i], aligned[1][i])
+		}
+	}
+	if dates, aligned := alignSeries([]TimeSeries{a, {}}); dates != nil || aligned != nil {
+		t.Error("Aligned with empty series")
+	}
+}
+
+// Test returns from each point to the next, and between two dates
+func TestTimeSeriesReturns(t *testing.T) {
+	ts := series([]string{"2024-01-01", "2024-02-01", "2024-03-01", "2024-04-01"},
+		[]float64{100, 110, 0, 50})
+
+	// No return after a zero
+	rr := ts.Returns()
+	if len(rr) != 2 || math.Abs(rr[0].p-0.1) > 1e-9 || rr[1].p != -1 || formatDate(rr[0].d) != "2024-02-01" {
+		t.Errorf("Returns: %v", rr)
+	}
+
+	// Return between dates, none before the first
+	if r, ok := ts.Return(parseDate("2024-01-15"), parseDate("2024-02-15")); !ok || math.Abs(r-0.1) > 1e-9 {
+		t.Errorf("Return: %f, %v", r, ok)
+	}
+	if _, ok := ts.Return(parseDate("2023-12-01"), parseDate("2024-02-15")); ok {
+		t.Error("Return from before first date")
+	}
+}
+
+func BenchmarkLatestPriceAt(b *testing.B) {
+	ts := dailySeries(10 * 365)
+	first := ts[0].d
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		latestPriceAt(ts, first.AddDate(0, 0, i%len(ts)))
+	}
+}
+
+func BenchmarkPriceOnInterpolate(b *testing.B) {
+	ts := dailySeries(10 * 365)
+	first := ts[0].d
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		priceOnInterpolate(ts, first.AddDate(0, 0, i%len(ts)).Add(12*time.Hour))
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	src := dailySeries(1000)
+	rand.New(rand.NewSource(1)).Shuffle(len(src), func(i, j int) { src[i], src[j] = src[j], src[i] })
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts := TimeSeries{}
+		for _, pt := range src {
+			ts.Insert(pt.d, pt.p)
+		}
+	}
+}
+
+func BenchmarkResample(b *testing.B) {
+	ts := dailySeries(10 * 365)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts.Resample(Weekly, ResampleAverage)
+	}
+}
+
+func BenchmarkResampleOHLC(b *testing.B) {
+	ts := dailySeries(10 * 365)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts.ResampleOHLC(Weekly)
+	}
+}
+
+func BenchmarkAlignSeries(b *testing.B) {
+	all := []TimeSeries{}
+	for i := 0; i < 20; i++ {
+		all = append(all, dailySeries(5 * 365)[i*10:])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		alignSeries(all)
+	}
+}
@@ -0,0 +1,149 @@
+// Transfers: moving units of a stock between accounts (e.g., brokers) in
+// kind, keeping the lots' original dates and cost, so no gain is realized
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Show form to edit/create a transfer. Edits the transfer if an ID is
+// provided. If zero, adds a transfer for the stock ID expected in the
+// query string.
+func editTransfer(c *gin.Context) {
+
+	// Get transfer ID (will be 0 to add)
+	uid := portfolioOwner(c)
+	tid := parseInt(c.Param("tid"))
+	if tid < 0 {
+		c.String(http.StatusNotFound, "Invalid transfer ID")
+		return
+	}
+
+	// If transfer ID is zero, create a "blank" transfer, otherwise get
+	// the transfer. Blank transfer requires a stock as query string.
+	var t *Transfer
+	if tid == 0 {
+		sid_, _ := c.GetQuery("sid")
+		sid := parseInt(sid_)
+		if sid <= 0 {
+			c.String(http.StatusNotFound, "Missing stock ID, required for adding transfer")
+			return
+		}
+		t = &Transfer{Stock: sid, Date: lastTransDate(uid)}
+	} else {
+		t = getTransfer(uid, tid)
+		if t == nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("Transfer %d not found", tid))
+			return
+		}
+	}
+
+	// Get the stock as well, and units currently held in each account
+	s := getStock(uid, t.Stock)
+	if s == nil {
+		c.String(http.StatusNotFound, "Stock not found")
+		return
+	}
+	held := map[string]float64{}
+	if p, ok := getPositions(uid, today())[s.Id]; ok {
+		held = p.Accounts()
+	}
+
+	// Show the form to edit transfer
+	showPage(c, "edit_transfer.html",
+		gin.H{"t": t, "s": s, "held": held, "accounts": getAccounts(uid), "current": "Stocks"})
+}
+
+// Process form to update or add a transfer
+func saveTransfer(c *gin.Context) {
+
+	// Get transfer and stock ID (tid will be 0 to add)
+	uid := portfolioOwner(c)
+	tid_, ok1 := c.GetPostForm("tid")
+	sid_, ok2 := c.GetPostForm("sid")
+	tid := parseInt(tid_)
+	sid := parseInt(sid_)
+	if !ok1 || !ok2 || sid < 0 || tid < 0 {
+		c.String(http.StatusOK, "saveTransfer: Missing or invalid stock and transfer IDs")
+		return
+	}
+
+	// Make sure the stock belongs to this user
+	if getStock(uid, sid) == nil {
+		c.String(http.StatusNotFound, "saveTransfer: stock not found")
+		return
+	}
+
+	// Get the transfer or create a "blank" one
+	t := &Transfer{Id: tid, Stock: sid}
+	if tid > 0 {
+		t = getTransfer(uid, tid)
+		if t == nil {
+			c.String(http.StatusNotFound, "saveTransfer: not found")
+			return
+		}
+	}
+	old := *t
+
+	// Update the transfer with the form inputs
+	ds, _ := c.GetPostForm("date")
+	t.Date = parseDate(ds)
+	t.Q = parseFloat(c.PostForm("q"))
+	t.From = strings.TrimSpace(c.PostForm("from"))
+	t.To = strings.TrimSpace(c.PostForm("to"))
+	t.Comments, _ = c.GetPostForm("comments")
+
+	// Validate: can only move units held in the account on the date, not
+	// counting this transfer if it is being edited
+	if !validDate(t.Date) || t.Q <= 0 || t.From == t.To {
+		c.String(http.StatusOK, "Invalid inputs: requires a date, positive units, and different accounts")
+		return
+	}
+	var held float64
+	if p, ok := getPositions(uid, t.Date)[sid]; ok {
+		held = p.Accounts()[t.From]
+	}
+	if tid > 0 && !later(old.Date, t.Date) {
+		if old.From == t.From {
+			held += old.Q
+		} else if old.To == t.From {
+			held -= old.Q
+		}
+	}
+	if t.Q > held+1e-9 {
+		c.String(http.StatusOK, fmt.Sprintf("Invalid inputs: only %g units held in the account on %s",
+			held, formatDate(t.Date)))
+		return
+	}
+
+	// Create or update transfer in database
+	addUpdateTransfer(uid, t)
+
+	// Remember the last transaction date for next entry
+	setLastTransDate(uid, t.Date)
+
+	// Go back to stock page
+	c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", sid))
+}
+
+// Delete a transfer
+func doDeleteTransfer(c *gin.Context) {
+
+	// Get the transfer (URL positional param)
+	uid := portfolioOwner(c)
+	tid := parseInt(c.Param("tid"))
+	t := getTransfer(uid, tid)
+	if tid <= 0 || t == nil {
+		c.String(http.StatusNotFound, "Transfer not found")
+		return
+	}
+
+	// Delete transfer and go back to stock page
+	deleteTransfer(uid, tid)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/stock/%d", t.Stock))
+}
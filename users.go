@@ -0,0 +1,360 @@
+// Users: login sessions, access control, and sharing portfolios
+
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Name of the cookie holding the session token
+const sessionCookie = "session"
+
+// Name of the cookie holding the ID of the portfolio being viewed
+const portfolioCookie = "portfolio"
+
+// Name of the cookie holding the CSRF token of the login form
+const loginCookie = "login_csrf"
+
+// How long a login remains valid
+const sessionMaxAge = 30 * 24 * time.Hour
+
+// Number of PBKDF2 iterations for password hashes
+const pwIterations = 100000
+
+//-----------------------------------------------------------------//
+//                         ACCESS CONTROL                          //
+//-----------------------------------------------------------------//
+
+// Middleware for all pages that require a login: looks up the user
+// from the session cookie, and determines which portfolio is being
+// viewed (the user's own, or one shared with them). Redirects to the
+// login page if not logged in.
+func authRequired(c *gin.Context) {
+
+	// Get the user from the session token
+	token, _ := c.Cookie(sessionCookie)
+	u := getSessionUser(token)
+	if u == nil {
+		c.Redirect(http.StatusFound, "/login")
+		c.Abort()
+		return
+	}
+	c.Set("user", u)
+
+	// Use own portfolio, unless another has been selected and it
+	// is shared with this user
+	owner := u.Id
+	pid, err := c.Cookie(portfolioCookie)
+	if err == nil {
+		oid := parseInt(pid)
+		if oid > 0 && oid != u.Id && isShared(oid, u.Id) {
+			owner = oid
+		}
+	}
+	c.Set("owner", owner)
+	c.Next()
+}
+
+// Middleware for pages that change data: only allowed if the user
+// is viewing their own portfolio, i.e., not a shared one
+func editRequired(c *gin.Context) {
+	if !canEdit(c) {
+		c.String(http.StatusForbidden, "This portfolio is shared with you read-only")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// User logged in for this request, set by authRequired()
+func currentUser(c *gin.Context) *User {
+	return c.MustGet("user").(*User)
+}
+
+// ID of the user whose portfolio is being viewed, set by authRequired()
+func portfolioOwner(c *gin.Context) int {
+	return c.MustGet("owner").(int)
+}
+
+// Whether the current user may change the portfolio being viewed
+func canEdit(c *gin.Context) bool {
+	return portfolioOwner(c) == currentUser(c).Id
+}
+
+// Middleware that rejects any request that may change data, i.e.,
+// anything but GET or HEAD, unless it carries the session's CSRF token
+// as a "csrf" form field or an X-CSRF-Token header. Must come after
+// authRequired().
+func csrfRequired(c *gin.Context) {
+
+	// Safe methods need no token
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		c.Next()
+		return
+	}
+
+	// Get token from header, or from form
+	token := c.GetHeader("X-CSRF-Token")
+	if token == "" {
+		token = c.PostForm("csrf")
+	}
+
+	// Compare with the expected token for this session
+	if subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken(c))) != 1 {
+		c.String(http.StatusForbidden, "Invalid or missing CSRF token, please reload the form")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// CSRF token for the current session
+func csrfToken(c *gin.Context) string {
+	token, _ := c.Cookie(sessionCookie)
+	return sessionCSRFToken(token)
+}
+
+// CSRF token for a session, derived from the session token so it needs
+// no storage but can't be used to recover the session
+func sessionCSRFToken(token string) string {
+	h := sha256.Sum256([]byte("csrf:" + token))
+	return hex.EncodeToString(h[:])
+}
+
+// Show a page, adding the menu, the user information needed by
+// the menu, and the CSRF token needed by forms on every page
+func showPage(c *gin.Context, tmpl string, data gin.H) {
+	u := currentUser(c)
+	data["menu"] = menu
+	data["csrf"] = csrfToken(c)
+	data["user"] = u
+	data["owner"] = portfolioOwner(c)
+	data["readonly"] = !canEdit(c)
+	data["shared"] = getSharedTo(u.Id)
+	c.HTML(http.StatusOK, tmpl, data)
+}
+
+//-----------------------------------------------------------------//
+//                         LOGIN / LOGOUT                          //
+//-----------------------------------------------------------------//
+
+// Show the login form
+func showLogin(c *gin.Context) {
+	showLoginForm(c, http.StatusOK, "")
+}
+
+// Show the login form with an error message, if any. As there is no
+// session yet, the form's CSRF token is a random one, also set in a
+// cookie, which the login must match. This stops another site logging a
+// user in to the attacker's account, so that what they enter is saved
+// there.
+func showLoginForm(c *gin.Context, status int, msg string) {
+	token := newToken()
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(loginCookie, token, 3600, "/login", "", false, true)
+	c.HTML(status, "login.html", gin.H{"error": msg, "csrf": token})
+}
+
+// Check user name and password, and start a session if valid
+func doLogin(c *gin.Context) {
+
+	// Check the login form's token
+	cookie, _ := c.Cookie(loginCookie)
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(c.PostForm("csrf")), []byte(cookie)) != 1 {
+		showLoginForm(c, http.StatusForbidden, "Login form expired, please try again")
+		return
+	}
+
+	// Look up user and check password
+	name, _ := c.GetPostForm("name")
+	pw, _ := c.GetPostForm("password")
+	u := getUserByName(strings.TrimSpace(name))
+	if u == nil || !checkPassword(pw, u.PwHash) {
+		showLoginForm(c, http.StatusUnauthorized, "Invalid user name or password")
+		return
+	}
+
+	// Create a session, and set the cookie
+	token := newToken()
+	addSession(token, u.Id)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, token, int(sessionMaxAge.Seconds()), "/", "", false, true)
+	c.SetCookie(portfolioCookie, "", -1, "/", "", false, true)
+	c.SetCookie(loginCookie, "", -1, "/login", "", false, true)
+
+	// Go to the portfolio page
+	c.Redirect(http.StatusFound, "/Portfolio")
+}
+
+// End the current session
+func doLogout(c *gin.Context) {
+	token, err := c.Cookie(sessionCookie)
+	if err == nil {
+		deleteSession(token)
+	}
+	c.SetCookie(sessionCookie, "", -1, "/", "", false, true)
+	c.SetCookie(portfolioCookie, "", -1, "/", "", false, true)
+	c.Redirect(http.StatusFound, "/login")
+}
+
+//-----------------------------------------------------------------//
+//                            SHARING                              //
+//-----------------------------------------------------------------//
+
+// Show page with users this portfolio is shared with, and the
+// portfolios others have shared with the current user
+func showSharing(c *gin.Context) {
+	u := currentUser(c)
+	showPage(c, "sharing.html",
+		gin.H{"sharedWith": getSharedWith(u.Id), "current": "Sharing"})
+}
+
+// Share the current user's portfolio read-only with another user
+func saveShare(c *gin.Context) {
+
+	// Find the other user
+	u := currentUser(c)
+	name, _ := c.GetPostForm("name")
+	other := getUserByName(strings.TrimSpace(name))
+	if other == nil {
+		c.String(http.StatusNotFound, "User not found")
+		return
+	}
+	if other.Id == u.Id {
+		c.String(http.StatusBadRequest, "Cannot share a portfolio with yourself")
+		return
+	}
+
+	// Add sharing and go back to sharing page
+	addShare(u.Id, other.Id)
+	c.Redirect(http.StatusFound, "/Sharing")
+}
+
+// Stop sharing the current user's portfolio with another user
+func delShare(c *gin.Context) {
+	u := currentUser(c)
+	uid := parseInt(c.Param("uid"))
+	deleteShare(u.Id, uid)
+	c.Redirect(http.StatusFound, "/Sharing")
+}
+
+// Switch to viewing another user's portfolio (if shared with the
+// current user), or back to one's own if the ID is the user's own. A POST,
+// as it changes what later requests see.
+func viewPortfolio(c *gin.Context) {
+	u := currentUser(c)
+	oid := parseInt(c.PostForm("uid"))
+	if oid != u.Id && !isShared(oid, u.Id) {
+		c.String(http.StatusNotFound, "Portfolio not found")
+		return
+	}
+	c.SetCookie(portfolioCookie, strconv.Itoa(oid), 0, "/", "", false, true)
+	c.Redirect(http.StatusFound, "/Portfolio")
+}
+
+//-----------------------------------------------------------------//
+//                   PASSWORDS, TOKENS, NEW USERS                  //
+//-----------------------------------------------------------------//
+
+// Hash a password with a random salt, returned as "salt$hash" in hex
+func hashPassword(pw string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	h, err := pbkdf2.Key(sha256.New, pw, salt, pwIterations, 32)
+	if err != nil {
+		panic("hashPassword: " + err.Error())
+	}
+	return hex.EncodeToString(salt) + "$" + hex.EncodeToString(h)
+}
+
+// Check a password against a hash created by hashPassword()
+func checkPassword(pw, stored string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err1 := hex.DecodeString(parts[0])
+	want, err2 := hex.DecodeString(parts[1])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	h, err := pbkdf2.Key(sha256.New, pw, salt, pwIterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(h, want) == 1
+}
+
+// Create a random token, used for sessions
+func newToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Add a user, or change their password if they exist, from the
+// command line: "./portfolio adduser <name>" prompts for the password
+func addUserCommand(name string) {
+
+	// Read password from standard input
+	fmt.Printf("Password for %s: ", name)
+	pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Println("adduser:", err)
+		os.Exit(1)
+	}
+	pw = strings.TrimSpace(pw)
+	if len(name) == 0 || len(pw) == 0 {
+		fmt.Println("adduser: name and password cannot be blank")
+		os.Exit(1)
+	}
+
+	// Create or update user
+	u := getUserByName(name)
+	if u == nil {
+		u = &User{Name: name}
+	}
+	u.PwHash = hashPassword(pw)
+	addUpdateUser(u)
+	fmt.Println("Saved user", name)
+}
+
+//-----------------------------------------------------------------//
+//                     LAST DATE ENTERED, PER USER                 //
+//-----------------------------------------------------------------//
+
+// Last date entered on a transaction this session, for each user
+var lastTransDates = map[int]time.Time{}
+var lastTransMutex sync.Mutex
+
+// Last date a user entered on a transaction, or today if none
+func lastTransDate(uid int) time.Time {
+	lastTransMutex.Lock()
+	defer lastTransMutex.Unlock()
+	d, ok := lastTransDates[uid]
+	if !ok {
+		return time.Now()
+	}
+	return d
+}
+
+// Remember the last date a user entered on a transaction
+func setLastTransDate(uid int, d time.Time) {
+	lastTransMutex.Lock()
+	defer lastTransMutex.Unlock()
+	lastTransDates[uid] = d
+}
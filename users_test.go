@@ -0,0 +1,260 @@
+// Tests of access control, with a test database and the real router
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A user logged in to the test server
+type testUser struct {
+	id    int
+	token string // session token
+}
+
+// Start a test server with a new database, and log in users with names
+func testServer(t *testing.T, names ...string) (*gin.Engine, []testUser) {
+	testDB(t)
+
+	// Router without logging
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	r := newRouter()
+
+	// Users, each with a session
+	users := []testUser{}
+	for _, name := range names {
+		u := testUser{id: addTestUser(name), token: newToken()}
+		addSession(u.token, u.id)
+		users = append(users, u)
+	}
+	return r, users
+}
+
+// Make a request as a user, viewing a portfolio (0 for their own), with
+// a form if not nil. The session's CSRF token is added to the form unless
+// it already has one (nil for none).
+func (u testUser) request(r *gin.Engine, method, path string, form url.Values,
+	portfolio int) *httptest.ResponseRecorder {
+	if form != nil {
+		if _, ok := form["csrf"]; !ok {
+			form.Set("csrf", sessionCSRFToken(u.token))
+		}
+	}
+	req := formRequest(method, path, form)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: u.token})
+	if portfolio != 0 {
+		req.AddCookie(&http.Cookie{Name: portfolioCookie, Value: strconv.Itoa(portfolio)})
+	}
+	return serve(r, req)
+}
+
+// Request with a form, if not nil
+func formRequest(method, path string, form url.Values) *http.Request {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req := httptest.NewRequest(method, path, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req
+}
+
+// Send a request to the router, and get the response
+func serve(r *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// Test that one user can't see or change another's data, and that a
+// portfolio shared read-only can't be changed
+func TestAccessControl(t *testing.T) {
+	r, users := testServer(t, "alice", "bob")
+	alice, bob := users[0], users[1]
+
+	// Alice's stock, transaction and cash
+	d := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	addUpdateStock(alice.id, &Stock{Code: "ALI", Name: "Alice's stock", Currency: "EUR"})
+	sid := getStocks(alice.id)[0].Id
+	addUpdateTransaction(alice.id, &Transaction{Stock: sid, Date: d, Q: 10, Amount: 1000})
+	tid := getTransactions(alice.id, sid)[0].Id
+	addUpdateCash(alice.id, &Cash{Date: d, Type: "Deposit", Amount: 500})
+	cid := getCashTransactions(alice.id)[0].Id
+	unchanged := func(when string) {
+		if s := getStock(alice.id, sid); s == nil || s.Code != "ALI" {
+			t.Errorf("%s: stock changed: %+v", when, s)
+		}
+		if tr := getTransaction(alice.id, tid); tr == nil || tr.Q != 10 {
+			t.Errorf("%s: transaction changed: %+v", when, tr)
+		}
+		if c := getCashTransaction(alice.id, cid); c == nil || c.Amount != 500 {
+			t.Errorf("%s: cash changed: %+v", when, c)
+		}
+		if len(getStocks(bob.id)) != 0 || len(getCashTransactions(bob.id)) != 0 {
+			t.Errorf("%s: data added for bob", when)
+		}
+	}
+
+	// Alice can see her own data
+	for _, path := range []string{"/stock/" + strconv.Itoa(sid), "/cash/" + strconv.Itoa(cid)} {
+		if w := alice.request(r, "GET", path, nil, 0); w.Code != http.StatusOK {
+			t.Errorf("Alice GET %s: %d", path, w.Code)
+		}
+	}
+
+	// Bob can't see it
+	for _, path := range []string{"/stock/" + strconv.Itoa(sid), "/cash/" + strconv.Itoa(cid),
+		"/edit_transaction/" + strconv.Itoa(tid)} {
+		w := bob.request(r, "GET", path, nil, 0)
+		if w.Code != http.StatusNotFound && strings.Contains(w.Body.String(), "ALI") {
+			t.Errorf("Bob GET %s: %d", path, w.Code)
+		}
+	}
+
+	// Bob can't change or delete it
+	bob.request(r, "POST", "/update_stock", url.Values{"id": {strconv.Itoa(sid)},
+		"code": {"BOB"}, "name": {"Bob's"}, "currency": {"EUR"}}, 0)
+	bob.request(r, "POST", "/update_transaction", url.Values{"tid": {strconv.Itoa(tid)},
+		"sid": {strconv.Itoa(sid)}, "date": {"2024-01-03"}, "q": {"1"}, "amount": {"1"},
+		"fees": {"0"}}, 0)
+	bob.request(r, "POST", "/update_cash", url.Values{"id": {strconv.Itoa(cid)},
+		"date": {"2024-01-03"}, "type": {"Deposit"}, "amount": {"1"}}, 0)
+	bob.request(r, "POST", "/delete_stock/"+strconv.Itoa(sid), url.Values{}, 0)
+	bob.request(r, "POST", "/delete_cash/"+strconv.Itoa(cid), url.Values{}, 0)
+	bob.request(r, "DELETE", "/cash/"+strconv.Itoa(cid), url.Values{}, 0)
+	unchanged("Bob's own portfolio")
+
+	// Viewing Alice's portfolio is ignored until it is shared
+	if w := bob.request(r, "GET", "/stock/"+strconv.Itoa(sid), nil, alice.id); w.Code != http.StatusNotFound {
+		t.Errorf("Bob GET stock before sharing: %d", w.Code)
+	}
+
+	// Once shared, Bob can see it but not change it
+	addShare(alice.id, bob.id)
+	if w := bob.request(r, "GET", "/stock/"+strconv.Itoa(sid), nil, alice.id); w.Code != http.StatusOK {
+		t.Errorf("Bob GET shared stock: %d", w.Code)
+	}
+	for _, req := range []struct {
+		method, path string
+		form         url.Values
+	}{
+		{"POST", "/update_stock", url.Values{"id": {strconv.Itoa(sid)}, "code": {"BOB"},
+			"name": {"Bob's"}, "currency": {"EUR"}}},
+		{"POST", "/update_transaction", url.Values{"tid": {strconv.Itoa(tid)},
+			"sid": {strconv.Itoa(sid)}, "date": {"2024-01-03"}, "q": {"1"}, "amount": {"1"},
+			"fees": {"0"}}},
+		{"POST", "/update_cash", url.Values{"id": {strconv.Itoa(cid)}, "date": {"2024-01-03"},
+			"type": {"Deposit"}, "amount": {"1"}}},
+		{"POST", "/delete_stock/" + strconv.Itoa(sid), url.Values{}},
+		{"DELETE", "/cash/" + strconv.Itoa(cid), url.Values{}},
+	} {
+		if w := bob.request(r, req.method, req.path, req.form, alice.id); w.Code != http.StatusForbidden {
+			t.Errorf("Bob %s %s on shared portfolio: %d", req.method, req.path, w.Code)
+		}
+	}
+	unchanged("shared portfolio")
+}
+
+// Test that requests that change data need the session's CSRF token, in
+// the form or a header
+func TestCSRF(t *testing.T) {
+	r, users := testServer(t, "alice", "bob")
+	alice, bob := users[0], users[1]
+	currency := func(code string) url.Values {
+		return url.Values{"cid": {"0"}, "code": {code}, "name": {code}}
+	}
+
+	// Token in the form, then missing, or another session's
+	if w := alice.request(r, "POST", "/update_currency", currency("USD"), 0); w.Code != http.StatusFound {
+		t.Errorf("Form token: %d", w.Code)
+	}
+	bad := currency("GBP")
+	bad.Set("csrf", sessionCSRFToken(bob.token))
+	for _, form := range []url.Values{{"cid": {"0"}, "code": {"CHF"}, "name": {"CHF"}, "csrf": nil}, bad} {
+		if w := alice.request(r, "POST", "/update_currency", form, 0); w.Code != http.StatusForbidden {
+			t.Errorf("Missing or wrong token: %d", w.Code)
+		}
+	}
+
+	// Token in a header instead of the form
+	req := formRequest("POST", "/update_currency", currency("NZD"))
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: alice.token})
+	req.Header.Set("X-CSRF-Token", sessionCSRFToken(alice.token))
+	if w := serve(r, req); w.Code != http.StatusFound {
+		t.Errorf("Header token: %d", w.Code)
+	}
+	codes := []string{}
+	for _, cur := range getCurrencies(alice.id) {
+		codes = append(codes, cur.Code)
+	}
+	if strings.Join(codes, ",") != "NZD,USD" {
+		t.Errorf("Currencies saved: %v", codes)
+	}
+
+	// Viewing a shared portfolio sets a cookie, so needs a POST with a token
+	addShare(alice.id, bob.id)
+	view := func(form url.Values) bool {
+		w := bob.request(r, "POST", "/view", form, 0)
+		return strings.Contains(w.Header().Get("Set-Cookie"), portfolioCookie+"=")
+	}
+	if view(url.Values{"uid": {strconv.Itoa(alice.id)}, "csrf": nil}) {
+		t.Error("Viewed portfolio without token")
+	}
+	if !view(url.Values{"uid": {strconv.Itoa(alice.id)}}) {
+		t.Error("Could not view shared portfolio")
+	}
+	if w := bob.request(r, "GET", "/view/"+strconv.Itoa(alice.id), nil, 0); w.Code != http.StatusNotFound {
+		t.Errorf("GET view: %d", w.Code)
+	}
+}
+
+// Test that logging in needs the login form's token from its cookie
+func TestLoginCSRF(t *testing.T) {
+	r, _ := testServer(t, "alice")
+	login := func(token, cookie string) *httptest.ResponseRecorder {
+		req := formRequest("POST", "/login", url.Values{"name": {"alice"}, "password": {"pw"},
+			"csrf": {token}})
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: loginCookie, Value: cookie})
+		}
+		return serve(r, req)
+	}
+
+	// Token from the form
+	w := serve(r, httptest.NewRequest("GET", "/login", nil))
+	var token string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == loginCookie {
+			token = c.Value
+		}
+	}
+	if token == "" || !strings.Contains(w.Body.String(), token) {
+		t.Fatal("No login token")
+	}
+
+	// No cookie, or a token that doesn't match it
+	if w := login(token, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Login without cookie: %d", w.Code)
+	}
+	if w := login(newToken(), token); w.Code != http.StatusForbidden {
+		t.Errorf("Login with wrong token: %d", w.Code)
+	}
+
+	// Token and cookie match
+	w = login(token, token)
+	if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Set-Cookie"), sessionCookie+"=") {
+		t.Errorf("Login: %d", w.Code)
+	}
+}
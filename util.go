@@ -38,3 +38,19 @@ func formatFloat(n float64) string {
 	p := message.NewPrinter(language.English)
 	return p.Sprintf("%.2f", n)
 }
+
+// Returns default if blank, -1 if could not be parsed
+func parseIntOr(s string, def int) int {
+	if len(strings.TrimSpace(s)) == 0 {
+		return def
+	}
+	return parseInt(s)
+}
+
+// Returns default if blank, -1 if could not be parsed
+func parseFloatOr(s string, def float64) float64 {
+	if len(strings.TrimSpace(s)) == 0 {
+		return def
+	}
+	return parseFloat(s)
+}